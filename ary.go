@@ -0,0 +1,209 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// An AryTree is like a Tree, but each internal node has up to 'arity'
+// children instead of 2, which makes proofs shallower at the cost of more
+// sibling hashes per level. Leaves are hashed as in a Tree, and an internal
+// node with children c1, ..., cn is hashed as:
+//
+//		Hash(0x01 || c1 || ... || cn)
+//
+// The tree is built level by level: the nodes of each level are grouped
+// into runs of 'arity' nodes, starting from the left, and each group is
+// hashed to form a node of the next level. If the final group of a level
+// contains fewer than 'arity' nodes, it is hashed as-is, unless it contains
+// a single node, which is promoted to the next level unchanged. With an
+// arity of 2, an AryTree therefore produces the same roots as a Tree; the
+// Tree should be preferred in that case, as it is faster.
+type AryTree struct {
+	hash  hash.Hash
+	arity int
+
+	// levels[i] holds the nodes at height i that have not yet been joined
+	// into a node at height i+1. There are always fewer than 'arity' of
+	// them. pathPos[i] is the position within levels[i] of the node on the
+	// path from the leaf at proofIndex to the root, or -1 if there is none.
+	levels  [][][]byte
+	pathPos []int
+
+	currentIndex uint64
+	proofIndex   uint64
+	proofSet     [][]byte
+	proofTree    bool
+}
+
+// aryNodeSum returns the hash of an internal node with the given children.
+func aryNodeSum(h hash.Hash, children [][]byte) []byte {
+	return sum(h, append([][]byte{nodeHashPrefix}, children...)...)
+}
+
+// join hashes the group of nodes into their parent. If the node at pos is on
+// the proof path, the other nodes of the group are appended to proofSet.
+func (t *AryTree) join(group [][]byte, pos int, proofSet [][]byte) ([]byte, [][]byte) {
+	if pos >= 0 {
+		for i, node := range group {
+			if i != pos {
+				proofSet = append(proofSet, node)
+			}
+		}
+	}
+	return aryNodeSum(t.hash, group), proofSet
+}
+
+// insert adds a node at the given height, joining groups of 'arity' nodes
+// into their parent.
+func (t *AryTree) insert(height int, node []byte, onPath bool) {
+	if height == len(t.levels) {
+		t.levels = append(t.levels, nil)
+		t.pathPos = append(t.pathPos, -1)
+	}
+	if onPath {
+		t.pathPos[height] = len(t.levels[height])
+	}
+	t.levels[height] = append(t.levels[height], node)
+	if len(t.levels[height]) == t.arity {
+		group, pos := t.levels[height], t.pathPos[height]
+		t.levels[height], t.pathPos[height] = nil, -1
+		var parent []byte
+		parent, t.proofSet = t.join(group, pos, t.proofSet)
+		t.insert(height+1, parent, pos >= 0)
+	}
+}
+
+// collapse folds the unjoined nodes of every level into the Merkle root,
+// returning the root and the completed proof set. The AryTree is not
+// modified.
+func (t *AryTree) collapse() (root []byte, proofSet [][]byte) {
+	proofSet = append([][]byte(nil), t.proofSet...)
+	var carry []byte
+	carryOnPath := false
+	for height := range t.levels {
+		nodes, pos := t.levels[height], t.pathPos[height]
+		if carry != nil {
+			if carryOnPath {
+				pos = len(nodes)
+			}
+			nodes = append(nodes[:len(nodes):len(nodes)], carry)
+		}
+		switch len(nodes) {
+		case 0:
+		case 1:
+			carry, carryOnPath = nodes[0], pos == 0
+		default:
+			carry, proofSet = t.join(nodes, pos, proofSet)
+			carryOnPath = pos >= 0
+		}
+	}
+	return carry, proofSet
+}
+
+// Push will add data to the set, building out the Merkle tree and root. The
+// tree does not remember all elements that are added, instead only keeping
+// the log(n) elements that are necessary to build the Merkle root and keeping
+// the log(n) elements necessary to build a proof that a piece of data is in
+// the Merkle tree.
+func (t *AryTree) Push(data []byte) {
+	onPath := t.proofTree && t.currentIndex == t.proofIndex
+	if onPath {
+		t.proofSet = append(t.proofSet, data)
+	}
+	t.insert(0, leafSum(t.hash, data), onPath)
+	t.currentIndex++
+}
+
+// Root returns the Merkle root of the data that has been pushed.
+func (t *AryTree) Root() []byte {
+	root, _ := t.collapse()
+	if root == nil {
+		return nil
+	}
+	// Return a copy to prevent leaking a pointer to internal data.
+	return append(root[:0:0], root...)
+}
+
+// SetIndex will tell the AryTree to create a storage proof for the leaf at
+// the input index. SetIndex must be called on an empty tree.
+func (t *AryTree) SetIndex(i uint64) error {
+	if t.currentIndex != 0 {
+		return errors.New("cannot call SetIndex on AryTree if AryTree has not been reset")
+	}
+	t.proofTree = true
+	t.proofIndex = i
+	return nil
+}
+
+// Prove creates a proof that the leaf at the established index (established
+// by SetIndex) is an element of the Merkle tree. The first element of the
+// proof set is the leaf data; it is followed, for each level of the tree from
+// the bottom up, by the other members of the group containing the proof
+// path, in order. Prove will return a nil proof set if the proofIndex has not
+// yet been reached. Prove does not modify the AryTree.
+func (t *AryTree) Prove() (merkleRoot []byte, proofSet [][]byte, proofIndex uint64, numLeaves uint64) {
+	if !t.proofTree {
+		panic("wrong usage: can't call prove on a tree if SetIndex wasn't called")
+	}
+	merkleRoot, proofSet = t.collapse()
+	if len(t.proofSet) == 0 {
+		proofSet = nil
+	}
+	return merkleRoot, proofSet, t.proofIndex, t.currentIndex
+}
+
+// NewAry creates a new AryTree with the specified arity, which must be a
+// power of two greater than 1. The provided hash will be used for all
+// hashing operations within the AryTree.
+func NewAry(h hash.Hash, arity int) *AryTree {
+	if arity < 2 || arity&(arity-1) != 0 {
+		panic("NewAry: arity must be a power of two greater than 1")
+	}
+	return &AryTree{
+		hash:  h,
+		arity: arity,
+	}
+}
+
+// VerifyAryProof is like VerifyProof, but verifies a proof produced by an
+// AryTree with the specified arity.
+func VerifyAryProof(h hash.Hash, arity int, merkleRoot []byte, proofSet [][]byte, proofIndex uint64, numLeaves uint64) bool {
+	if arity < 2 || arity&(arity-1) != 0 {
+		panic("VerifyAryProof: arity must be a power of two greater than 1")
+	}
+	if merkleRoot == nil || proofIndex >= numLeaves || len(proofSet) == 0 {
+		return false
+	}
+
+	// At each level, the node on the proof path is at index 'index' among
+	// the 'levelSize' nodes of that level. Its group begins at the previous
+	// multiple of arity, and contains up to arity nodes.
+	current := leafSum(h, proofSet[0])
+	proofSet = proofSet[1:]
+	index, levelSize := proofIndex, numLeaves
+	k := uint64(arity)
+	for levelSize > 1 {
+		groupStart := index - index%k
+		groupSize := levelSize - groupStart
+		if groupSize > k {
+			groupSize = k
+		}
+		if groupSize > 1 {
+			if uint64(len(proofSet)) < groupSize-1 {
+				return false
+			}
+			pos := int(index - groupStart)
+			group := make([][]byte, 0, groupSize)
+			group = append(group, proofSet[:pos]...)
+			group = append(group, current)
+			group = append(group, proofSet[pos:groupSize-1]...)
+			current = aryNodeSum(h, group)
+			proofSet = proofSet[groupSize-1:]
+		}
+		index /= k
+		levelSize = (levelSize + k - 1) / k
+	}
+	return len(proofSet) == 0 && bytes.Equal(current, merkleRoot)
+}
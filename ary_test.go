@@ -0,0 +1,120 @@
+package merkletree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// TestAryTreeBinary tests that an AryTree with an arity of 2 produces the
+// same roots and proofs as a Tree.
+func TestAryTreeBinary(t *testing.T) {
+	for numLeaves := uint64(1); numLeaves <= 33; numLeaves++ {
+		for proofIndex := uint64(0); proofIndex < numLeaves; proofIndex++ {
+			tree := New(sha256.New())
+			ary := NewAry(sha256.New(), 2)
+			if err := tree.SetIndex(proofIndex); err != nil {
+				t.Fatal(err)
+			}
+			if err := ary.SetIndex(proofIndex); err != nil {
+				t.Fatal(err)
+			}
+			for i := uint64(0); i < numLeaves; i++ {
+				tree.Push([]byte{byte(i)})
+				ary.Push([]byte{byte(i)})
+			}
+			root, proofSet, _, _ := tree.Prove()
+			aryRoot, aryProofSet, _, _ := ary.Prove()
+			if !bytes.Equal(root, aryRoot) || !bytes.Equal(root, ary.Root()) {
+				t.Fatalf("roots of %v-leaf trees differ", numLeaves)
+			}
+			if len(proofSet) != len(aryProofSet) {
+				t.Fatalf("proofs for leaf %v of %v-leaf trees differ", proofIndex, numLeaves)
+			}
+			for i := range proofSet {
+				if !bytes.Equal(proofSet[i], aryProofSet[i]) {
+					t.Fatalf("proofs for leaf %v of %v-leaf trees differ", proofIndex, numLeaves)
+				}
+			}
+		}
+	}
+}
+
+// TestAryTree4 tests building and verifying proofs with an AryTree of arity
+// 4, and compares its proof depth to that of a binary Tree.
+func TestAryTree4(t *testing.T) {
+	h := sha256.New()
+
+	// manually compute the root of a 16-leaf tree
+	var leaves [][]byte
+	for i := 0; i < 16; i++ {
+		leaves = append(leaves, leafSum(h, []byte{byte(i)}))
+	}
+	var nodes [][]byte
+	for i := 0; i < 16; i += 4 {
+		nodes = append(nodes, aryNodeSum(h, leaves[i:i+4]))
+	}
+	expected := aryNodeSum(h, nodes)
+
+	ary := NewAry(h, 4)
+	tree := New(sha256.New())
+	if err := ary.SetIndex(6); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetIndex(6); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		ary.Push([]byte{byte(i)})
+		tree.Push([]byte{byte(i)})
+	}
+	root, proofSet, proofIndex, numLeaves := ary.Prove()
+	if !bytes.Equal(root, expected) {
+		t.Fatal("AryTree produced the wrong root")
+	}
+	if !VerifyAryProof(h, 4, root, proofSet, proofIndex, numLeaves) {
+		t.Fatal("failed to verify AryTree proof")
+	}
+	// the 4-ary proof has 2 levels of 3 siblings each, while the binary
+	// proof has 4 levels of 1 sibling each
+	if len(proofSet)-1 != 2*3 {
+		t.Fatalf("expected 4-ary proof of depth 2 to contain 6 hashes, got %v", len(proofSet)-1)
+	}
+	if _, binaryProofSet, _, _ := tree.Prove(); len(binaryProofSet)-1 != 4 {
+		t.Fatalf("expected binary proof of depth 4 to contain 4 hashes, got %v", len(binaryProofSet)-1)
+	}
+
+	// an incomplete tree: the final group of the first level contains 2
+	// leaves, and the final group of the second level contains 2 nodes
+	ary = NewAry(h, 4)
+	for i := 0; i < 6; i++ {
+		ary.Push([]byte{byte(i)})
+	}
+	expected = aryNodeSum(h, [][]byte{aryNodeSum(h, leaves[:4]), aryNodeSum(h, leaves[4:6])})
+	if !bytes.Equal(ary.Root(), expected) {
+		t.Fatal("AryTree produced the wrong root for incomplete tree")
+	}
+
+	// build and verify proofs for every leaf of various trees
+	for _, arity := range []int{4, 8} {
+		for n := uint64(1); n <= 70; n++ {
+			for proofIndex := uint64(0); proofIndex < n; proofIndex++ {
+				ary := NewAry(h, arity)
+				if err := ary.SetIndex(proofIndex); err != nil {
+					t.Fatal(err)
+				}
+				for i := uint64(0); i < n; i++ {
+					ary.Push([]byte{byte(i)})
+				}
+				root, proofSet, proofIndex, numLeaves := ary.Prove()
+				if !VerifyAryProof(h, arity, root, proofSet, proofIndex, numLeaves) {
+					t.Fatalf("failed to verify proof for leaf %v of %v-leaf %v-ary tree", proofIndex, n, arity)
+				}
+				proofSet[0] = []byte{byte(proofIndex + 1)}
+				if VerifyAryProof(h, arity, root, proofSet, proofIndex, numLeaves) {
+					t.Fatalf("verified proof for leaf %v of %v-leaf %v-ary tree with wrong data", proofIndex, n, arity)
+				}
+			}
+		}
+	}
+}
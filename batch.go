@@ -0,0 +1,71 @@
+package merkletree
+
+import (
+	"errors"
+	"hash"
+	"runtime"
+	"sync"
+)
+
+// ErrInvalidProof is returned by VerifyRangeProofBatch for a proof that was
+// well-formed but did not verify against the supplied root.
+var ErrInvalidProof = errors.New("range proof is invalid")
+
+// ErrIllegalRange is returned by VerifyRangeProofBatch for a job whose range
+// is illegal, i.e. one for which VerifyRangeProof would panic.
+var ErrIllegalRange = errors.New("illegal proof range")
+
+// A VerifyJob bundles the arguments of a single call to VerifyRangeProof.
+type VerifyJob struct {
+	LeafHasher LeafHasher
+	Hash       hash.Hash
+	Start      int
+	End        int
+	Proof      [][]byte
+	Root       []byte
+}
+
+// VerifyRangeProofBatch verifies a batch of independent range proofs
+// concurrently, using a bounded number of goroutines. The returned slice
+// contains one entry per job: nil if the proof verified, ErrInvalidProof if
+// it did not, ErrIllegalRange if its range is illegal, or the error returned
+// by VerifyRangeProof. Since the jobs are verified concurrently, each job must
+// have its own LeafHasher and hash.Hash.
+func VerifyRangeProofBatch(jobs []VerifyJob) []error {
+	// check each range up front, since VerifyRangeProof would panic inside a
+	// worker goroutine, where the caller could not recover
+	errs := make([]error, len(jobs))
+	for i, j := range jobs {
+		if j.Start < 0 || j.Start >= j.End {
+			errs[i] = ErrIllegalRange
+		}
+	}
+	workers := runtime.NumCPU()
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	jobChan := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobChan {
+				j := jobs[i]
+				ok, err := VerifyRangeProof(j.LeafHasher, j.Hash, j.Start, j.End, j.Proof, j.Root)
+				if err == nil && !ok {
+					err = ErrInvalidProof
+				}
+				errs[i] = err
+			}
+		}()
+	}
+	for i := range jobs {
+		if errs[i] == nil {
+			jobChan <- i
+		}
+	}
+	close(jobChan)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,75 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestVerifyRangeProofBatch tests that VerifyRangeProofBatch reports the
+// correct result for each job in a mix of valid and invalid proofs.
+func TestVerifyRangeProofBatch(t *testing.T) {
+	const leafSize = 64
+	const numJobs = 50
+	jobs := make([]VerifyJob, numJobs)
+	valid := make([]bool, numJobs)
+	for i := range jobs {
+		blake, _ := blake2b.New256(nil)
+		numLeaves := fastrand.Intn(64) + 1
+		leafData := fastrand.Bytes(leafSize * numLeaves)
+		root := bytesRoot(leafData, blake, leafSize)
+		start := fastrand.Intn(numLeaves)
+		end := start + fastrand.Intn(numLeaves-start) + 1
+		proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// corrupt every third root
+		valid[i] = i%3 != 0
+		if !valid[i] {
+			root[0]++
+		}
+		jobs[i] = VerifyJob{
+			LeafHasher: NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize),
+			Hash:       blake,
+			Start:      start,
+			End:        end,
+			Proof:      proof,
+			Root:       root,
+		}
+	}
+	// one job has a malformed proof
+	blake, _ := blake2b.New256(nil)
+	jobs[1].Hash = blake
+	jobs[1].Proof = [][]byte{{1, 2, 3}}
+	// two jobs have illegal ranges
+	jobs[2].End = jobs[2].Start
+	jobs[4].Start = -1
+
+	errs := VerifyRangeProofBatch(jobs)
+	if len(errs) != numJobs {
+		t.Fatal("wrong number of results")
+	}
+	for i, err := range errs {
+		switch {
+		case i == 1:
+			if err != ErrBadHashLength {
+				t.Errorf("job %v: expected ErrBadHashLength, got %v", i, err)
+			}
+		case i == 2 || i == 4:
+			if err != ErrIllegalRange {
+				t.Errorf("job %v: expected ErrIllegalRange, got %v", i, err)
+			}
+		case valid[i] && err != nil:
+			t.Errorf("job %v: expected valid proof, got %v", i, err)
+		case !valid[i] && err != ErrInvalidProof:
+			t.Errorf("job %v: expected ErrInvalidProof, got %v", i, err)
+		}
+	}
+
+	if len(VerifyRangeProofBatch(nil)) != 0 {
+		t.Error("expected no results for empty batch")
+	}
+}
@@ -0,0 +1,38 @@
+package merkletree
+
+import (
+	"errors"
+
+	"lukechampine.com/blake3"
+)
+
+// ErrBLAKE3NativeTree is returned by NewBLAKE3Native. This package does not
+// implement BLAKE3's built-in tree mode.
+var ErrBLAKE3NativeTree = errors.New("merkletree does not implement BLAKE3's native tree mode; use a BLAKE3 or Bao implementation directly")
+
+// NewBLAKE3Custom creates a Tree that uses 256-bit BLAKE3 as a plain hash
+// function within this package's Merkle tree construction, i.e. leaves are
+// hashed as BLAKE3(0x00 || data) and nodes as BLAKE3(0x01 || left || right).
+//
+// This is NOT BLAKE3's native tree mode. BLAKE3 internally splits its input
+// into 1 KiB chunks and combines them in a Merkle tree of its own, with
+// different domain separation; the roots produced by NewBLAKE3Custom will
+// never match the output of BLAKE3 over the same data. For example, the
+// 256-byte input 0x00, 0x01, ..., 0xFF, split into 64-byte leaves, has a
+// NewBLAKE3Custom root of
+//
+//	ec0e2fe6bda78bd02e95a538e38e834b6b8c019e469cbf1d280e863b75ed7869
+//
+// whereas its plain BLAKE3 hash is
+//
+//	4a495ba42461748eca8fdad618f976aa726cc2903de9fcb40735a786ac1c196b
+func NewBLAKE3Custom() *Tree {
+	return New(blake3.New(32, nil))
+}
+
+// NewBLAKE3Native always returns ErrBLAKE3NativeTree. It exists to steer
+// callers who expect BLAKE3's native tree semantics away from
+// NewBLAKE3Custom, whose roots are incompatible with them.
+func NewBLAKE3Native() (*Tree, error) {
+	return nil, ErrBLAKE3NativeTree
+}
@@ -0,0 +1,37 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"lukechampine.com/blake3"
+)
+
+// TestBLAKE3Custom checks NewBLAKE3Custom against the test vector in its
+// documentation, and confirms that the root differs from BLAKE3's native
+// hash of the same data.
+func TestBLAKE3Custom(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tree := NewBLAKE3Custom()
+	if err := tree.ReadAll(bytes.NewReader(data), 64); err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(tree.Root()) != "ec0e2fe6bda78bd02e95a538e38e834b6b8c019e469cbf1d280e863b75ed7869" {
+		t.Error("NewBLAKE3Custom produced wrong root:", hex.EncodeToString(tree.Root()))
+	}
+	native := blake3.Sum256(data)
+	if hex.EncodeToString(native[:]) != "4a495ba42461748eca8fdad618f976aa726cc2903de9fcb40735a786ac1c196b" {
+		t.Error("BLAKE3 produced unexpected hash:", hex.EncodeToString(native[:]))
+	}
+	if bytes.Equal(tree.Root(), native[:]) {
+		t.Error("NewBLAKE3Custom root should not match native BLAKE3 hash")
+	}
+
+	if _, err := NewBLAKE3Native(); err != ErrBLAKE3NativeTree {
+		t.Error("expected ErrBLAKE3NativeTree, got", err)
+	}
+}
@@ -0,0 +1,227 @@
+package merkletree
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"io"
+	"sync"
+)
+
+// numCacheShards is the number of independently-locked shards in a
+// SharedSubtreeCache. Sharding reduces lock contention when many goroutines
+// consult the cache at once.
+const numCacheShards = 16
+
+// A SharedSubtreeCache is a bounded cache of subtree roots that can be shared
+// by many SubtreeHashers across goroutines. Each subtree root is keyed by the
+// Merkle root of the tree (e.g. a sector) it belongs to, along with the span
+// of leaves it covers. When a shard of the cache is full, an arbitrary entry
+// is evicted to make room for the new one.
+type SharedSubtreeCache struct {
+	shards          [numCacheShards]cacheShard
+	maxShardEntries int
+}
+
+type cacheShard struct {
+	mu    sync.RWMutex
+	roots map[subtreeCacheKey][]byte
+}
+
+// A subtreeCacheKey identifies the subtree of size leaves beginning at offset
+// within the tree whose root is treeRoot.
+type subtreeCacheKey struct {
+	treeRoot string
+	offset   int
+	size     int
+}
+
+// shard returns the shard responsible for k.
+func (c *SharedSubtreeCache) shard(k subtreeCacheKey) *cacheShard {
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(k.offset))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(k.size))
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(k.treeRoot))
+	_, _ = h.Write(buf[:])
+	return &c.shards[h.Sum32()%numCacheShards]
+}
+
+// get returns a copy of the cached root for k, if present.
+func (c *SharedSubtreeCache) get(k subtreeCacheKey) ([]byte, bool) {
+	s := c.shard(k)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	root, ok := s.roots[k]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), root...), true
+}
+
+// put adds the root for k to the cache, evicting an arbitrary entry if the
+// shard is full.
+func (c *SharedSubtreeCache) put(k subtreeCacheKey, root []byte) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.roots[k]; !ok && len(s.roots) >= c.maxShardEntries {
+		for evict := range s.roots {
+			delete(s.roots, evict)
+			break
+		}
+	}
+	s.roots[k] = append([]byte(nil), root...)
+}
+
+// Len returns the number of subtree roots currently stored in the cache.
+func (c *SharedSubtreeCache) Len() int {
+	n := 0
+	for i := range c.shards {
+		c.shards[i].mu.RLock()
+		n += len(c.shards[i].roots)
+		c.shards[i].mu.RUnlock()
+	}
+	return n
+}
+
+// NewSharedSubtreeCache creates a SharedSubtreeCache that holds at most
+// maxEntries subtree roots.
+func NewSharedSubtreeCache(maxEntries int) *SharedSubtreeCache {
+	maxShardEntries := maxEntries / numCacheShards
+	if maxShardEntries < 1 {
+		maxShardEntries = 1
+	}
+	c := &SharedSubtreeCache{
+		maxShardEntries: maxShardEntries,
+	}
+	for i := range c.shards {
+		c.shards[i].roots = make(map[subtreeCacheKey][]byte)
+	}
+	return c
+}
+
+// A SharedCacheSubtreeHasher wraps an underlying SubtreeHasher. It consults a
+// SharedSubtreeCache before computing each subtree root, only falling back to
+// the underlying SubtreeHasher on a cache miss, in which case the computed
+// root is added to the cache. A SharedSubtreeCache may be safely consulted by
+// many SharedCacheSubtreeHashers concurrently, but each
+// SharedCacheSubtreeHasher must only be used by one goroutine.
+type SharedCacheSubtreeHasher struct {
+	sh        SubtreeHasher
+	cache     *SharedSubtreeCache
+	treeRoot  string
+	numLeaves int
+	offset    int
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (s *SharedCacheSubtreeHasher) NextSubtreeRoot(n int) ([]byte, error) {
+	if s.offset >= s.numLeaves {
+		return nil, io.EOF
+	}
+	k := subtreeCacheKey{
+		treeRoot: s.treeRoot,
+		offset:   s.offset,
+		size:     n,
+	}
+	if root, ok := s.cache.get(k); ok {
+		// skip the underlying leaves, taking care not to skip past the end
+		// of the tree
+		skip := n
+		if s.offset+skip > s.numLeaves {
+			skip = s.numLeaves - s.offset
+		}
+		if err := s.sh.Skip(skip); err != nil {
+			return nil, err
+		}
+		s.offset += skip
+		return root, nil
+	}
+	root, err := s.sh.NextSubtreeRoot(n)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.put(k, root)
+	s.offset += n
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (s *SharedCacheSubtreeHasher) Skip(n int) error {
+	s.offset += n
+	return s.sh.Skip(n)
+}
+
+// NewSharedCacheSubtreeHasher returns a SharedCacheSubtreeHasher that caches
+// the subtree roots computed by sh in cache. treeRoot is the Merkle root of
+// the tree whose leaves sh hashes, and numLeaves is the number of leaves in
+// that tree.
+func NewSharedCacheSubtreeHasher(sh SubtreeHasher, cache *SharedSubtreeCache, treeRoot []byte, numLeaves int) *SharedCacheSubtreeHasher {
+	return &SharedCacheSubtreeHasher{
+		sh:        sh,
+		cache:     cache,
+		treeRoot:  string(treeRoot),
+		numLeaves: numLeaves,
+	}
+}
+
+// A PathCache stores every node of a Merkle tree, allowing proofs for single
+// leaves to be produced in O(log n) time. Building the cache requires hashing
+// every node once, and storing approximately twice as many hashes as there
+// are leaves.
+type PathCache struct {
+	// levels[0] holds the leaf hashes, and levels[i+1] holds the parents of
+	// the nodes in levels[i]. If levels[i] has an odd number of nodes, the
+	// last is promoted to levels[i+1] unchanged, so the final node of each
+	// level may be the root of an imperfect subtree, as in a Tree.
+	levels [][][]byte
+}
+
+// Root returns the Merkle root of the tree.
+func (pc *PathCache) Root() []byte {
+	return pc.levels[len(pc.levels)-1][0]
+}
+
+// Prove returns a proof for the leaf at index, identical to the proof
+// constructed by BuildRangeProof(index, index+1, ...).
+func (pc *PathCache) Prove(index int) [][]byte {
+	if index < 0 || index >= len(pc.levels[0]) {
+		panic("PathCache.Prove: illegal index")
+	}
+	var proof [][]byte
+	// left-side hashes, from the largest subtree to the smallest
+	for i := len(pc.levels) - 1; i >= 0; i-- {
+		if index&(1<<uint(i)) != 0 {
+			proof = append(proof, pc.levels[i][(index>>uint(i))-1])
+		}
+	}
+	// right-side hashes, from the smallest subtree to the largest
+	for i := 0; i < len(pc.levels); i++ {
+		if j := (index >> uint(i)) + 1; index&(1<<uint(i)) == 0 && j < len(pc.levels[i]) {
+			proof = append(proof, pc.levels[i][j])
+		}
+	}
+	return proof
+}
+
+// NewPathCache builds a PathCache from the hashes of every leaf in the tree.
+// The leaf hashes are retained by the PathCache.
+func NewPathCache(leafHashes [][]byte, h hash.Hash) *PathCache {
+	if len(leafHashes) == 0 {
+		panic("NewPathCache: no leaf hashes")
+	}
+	levels := [][][]byte{leafHashes}
+	for level := leafHashes; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, nodeSum(h, level[i], level[i+1]))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return &PathCache{levels: levels}
+}
@@ -0,0 +1,185 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestSharedSubtreeCache tests that proofs built using a SharedSubtreeCache
+// match proofs built without one, even when the cache is consulted from many
+// goroutines at once.
+func TestSharedSubtreeCache(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 100
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	cache := NewSharedSubtreeCache(1000)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, _ := blake2b.New256(nil)
+			for n := 0; n < 50; n++ {
+				start := fastrand.Intn(numLeaves)
+				end := start + fastrand.Intn(numLeaves-start) + 1
+				rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, h)
+				proof, err := BuildRangeProof(start, end, NewSharedCacheSubtreeHasher(rsh, cache, root, numLeaves))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, h))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !reflect.DeepEqual(proof, expected) {
+					t.Errorf("cached proof for range %v-%v does not match uncached proof", start, end)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if cache.Len() == 0 {
+		t.Fatal("cache was not populated")
+	}
+}
+
+// TestSharedSubtreeCacheBounded tests that a SharedSubtreeCache never holds
+// more than its maximum number of entries.
+func TestSharedSubtreeCacheBounded(t *testing.T) {
+	cache := NewSharedSubtreeCache(numCacheShards * 2)
+	for i := 0; i < 1000; i++ {
+		cache.put(subtreeCacheKey{treeRoot: "root", offset: i, size: 1}, []byte{byte(i)})
+	}
+	if cache.Len() > numCacheShards*2 {
+		t.Fatal("cache exceeded its maximum size:", cache.Len())
+	}
+}
+
+// TestSharedSubtreeCacheCopies tests that modifying a proof built using a
+// SharedSubtreeCache does not corrupt the cache.
+func TestSharedSubtreeCacheCopies(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 16
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	expected, err := BuildRangeProof(5, 6, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewSharedSubtreeCache(1000)
+	for i := 0; i < 3; i++ {
+		rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+		proof, err := BuildRangeProof(5, 6, NewSharedCacheSubtreeHasher(rsh, cache, root, numLeaves))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, expected) {
+			t.Fatalf("proof %v does not match uncached proof", i)
+		}
+		for _, h := range proof {
+			h[0] ^= 1
+		}
+	}
+}
+
+// BenchmarkSharedSubtreeCache compares the throughput of several goroutines
+// building proofs over the same sector with and without a SharedSubtreeCache.
+func BenchmarkSharedSubtreeCache(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := testData(1, 1<<22)
+	const leafSize = 64
+	numLeaves := len(leafData) / leafSize
+	root := bytesRoot(leafData, blake, leafSize)
+	if hex.EncodeToString(root) != testDataRoot {
+		b.Fatal("wrong root for test data")
+	}
+
+	b.Run("independent", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			h, _ := blake2b.New256(nil)
+			for pb.Next() {
+				start := fastrand.Intn(numLeaves)
+				rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, h)
+				_, _ = BuildRangeProof(start, start+1, rsh)
+			}
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		cache := NewSharedSubtreeCache(1 << 16)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			h, _ := blake2b.New256(nil)
+			for pb.Next() {
+				start := fastrand.Intn(numLeaves)
+				rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, h)
+				_, _ = BuildRangeProof(start, start+1, NewSharedCacheSubtreeHasher(rsh, cache, root, numLeaves))
+			}
+		})
+	})
+}
+
+// TestPathCache tests that a PathCache produces the same proofs as
+// BuildRangeProof.
+func TestPathCache(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	for _, numLeaves := range []int{1, 2, 3, 7, 8, 13, 64, 100} {
+		leafData := fastrand.Bytes(numLeaves * leafSize)
+		leafHashes := make([][]byte, numLeaves)
+		for i := range leafHashes {
+			leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+		}
+		pc := NewPathCache(leafHashes, blake)
+		if !bytes.Equal(pc.Root(), bytesRoot(leafData, blake, leafSize)) {
+			t.Fatalf("%v-leaf PathCache has wrong root", numLeaves)
+		}
+		for i := 0; i < numLeaves; i++ {
+			expected, err := BuildRangeProof(i, i+1, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proof := pc.Prove(i); !reflect.DeepEqual(proof, expected) {
+				t.Fatalf("%v-leaf PathCache produced wrong proof for leaf %v", numLeaves, i)
+			}
+		}
+	}
+}
+
+// BenchmarkPathCache compares producing single-leaf proofs with a PathCache
+// and with BuildRangeProof.
+func BenchmarkPathCache(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 1 << 16
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+
+	b.Run("BuildRangeProof", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			index := i % numLeaves
+			_, _ = BuildRangeProof(index, index+1, NewCachedSubtreeHasher(leafHashes, blake))
+		}
+	})
+	b.Run("PathCache", func(b *testing.B) {
+		pc := NewPathCache(leafHashes, blake)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = pc.Prove(i % numLeaves)
+		}
+	})
+}
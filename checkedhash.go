@@ -0,0 +1,36 @@
+package merkletree
+
+import (
+	"fmt"
+	"hash"
+)
+
+// A CheckedHash wraps a hash.Hash and panics if its output size ever
+// changes. leafSum and nodeSum assume that every hash in a tree has the same
+// size; a hash whose output size varies, e.g. because differently-configured
+// instances are mixed within a tree, would otherwise silently corrupt the
+// resulting roots. The size of the first output is recorded, and every
+// subsequent output is compared against it.
+type CheckedHash struct {
+	hash.Hash
+	size int
+}
+
+// Sum implements hash.Hash.
+func (ch *CheckedHash) Sum(b []byte) []byte {
+	sum := ch.Hash.Sum(b)
+	n := len(sum) - len(b)
+	if ch.size == 0 {
+		ch.size = n
+	} else if n != ch.size {
+		panic(fmt.Sprintf("CheckedHash: output size changed from %v to %v", ch.size, n))
+	}
+	return sum
+}
+
+// NewCheckedHash wraps h in a CheckedHash.
+func NewCheckedHash(h hash.Hash) *CheckedHash {
+	return &CheckedHash{
+		Hash: h,
+	}
+}
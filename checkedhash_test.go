@@ -0,0 +1,53 @@
+package merkletree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+)
+
+// shrinkingHash is a misbehaving hash.Hash whose output shrinks by one byte
+// after a set number of sums.
+type shrinkingHash struct {
+	hash.Hash
+	sums int
+}
+
+func (sh *shrinkingHash) Sum(b []byte) []byte {
+	sh.sums++
+	sum := sh.Hash.Sum(b)
+	if sh.sums > 5 {
+		sum = sum[:len(sum)-1]
+	}
+	return sum
+}
+
+// TestCheckedHash tests that a CheckedHash panics when the output size of its
+// underlying hash changes, and is otherwise transparent.
+func TestCheckedHash(t *testing.T) {
+	// a well-behaved hash produces the same root as an unchecked Tree
+	tree := New(sha256.New())
+	checked := NewChecked(sha256.New())
+	for i := 0; i < 9; i++ {
+		data := fastrand.Bytes(64)
+		tree.Push(data)
+		checked.Push(data)
+	}
+	if !bytes.Equal(tree.Root(), checked.Root()) {
+		t.Fatal("checked Tree produced a different root")
+	}
+
+	// a misbehaving hash triggers a panic
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic when hash output size changed")
+		}
+	}()
+	checked = NewChecked(&shrinkingHash{Hash: sha256.New()})
+	for i := 0; i < 9; i++ {
+		checked.Push(fastrand.Bytes(64))
+	}
+}
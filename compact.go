@@ -0,0 +1,198 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// A CompactRangeProof is a range proof from which derivable hashes have been
+// omitted. In general, the sibling hashes of a Merkle proof cannot be derived
+// without the underlying data. However, a verifier that knows the number of
+// leaves and the leaf size can compute the root of any subtree consisting
+// entirely of zero-filled leaves, which are common in padded or sparsely
+// populated sectors. A CompactRangeProof records which proof positions are
+// present in a bitmask, and stores only the hashes that are not the root of
+// an all-zero subtree.
+type CompactRangeProof struct {
+	// NumHashes is the number of hashes in the full proof.
+	NumHashes int
+	// Present is a bitmask indicating which hashes of the full proof are
+	// stored in Hashes. Bit i of Present[i/8] corresponds to hash i.
+	Present []byte
+	// Hashes contains the hashes that could not be omitted, in order.
+	Hashes [][]byte
+}
+
+// proofSubtreeSizes returns the number of leaves in the subtree for each hash
+// of a proof for the leaf range [proofStart, proofEnd) within a tree of
+// numLeaves leaves, in the order the hashes appear in the proof.
+func proofSubtreeSizes(numLeaves, proofStart, proofEnd int) []int {
+	var sizes []int
+	for i := maxSubtreeHeight; i >= 0; i-- {
+		subtreeSize := 1 << uint64(i)
+		if proofStart&subtreeSize != 0 {
+			sizes = append(sizes, subtreeSize)
+		}
+	}
+	endMask := proofEnd - 1
+	pos := proofEnd
+	for i := 0; i <= maxSubtreeHeight && pos < numLeaves; i++ {
+		subtreeSize := 1 << uint64(i)
+		if endMask&subtreeSize == 0 {
+			if pos+subtreeSize > numLeaves {
+				sizes = append(sizes, numLeaves-pos)
+			} else {
+				sizes = append(sizes, subtreeSize)
+			}
+			pos += subtreeSize
+		}
+	}
+	return sizes
+}
+
+// zeroSubtreeRoots returns a function computing the root of a tree of n
+// zero-filled leaves of leafSize bytes.
+func zeroSubtreeRoots(h hash.Hash, leafSize int) func(n int) []byte {
+	levels := [][]byte{leafSum(h, make([]byte, leafSize))}
+	return func(n int) []byte {
+		tree := New(h)
+		for i := maxSubtreeHeight; i >= 0; i-- {
+			if n&(1<<uint64(i)) == 0 {
+				continue
+			}
+			for len(levels) <= i {
+				prev := levels[len(levels)-1]
+				levels = append(levels, nodeSum(h, prev, prev))
+			}
+			if err := tree.PushSubTree(i, levels[i]); err != nil {
+				panic(err) // should never happen
+			}
+		}
+		return tree.Root()
+	}
+}
+
+// CompressRangeProof converts a proof for the leaf range [proofStart,
+// proofEnd) within a tree of numLeaves leaves into a CompactRangeProof,
+// omitting every hash that is the root of an all-zero subtree.
+func CompressRangeProof(proof [][]byte, numLeaves, proofStart, proofEnd, leafSize int, h hash.Hash) (CompactRangeProof, error) {
+	sizes := proofSubtreeSizes(numLeaves, proofStart, proofEnd)
+	if len(sizes) != len(proof) {
+		return CompactRangeProof{}, errors.New("proof has wrong number of hashes")
+	}
+	zeroRoot := zeroSubtreeRoots(h, leafSize)
+	cp := CompactRangeProof{
+		NumHashes: len(proof),
+		Present:   make([]byte, (len(proof)+7)/8),
+	}
+	for i := range proof {
+		if !bytes.Equal(proof[i], zeroRoot(sizes[i])) {
+			cp.Present[i/8] |= 1 << uint(i%8)
+			cp.Hashes = append(cp.Hashes, proof[i])
+		}
+	}
+	return cp, nil
+}
+
+// Expand reconstructs the full proof from a CompactRangeProof for the leaf
+// range [proofStart, proofEnd) within a tree of numLeaves leaves.
+func (cp CompactRangeProof) Expand(numLeaves, proofStart, proofEnd, leafSize int, h hash.Hash) ([][]byte, error) {
+	sizes := proofSubtreeSizes(numLeaves, proofStart, proofEnd)
+	if len(sizes) != cp.NumHashes || len(cp.Present) != (cp.NumHashes+7)/8 {
+		return nil, errors.New("compact proof has wrong number of hashes")
+	} else if cp.NumHashes == 0 {
+		return nil, nil // as returned by BuildRangeProof
+	}
+	zeroRoot := zeroSubtreeRoots(h, leafSize)
+	proof := make([][]byte, cp.NumHashes)
+	hashes := cp.Hashes
+	for i := range proof {
+		if cp.Present[i/8]&(1<<uint(i%8)) != 0 {
+			if len(hashes) == 0 {
+				return nil, errors.New("compact proof is missing hashes")
+			}
+			proof[i], hashes = hashes[0], hashes[1:]
+		} else {
+			proof[i] = zeroRoot(sizes[i])
+		}
+	}
+	if len(hashes) != 0 {
+		return nil, errors.New("compact proof contains extra hashes")
+	}
+	return proof, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding is the
+// number of hashes in the full proof and the size of each hash, both as
+// uvarints, followed by the bitmask and the stored hashes.
+func (cp CompactRangeProof) MarshalBinary() ([]byte, error) {
+	hashSize := 0
+	if len(cp.Hashes) > 0 {
+		hashSize = len(cp.Hashes[0])
+	}
+	buf := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(cp.Present)+len(cp.Hashes)*hashSize)
+	n := binary.PutUvarint(buf, uint64(cp.NumHashes))
+	n += binary.PutUvarint(buf[n:], uint64(hashSize))
+	buf = append(buf[:n], cp.Present...)
+	for _, h := range cp.Hashes {
+		if len(h) != hashSize {
+			return nil, ErrBadHashLength
+		}
+		buf = append(buf, h...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (cp *CompactRangeProof) UnmarshalBinary(b []byte) error {
+	numHashes, n := binary.Uvarint(b)
+	if n <= 0 || numHashes > uint64(len(b))*8 {
+		return errors.New("invalid compact proof")
+	}
+	b = b[n:]
+	hashSize, n := binary.Uvarint(b)
+	if n <= 0 || hashSize > uint64(len(b)) {
+		return errors.New("invalid compact proof")
+	}
+	b = b[n:]
+	maskLen := (int(numHashes) + 7) / 8
+	if len(b) < maskLen {
+		return errors.New("compact proof is truncated")
+	}
+	present, b := b[:maskLen], b[maskLen:]
+	numPresent := 0
+	for i := 0; i < int(numHashes); i++ {
+		if present[i/8]&(1<<uint(i%8)) != 0 {
+			numPresent++
+		}
+	}
+	if numPresent > 0 && hashSize == 0 {
+		return ErrBadHashLength
+	} else if len(b) != numPresent*int(hashSize) {
+		return errors.New("compact proof has wrong length")
+	}
+	cp.NumHashes = int(numHashes)
+	cp.Present = append([]byte(nil), present...)
+	cp.Hashes = make([][]byte, numPresent)
+	for i := range cp.Hashes {
+		cp.Hashes[i] = append([]byte(nil), b[:hashSize]...)
+		b = b[hashSize:]
+	}
+	return nil
+}
+
+// VerifyCompactRangeProof verifies a CompactRangeProof for the leaf range
+// [proofStart, proofEnd) within a tree of numLeaves leaves of leafSize
+// bytes, by reconstructing the omitted hashes and calling VerifyRangeProof.
+func VerifyCompactRangeProof(lh LeafHasher, h hash.Hash, numLeaves, proofStart, proofEnd, leafSize int, cp CompactRangeProof, root []byte) (bool, error) {
+	if err := checkHashLengths(cp.Hashes, h); err != nil {
+		return false, err
+	}
+	proof, err := cp.Expand(numLeaves, proofStart, proofEnd, leafSize, h)
+	if err != nil {
+		return false, err
+	}
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
@@ -0,0 +1,93 @@
+package merkletree
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestCompactRangeProof tests that compact proofs verify identically to
+// full proofs, and are smaller when the tree contains zero-filled leaves.
+func TestCompactRangeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+
+	// a mostly-empty power-of-two tree, and a tree of random data
+	sparseData := make([]byte, leafSize*64)
+	copy(sparseData[5*leafSize:], fastrand.Bytes(leafSize))
+	randomData := fastrand.Bytes(leafSize * 37)
+
+	for _, data := range [][]byte{sparseData, randomData} {
+		numLeaves := len(data) / leafSize
+		root := bytesRoot(data, blake, leafSize)
+		for n := 0; n < 50; n++ {
+			start := fastrand.Intn(numLeaves)
+			end := start + fastrand.Intn(numLeaves-start) + 1
+			if n == 0 {
+				start, end = 5, 6
+			} else if n == 1 {
+				start, end = 0, numLeaves // empty proof
+			}
+			proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cp, err := CompressRangeProof(proof, numLeaves, start, end, leafSize, blake)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cp.Hashes) > len(proof) {
+				t.Fatal("compact proof contains more hashes than full proof")
+			}
+			if n == 0 && numLeaves == 64 && len(cp.Hashes) != 0 {
+				t.Fatal("single-leaf proof in an otherwise empty tree should not contain any hashes, got", len(cp.Hashes))
+			}
+
+			// round-trip through the binary encoding
+			b, err := cp.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded CompactRangeProof
+			if err := decoded.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+			expanded, err := decoded.Expand(numLeaves, start, end, leafSize, blake)
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(expanded, proof) {
+				t.Fatal("expanded proof does not match original proof")
+			}
+
+			lh := NewReaderLeafHasher(bytes.NewReader(data[start*leafSize:end*leafSize]), blake, leafSize)
+			ok, err := VerifyCompactRangeProof(lh, blake, numLeaves, start, end, leafSize, decoded, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("failed to verify compact proof for range %v-%v", start, end)
+			}
+		}
+	}
+
+	// compare sizes for a single-leaf proof in the sparse tree
+	proof, _ := BuildRangeProof(5, 6, NewReaderSubtreeHasher(bytes.NewReader(sparseData), leafSize, blake))
+	cp, _ := CompressRangeProof(proof, 64, 5, 6, leafSize, blake)
+	b, _ := cp.MarshalBinary()
+	if len(b) >= len(proof)*blake.Size() {
+		t.Fatalf("compact proof (%v bytes) is not smaller than full proof (%v bytes)", len(b), len(proof)*blake.Size())
+	}
+
+	// truncated encodings should be rejected
+	proof, _ = BuildRangeProof(5, 6, NewReaderSubtreeHasher(bytes.NewReader(randomData), leafSize, blake))
+	cp, _ = CompressRangeProof(proof, 37, 5, 6, leafSize, blake)
+	b, _ = cp.MarshalBinary()
+	for i := 0; i < len(b); i++ {
+		var decoded CompactRangeProof
+		if err := decoded.UnmarshalBinary(b[:i]); err == nil {
+			t.Fatalf("decoded compact proof truncated to %v bytes", i)
+		}
+	}
+}
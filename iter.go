@@ -0,0 +1,30 @@
+//go:build go1.23
+// +build go1.23
+
+package merkletree
+
+import (
+	"io"
+	"iter"
+)
+
+// SubtreeRoots returns an iterator over the roots produced by repeatedly
+// calling sh.NextSubtreeRoot(subtreeSize). Iteration ends when sh returns
+// io.EOF; any other error is yielded alongside a nil root, after which
+// iteration stops.
+func SubtreeRoots(sh SubtreeHasher, subtreeSize int) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		for {
+			root, err := sh.NextSubtreeRoot(subtreeSize)
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(root, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+//go:build go1.23
+// +build go1.23
+
+package merkletree
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestSubtreeRoots tests that SubtreeRoots yields the same roots as manual
+// calls to NextSubtreeRoot.
+func TestSubtreeRoots(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const subtreeSize = 4
+	leafData := fastrand.Bytes(leafSize*17 + 5)
+
+	var expected [][]byte
+	sh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	for {
+		root, err := sh.NextSubtreeRoot(subtreeSize)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, root)
+	}
+
+	var got [][]byte
+	for root, err := range SubtreeRoots(NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake), subtreeSize) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, root)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v roots, got %v", len(expected), len(got))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], expected[i]) {
+			t.Fatalf("root %v does not match", i)
+		}
+	}
+
+	// breaking out of the loop early should stop iteration
+	n := 0
+	for range SubtreeRoots(NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake), subtreeSize) {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Fatal("expected iteration to stop after break")
+	}
+}
@@ -2,11 +2,52 @@ package merkletree
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
+	"math/bits"
+	"runtime"
+	"sort"
+	"sync"
 )
 
+// ErrBadHashLength is returned when verifying a proof that contains a hash
+// whose length does not match the size of the hash function.
+var ErrBadHashLength = errors.New("proof contains a hash of incorrect length")
+
+// ErrBadProofLength is returned when reconstructing a root from a proof that
+// contains too few hashes to cover the leaves before the proof range, or more
+// hashes than any tree could require.
+var ErrBadProofLength = errors.New("proof contains the wrong number of hashes")
+
+// ErrNoLeafHashes is returned when verifying a proof using a LeafHasher that
+// produces no leaf hashes. Without any leaves, an empty proof would otherwise
+// "verify" against an empty root, which is never valid.
+var ErrNoLeafHashes = errors.New("LeafHasher produced no leaf hashes")
+
+// ErrLeafSizeMismatch is returned when verifying a RangeProof whose leaf size
+// differs from the leaf size used by the verifier.
+var ErrLeafSizeMismatch = errors.New("proof was built with a different leaf size")
+
+// ErrHasherMisuse is returned when a SubtreeHasher is used incorrectly, e.g.
+// by skipping a negative number of leaves, or by requesting more subtree
+// roots after io.EOF has already been returned.
+var ErrHasherMisuse = errors.New("SubtreeHasher used incorrectly")
+
+// ErrBudgetExceeded is returned by VerifyRangeProofN when verifying a proof
+// would require consuming more leaf hashes than the specified budget.
+var ErrBudgetExceeded = errors.New("proof verification exceeded leaf budget")
+
+// ErrBadRootLength is returned by VerifyRangeProofTyped and
+// VerifyRangeProofHex when the supplied root's length does not match the size
+// of the hash function.
+var ErrBadRootLength = errors.New("root has incorrect length")
+
 // A SubtreeHasher calculates subtree roots in sequential order, for use with
 // BuildRangeProof.
 type SubtreeHasher interface {
@@ -20,32 +61,209 @@ type SubtreeHasher interface {
 	Skip(n int) error
 }
 
+// IsEndOfTree reports whether err, as returned by NextSubtreeRoot, signals
+// that no leaves are left in the tree. This is the normal way for a
+// SubtreeHasher to terminate, and is not an error.
+func IsEndOfTree(err error) bool {
+	return errors.Is(err, io.EOF)
+}
+
+// IsTruncated reports whether err, as returned by Skip, signals that fewer
+// leaves were left in the tree than were requested to be skipped.
+func IsTruncated(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// A subtreeFolder computes the root of a sequence of leaves, as if they were
+// pushed into a Tree, without allocating for every leaf and node. Since the
+// leaves are pushed sequentially, the height of each subtree on the stack is
+// given by the bits of the number of leaves pushed so far.
+type subtreeFolder struct {
+	h            hash.Hash
+	leafH        hash.Hash // if non-nil, used in place of h for leaves
+	lengthPrefix bool
+
+	// stack holds the roots of the perfect subtrees of the leaves pushed so
+	// far, indexed by height. The buffers are reused after each reset.
+	stack     [][]byte
+	cur       []byte
+	numLeaves int
+}
+
+// sum hashes data into sf.cur with sf.h, reusing its memory.
+func (sf *subtreeFolder) sum(data ...[]byte) {
+	sf.sumWith(sf.h, data...)
+}
+
+// sumWith is like sum, but uses h.
+func (sf *subtreeFolder) sumWith(h hash.Hash, data ...[]byte) {
+	h.Reset()
+	for _, d := range data {
+		// the Hash interface specifies that Write never returns an error
+		_, _ = h.Write(d)
+	}
+	sf.cur = h.Sum(sf.cur[:0])
+}
+
+// reset discards all of the leaves pushed so far.
+func (sf *subtreeFolder) reset() {
+	sf.numLeaves = 0
+}
+
+// pushLeaf adds a leaf to the folder.
+func (sf *subtreeFolder) pushLeaf(leaf []byte) {
+	sf.hashLeaf(leaf)
+	sf.pushCur()
+}
+
+// hashLeaf hashes leaf into sf.cur.
+func (sf *subtreeFolder) hashLeaf(leaf []byte) {
+	h := sf.h
+	if sf.leafH != nil {
+		h = sf.leafH
+	}
+	if sf.lengthPrefix {
+		var prefix [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(prefix[:], uint64(len(leaf)))
+		sf.sumWith(h, leafHashPrefix, prefix[:n], leaf)
+	} else {
+		sf.sumWith(h, leafHashPrefix, leaf)
+	}
+}
+
+// pushCur adds the leaf hash in sf.cur to the folder.
+func (sf *subtreeFolder) pushCur() {
+	height := 0
+	for ; sf.numLeaves&(1<<uint(height)) != 0; height++ {
+		sf.sum(nodeHashPrefix, sf.stack[height], sf.cur)
+	}
+	if height == len(sf.stack) {
+		sf.stack = append(sf.stack, nil)
+	}
+	sf.stack[height] = append(sf.stack[height][:0], sf.cur...)
+	sf.numLeaves++
+}
+
+// root returns the root of the leaves pushed so far, or nil if no leaves have
+// been pushed.
+func (sf *subtreeFolder) root() []byte {
+	if sf.numLeaves == 0 {
+		return nil
+	}
+	// join the subtrees from shortest to tallest, with the taller subtree
+	// on the left, as in Tree.Root
+	height := bits.TrailingZeros64(uint64(sf.numLeaves))
+	sf.cur = append(sf.cur[:0], sf.stack[height]...)
+	for height++; height < bits.Len64(uint64(sf.numLeaves)); height++ {
+		if sf.numLeaves&(1<<uint(height)) != 0 {
+			sf.sum(nodeHashPrefix, sf.stack[height], sf.cur)
+		}
+	}
+	return append([]byte(nil), sf.cur...)
+}
+
 // ReaderSubtreeHasher implements SubtreeHasher by reading leaf data from an
 // underlying stream.
 type ReaderSubtreeHasher struct {
-	r    io.Reader
-	h    hash.Hash
-	leaf []byte
+	r      io.Reader
+	leaf   []byte
+	folder subtreeFolder
+
+	// workers, if non-nil, are used to hash the leaves of large subtrees in
+	// parallel. Each worker has its own hash; batch holds the leaf data read
+	// for them, and batchHashes the resulting leaf hashes.
+	workers     []subtreeFolder
+	batch       []byte
+	batchHashes [][]byte
+
+	// exhausted is set once NextSubtreeRoot has returned io.EOF.
+	exhausted bool
 }
 
-// NextSubtreeRoot implements SubtreeHasher.
-func (rsh *ReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
-	tree := New(rsh.h)
+// pushLeavesParallel reads up to subtreeSize leaves in batches, hashing the
+// leaves of each batch in parallel and then pushing them into rsh.folder in
+// order.
+func (rsh *ReaderSubtreeHasher) pushLeavesParallel(subtreeSize int) error {
+	leafSize := len(rsh.leaf)
+	for remaining := subtreeSize; remaining > 0; {
+		want := len(rsh.batchHashes)
+		if want > remaining {
+			want = remaining
+		}
+		n, err := io.ReadFull(rsh.r, rsh.batch[:want*leafSize])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		numLeaves := (n + leafSize - 1) / leafSize
+
+		// hash a contiguous chunk of the batch in each worker
+		var wg sync.WaitGroup
+		for w := range rsh.workers {
+			start, end := w*numLeaves/len(rsh.workers), (w+1)*numLeaves/len(rsh.workers)
+			wg.Add(1)
+			go func(f *subtreeFolder, start, end int) {
+				defer wg.Done()
+				for i := start; i < end; i++ {
+					leafEnd := (i + 1) * leafSize
+					if leafEnd > n {
+						leafEnd = n
+					}
+					f.hashLeaf(rsh.batch[i*leafSize : leafEnd])
+					rsh.batchHashes[i] = append(rsh.batchHashes[i][:0], f.cur...)
+				}
+			}(&rsh.workers[w], start, end)
+		}
+		wg.Wait()
+
+		for _, leafHash := range rsh.batchHashes[:numLeaves] {
+			rsh.folder.cur = append(rsh.folder.cur[:0], leafHash...)
+			rsh.folder.pushCur()
+		}
+		if numLeaves < want {
+			break // reached the end of the stream
+		}
+		remaining -= numLeaves
+	}
+	return nil
+}
+
+// pushLeaves reads up to subtreeSize leaves one at a time, pushing each into
+// rsh.folder.
+func (rsh *ReaderSubtreeHasher) pushLeaves(subtreeSize int) error {
 	for i := 0; i < subtreeSize; i++ {
 		n, err := io.ReadFull(rsh.r, rsh.leaf)
 		if n > 0 {
-			tree.Push(rsh.leaf[:n])
+			rsh.folder.pushLeaf(rsh.leaf[:n])
 		}
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break // reading a partial leaf is normal at the end of the stream
 		} else if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	root := tree.Root()
+	return nil
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (rsh *ReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 || rsh.exhausted {
+		return nil, ErrHasherMisuse
+	}
+	rsh.folder.reset()
+	var err error
+	if rsh.workers != nil && subtreeSize >= parallelMinLeaves {
+		err = rsh.pushLeavesParallel(subtreeSize)
+	} else {
+		err = rsh.pushLeaves(subtreeSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	root := rsh.folder.root()
 	if root == nil {
 		// we didn't read anything; return EOF to signal that there are no
 		// more subtrees to hash.
+		rsh.exhausted = true
 		return nil, io.EOF
 	}
 	return root, nil
@@ -53,10 +271,15 @@ func (rsh *ReaderSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error)
 
 // Skip implements SubtreeHasher.
 func (rsh *ReaderSubtreeHasher) Skip(n int) (err error) {
+	if n < 0 || (rsh.exhausted && n > 0) {
+		return ErrHasherMisuse
+	}
 	skipSize := int64(len(rsh.leaf) * n)
 	skipped, err := io.CopyN(ioutil.Discard, rsh.r, skipSize)
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		if skipped == skipSize {
+		// the final leaf of the stream may be partial, so it's sufficient to
+		// have read at least one byte of the n'th leaf
+		if n > 0 && skipped > skipSize-int64(len(rsh.leaf)) {
 			return nil
 		}
 		return io.ErrUnexpectedEOF
@@ -66,201 +289,1064 @@ func (rsh *ReaderSubtreeHasher) Skip(n int) (err error) {
 
 // NewReaderSubtreeHasher returns a new ReaderSubtreeHasher that reads leaf data from r.
 func NewReaderSubtreeHasher(r io.Reader, leafSize int, h hash.Hash) *ReaderSubtreeHasher {
+	return NewReaderSubtreeHasherBuffer(r, make([]byte, leafSize), h)
+}
+
+// NewReaderSubtreeHasherBuffer is like NewReaderSubtreeHasher, but uses leaf
+// as its buffer for reading leaf data, rather than allocating a new one. The
+// leaf size is len(leaf). This allows the buffer to be recycled (e.g. via a
+// sync.Pool) when many hashers are created; leaf must not be reused until
+// the ReaderSubtreeHasher is no longer in use.
+func NewReaderSubtreeHasherBuffer(r io.Reader, leaf []byte, h hash.Hash) *ReaderSubtreeHasher {
 	return &ReaderSubtreeHasher{
-		r:    r,
-		h:    h,
-		leaf: make([]byte, leafSize),
+		r:      r,
+		leaf:   leaf,
+		folder: subtreeFolder{h: h},
 	}
 }
 
-// CachedSubtreeHasher implements SubtreeHasher using a set of precomputed
-// leaf hashes.
-type CachedSubtreeHasher struct {
-	leafHashes [][]byte
-	h          hash.Hash
+// parallelMinLeaves is the smallest subtree whose leaves are hashed in
+// parallel by a ReaderSubtreeHasher created with
+// NewReaderSubtreeHasherParallel; smaller subtrees are not worth the overhead.
+// parallelBatchLeaves is the number of leaves read and hashed in each batch.
+const (
+	parallelMinLeaves   = 1 << 8
+	parallelBatchLeaves = 1 << 12
+)
+
+// NewReaderSubtreeHasherParallel is like NewReaderSubtreeHasher, but hashes
+// the leaves of large subtrees using the specified number of goroutines. The
+// leaf data is still read sequentially, one batch at a time, and the leaf
+// hashes are folded in order, so the roots are identical to those of a
+// NewReaderSubtreeHasher. Since each goroutine needs its own hash.Hash,
+// newHash is called to create them. If workers is not positive,
+// runtime.NumCPU() goroutines are used.
+func NewReaderSubtreeHasherParallel(r io.Reader, leafSize int, newHash func() hash.Hash, workers int) *ReaderSubtreeHasher {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	rsh := NewReaderSubtreeHasher(r, leafSize, newHash())
+	rsh.workers = make([]subtreeFolder, workers)
+	for i := range rsh.workers {
+		rsh.workers[i].h = newHash()
+	}
+	rsh.batch = make([]byte, parallelBatchLeaves*leafSize)
+	rsh.batchHashes = make([][]byte, parallelBatchLeaves)
+	return rsh
+}
+
+// NewReaderSubtreeHasherWithLeafHash returns a new ReaderSubtreeHasher that
+// reads leaf data from r, hashing leaves with leafHash and interior nodes with
+// nodeHash, as in a Tree created with NewWithLeafHash.
+func NewReaderSubtreeHasherWithLeafHash(r io.Reader, leafSize int, leafHash, nodeHash hash.Hash) *ReaderSubtreeHasher {
+	rsh := NewReaderSubtreeHasher(r, leafSize, nodeHash)
+	rsh.folder.leafH = leafHash
+	return rsh
+}
+
+// NewReaderSubtreeHasherParallelWithLeafHash is like
+// NewReaderSubtreeHasherParallel, but hashes leaves with the hashes returned
+// by newLeafHash and interior nodes with the hash returned by newNodeHash, as
+// in a Tree created with NewWithLeafHash.
+func NewReaderSubtreeHasherParallelWithLeafHash(r io.Reader, leafSize int, newLeafHash, newNodeHash func() hash.Hash, workers int) *ReaderSubtreeHasher {
+	rsh := NewReaderSubtreeHasherParallel(r, leafSize, newNodeHash, workers)
+	rsh.folder.leafH = newLeafHash()
+	for i := range rsh.workers {
+		rsh.workers[i].h = newLeafHash()
+	}
+	return rsh
+}
+
+// NewReaderSubtreeHasherLengthPrefixed returns a new ReaderSubtreeHasher that
+// reads leaf data from r and hashes each leaf with its length prepended, as
+// in a Tree created with NewLengthPrefixed.
+func NewReaderSubtreeHasherLengthPrefixed(r io.Reader, leafSize int, h hash.Hash) *ReaderSubtreeHasher {
+	rsh := NewReaderSubtreeHasher(r, leafSize, h)
+	rsh.folder.lengthPrefix = true
+	return rsh
+}
+
+// DefaultReadAtBlockSize is the default number of bytes read by each ReadAt
+// call of a ReaderAtSubtreeHasher. It matches the default readahead window of
+// many operating systems.
+const DefaultReadAtBlockSize = 1 << 17
+
+// ReaderAtSubtreeHasher implements SubtreeHasher by reading leaf data from an
+// io.ReaderAt, such as an *os.File or a memory-mapped region. Leaves are read
+// in large blocks rather than one at a time, which is friendlier to the page
+// cache and prefetcher, and skipped leaves are never read at all.
+type ReaderAtSubtreeHasher struct {
+	r        io.ReaderAt
+	leafSize int
+	block    []byte
+	folder   subtreeFolder
+
+	// pos is the index of the next leaf.
+	pos int
+	// exhausted is set once NextSubtreeRoot has returned io.EOF.
+	exhausted bool
 }
 
 // NextSubtreeRoot implements SubtreeHasher.
-func (csh *CachedSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
-	if len(csh.leafHashes) == 0 {
-		return nil, io.EOF
+func (rsh *ReaderAtSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 || rsh.exhausted {
+		return nil, ErrHasherMisuse
 	}
-	tree := New(csh.h)
-	for i := 0; i < subtreeSize && len(csh.leafHashes) > 0; i++ {
-		if err := tree.PushSubTree(0, csh.leafHashes[0]); err != nil {
+	rsh.folder.reset()
+	for remaining := subtreeSize; remaining > 0; {
+		want := len(rsh.block) / rsh.leafSize
+		if want > remaining {
+			want = remaining
+		}
+		n, err := rsh.r.ReadAt(rsh.block[:want*rsh.leafSize], int64(rsh.pos)*int64(rsh.leafSize))
+		if err != nil && err != io.EOF {
 			return nil, err
 		}
-		csh.leafHashes = csh.leafHashes[1:]
+		for buf := rsh.block[:n]; len(buf) > 0; {
+			leaf := buf
+			if len(leaf) > rsh.leafSize {
+				leaf = leaf[:rsh.leafSize]
+			}
+			rsh.folder.pushLeaf(leaf)
+			buf = buf[len(leaf):]
+			rsh.pos++
+			remaining--
+		}
+		if n < want*rsh.leafSize {
+			break // reached the end of the data
+		}
 	}
-	return tree.Root(), nil
+	root := rsh.folder.root()
+	if root == nil {
+		rsh.exhausted = true
+		return nil, io.EOF
+	}
+	return root, nil
 }
 
 // Skip implements SubtreeHasher.
-func (csh *CachedSubtreeHasher) Skip(n int) error {
-	if n > len(csh.leafHashes) {
+func (rsh *ReaderAtSubtreeHasher) Skip(n int) error {
+	if n < 0 || (rsh.exhausted && n > 0) {
+		return ErrHasherMisuse
+	} else if n == 0 {
+		return nil
+	}
+	// the final leaf may be partial, so it's sufficient for the first byte
+	// of the n'th leaf to exist
+	var b [1]byte
+	if _, err := rsh.r.ReadAt(b[:], int64(rsh.pos+n-1)*int64(rsh.leafSize)); err == io.EOF {
 		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
 	}
-	csh.leafHashes = csh.leafHashes[n:]
+	rsh.pos += n
 	return nil
 }
 
-// NewCachedSubtreeHasher creates a CachedSubtreeHasher using the specified
-// leaf hashes and hash function.
-func NewCachedSubtreeHasher(leafHashes [][]byte, h hash.Hash) *CachedSubtreeHasher {
-	return &CachedSubtreeHasher{
-		leafHashes: leafHashes,
-		h:          h,
-	}
+// NewReaderAtSubtreeHasher returns a ReaderAtSubtreeHasher that reads leaf
+// data from r, starting at offset 0, in blocks of DefaultReadAtBlockSize
+// bytes.
+func NewReaderAtSubtreeHasher(r io.ReaderAt, leafSize int, h hash.Hash) *ReaderAtSubtreeHasher {
+	return NewReaderAtSubtreeHasherBlockSize(r, leafSize, DefaultReadAtBlockSize, h)
 }
 
-// BuildRangeProof constructs a proof for the leaf range [proofStart,
-// proofEnd) using the provided SubtreeHasher.
-func BuildRangeProof(proofStart, proofEnd int, h SubtreeHasher) (proof [][]byte, err error) {
-	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
-		panic("BuildRangeProof: illegal proof range")
+// NewReaderAtSubtreeHasherBlockSize is like NewReaderAtSubtreeHasher, but
+// reads leaf data in blocks of blockSize bytes. blockSize is rounded down to
+// a multiple of leafSize, and is at least leafSize.
+func NewReaderAtSubtreeHasherBlockSize(r io.ReaderAt, leafSize, blockSize int, h hash.Hash) *ReaderAtSubtreeHasher {
+	if blockSize < leafSize {
+		blockSize = leafSize
 	}
+	return &ReaderAtSubtreeHasher{
+		r:        r,
+		leafSize: leafSize,
+		block:    make([]byte, blockSize-blockSize%leafSize),
+		folder:   subtreeFolder{h: h},
+	}
+}
 
-	// NOTE: this implementation is a bit magical. Essentially, the binary
-	// property of Merkle trees allows us to determine which subtrees are
-	// present in the proof just by looking at the binary representation of
-	// the proofStart and proofEnd integers.
-	//
-	// As an example, imagine we are constructing the following proof:
-	//
-	//               ┌────────┴────────*
-	//         ┌─────┴─────┐           │
-	//      *──┴──┐     ┌──┴──*     ┌──┴──┐
-	//    ┌─┴─┐ *─┴─┐ ┌─┴─* ┌─┴─┐ ┌─┴─┐ ┌─┴─┐
-	//    0   1 2   3 4   5 6   7 8   9 10  11
-	//              ^^^
-	//
-	// That is, proofStart = 3, proofEnd = 5, and there are 12 total leaves.
-	// Each * represents a hash that should be included in the proof. But how
-	// do we find these *s?
-	//
-	// We begin by examining the 1 bits in the binary representation of 3.
-	// There are two 1 bits set, at exponents 1 and 0, which tells us that
-	// there are two subtrees in the first half of the proof: one with 2^1
-	// leaves, and one with 2^0 leaves. So we call NextSubtreeRoot(2) to get
-	// the first proof hash, and NextSubtreeRoot(1) to get the second. The
-	// order is important here: SubtreeHashers are stateful and proceed left-
-	// to-right, so we should examine the bits in big-endian order to ensure
-	// that we process larger subtrees first.
-	//
-	// The SubtreeHasher is now inside the proof range, so we call Skip to
-	// proceed to the subtrees in the second half of the proof.
-	//
-	// We calculate the second half of the proof by examining bits again.
-	// However, instead of looking at the 1 bits in proofStart, we look at the
-	// 0 bits in proofEnd-1. All of the bits are 0 except for 2^2, so we call
-	// NextSubtreeRoot on 2^0, 2^1, 2^3, and 2^4. Again, due to the nature of
-	// the SubtreeHasher, order is important: we proceed in little-endian
-	// order to ensure that we process smaller subtrees first. Finally, when
-	// we attempt to call NextSubtreeRoot(2^4), it returns io.EOF, since we
-	// are past the end of the tree, so the proof is complete.
-	//
-	// Why does this work? Well, it helps to realize that in a binary tree,
-	// the bits of an leaf index describe the *path* from the root of the tree
-	// to that leaf. For example: to reach leaf 2 in the above tree, start at
-	// the top, then go left, left, right, left -- i.e. 0010. Thus, when we
-	// want to construct a Merkle proof for a single leaf, we can use this
-	// path to figure out which subtree hashes to include in the proof. But in
-	// a multi-leaf proof, there are two paths: the path to proofStart, and
-	// the path to proofEnd. So first we look at the path to proofStart, and
-	// throw away all the hashes "to the right" of it, since we know those
-	// will either be inside the proof range or part of the second half of the
-	// proof; then, we look at the path to proofEnd, and do the opposite,
-	// throwing away all the hashes "to the left" of it. That's why we look at
-	// the 1 bits in proofStart, but the 0 bits in proofEnd. Visually:
-	//
-	//               ┌────────┴────────*          This is the Merkle proof for
-	//         ┌─────┴─────*           │          leaf 3. Each "left-side" hash
-	//      *──┴──┐     ┌──┴──┐     ┌──┴──┐       corresponds to a 1 bit in the
-	//    ┌─┴─┐ *─┴─┐ ┌─┴─┐ ┌─┴─┐ ┌─┴─┐ ┌─┴─┐     binary string 1100.
-	//    0   1 2   3 4   5 6   7 8   9 10  11
-	//              ^
-	//
-	//               ┌────────┴────────*          This is the Merkle proof for
-	//         *─────┴─────┐           │          leaf 4. Each "right-side" hash
-	//      ┌──┴──┐     ┌──┴──*     ┌──┴──┐       corresponds to a 0 bit in the
-	//    ┌─┴─┐ ┌─┴─┐ ┌─┴─* ┌─┴─┐ ┌─┴─┐ ┌─┴─┐     binary string 0010.
-	//    0   1 2   3 4   5 6   7 8   9 10  11
-	//                ^
-	//
-	// Combining the "left side" of the first proof with the "right side" of
-	// the second yields the full range proof shown in the first diagram.
+// NewReaderAtSubtreeHasherWithLeafHash is like NewReaderAtSubtreeHasher, but
+// hashes leaves with leafHash and interior nodes with nodeHash, as in a Tree
+// created with NewWithLeafHash.
+func NewReaderAtSubtreeHasherWithLeafHash(r io.ReaderAt, leafSize int, leafHash, nodeHash hash.Hash) *ReaderAtSubtreeHasher {
+	rsh := NewReaderAtSubtreeHasher(r, leafSize, nodeHash)
+	rsh.folder.leafH = leafHash
+	return rsh
+}
 
-	// add proof hashes from leaves [0, proofStart)
-	for i := 63; i >= 0; i-- {
-		subtreeSize := 1 << uint64(i)
-		if proofStart&subtreeSize != 0 {
-			root, err := h.NextSubtreeRoot(subtreeSize)
-			if err != nil {
-				return nil, err
-			}
-			proof = append(proof, root)
-		}
-	}
+// ErrLeafMismatch is returned by a VerifyingSubtreeHasher when the hash of a
+// leaf does not match the expected hash.
+var ErrLeafMismatch = errors.New("leaf hash does not match expected hash")
 
-	// skip leaves within proof range
-	if err := h.Skip(proofEnd - proofStart); err != nil {
-		return nil, err
+// VerifyingSubtreeHasher wraps a ReaderSubtreeHasher, checking the hash of
+// each leaf it reads against a set of expected leaf hashes. This allows data
+// to be checked for corruption while a proof is built from it. Leaves are read
+// from the ReaderSubtreeHasher's stream and hashed in the same way, but always
+// sequentially, since each must be checked before it is folded.
+type VerifyingSubtreeHasher struct {
+	rsh      *ReaderSubtreeHasher
+	folder   subtreeFolder
+	expected [][]byte
+	pos      int
+
+	// exhausted is set once NextSubtreeRoot has returned io.EOF.
+	exhausted bool
+}
+
+// checkLeaf compares leafHash to the expected hash of the next leaf.
+func (vsh *VerifyingSubtreeHasher) checkLeaf(leafHash []byte) error {
+	if vsh.pos >= len(vsh.expected) {
+		return fmt.Errorf("leaf %v: no expected hash", vsh.pos)
+	} else if !bytes.Equal(leafHash, vsh.expected[vsh.pos]) {
+		return fmt.Errorf("leaf %v: %w", vsh.pos, ErrLeafMismatch)
 	}
+	vsh.pos++
+	return nil
+}
 
-	// add proof hashes from proofEnd onward, stopping when NextSubtreeRoot
-	// returns io.EOF.
-	endMask := proofEnd - 1
-	for i := 0; i < 64; i++ {
-		subtreeSize := 1 << uint64(i)
-		if endMask&subtreeSize == 0 {
-			root, err := h.NextSubtreeRoot(int(subtreeSize))
-			if err == io.EOF {
-				break
-			} else if err != nil {
+// NextSubtreeRoot implements SubtreeHasher. It returns an error wrapping
+// ErrLeafMismatch, and naming the index of the leaf, if any leaf within the
+// subtree does not match its expected hash.
+func (vsh *VerifyingSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 || vsh.exhausted {
+		return nil, ErrHasherMisuse
+	}
+	vsh.folder.reset()
+	for i := 0; i < subtreeSize; i++ {
+		n, err := io.ReadFull(vsh.rsh.r, vsh.rsh.leaf)
+		if n > 0 {
+			vsh.folder.hashLeaf(vsh.rsh.leaf[:n])
+			if err := vsh.checkLeaf(vsh.folder.cur); err != nil {
 				return nil, err
 			}
-			proof = append(proof, root)
+			vsh.folder.pushCur()
 		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // reading a partial leaf is normal at the end of the stream
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	root := vsh.folder.root()
+	if root == nil {
+		vsh.exhausted = true
+		return nil, io.EOF
 	}
+	return root, nil
+}
 
-	return proof, nil
+// Skip implements SubtreeHasher. Skipped leaves are not checked.
+func (vsh *VerifyingSubtreeHasher) Skip(n int) error {
+	if n < 0 || (vsh.exhausted && n > 0) {
+		return ErrHasherMisuse
+	}
+	if err := vsh.rsh.Skip(n); err != nil {
+		return err
+	}
+	vsh.pos += n
+	return nil
 }
 
-// A LeafHasher returns the leaves of a Merkle tree in sequential order. When
-// no more leaves are available, NextLeafHash must return io.EOF.
-type LeafHasher interface {
-	NextLeafHash() ([]byte, error)
+// NewVerifyingSubtreeHasher returns a VerifyingSubtreeHasher that checks the
+// leaves read by rsh against expected, which must contain the hash of every
+// leaf in the tree, starting from the leaf that rsh will read next. rsh
+// should not be used directly after calling NewVerifyingSubtreeHasher.
+func NewVerifyingSubtreeHasher(rsh *ReaderSubtreeHasher, expected [][]byte) *VerifyingSubtreeHasher {
+	return &VerifyingSubtreeHasher{
+		rsh: rsh,
+		folder: subtreeFolder{
+			h:            rsh.folder.h,
+			leafH:        rsh.folder.leafH,
+			lengthPrefix: rsh.folder.lengthPrefix,
+		},
+		expected: expected,
+	}
 }
 
-// ReaderLeafHasher implements the LeafHasher interface by reading leaf data
-// from the underlying stream.
-type ReaderLeafHasher struct {
-	r    io.Reader
-	h    hash.Hash
-	leaf []byte
+// IteratorSubtreeHasher implements SubtreeHasher by pulling leaf data from an
+// arbitrary source, such as the rows of a database query.
+type IteratorSubtreeHasher struct {
+	next     func() ([]byte, bool, error)
+	leafSize int
+	folder   subtreeFolder
+
+	// done is set once next has reported that no leaves remain.
+	done bool
+	// exhausted is set once NextSubtreeRoot has returned io.EOF.
+	exhausted bool
 }
 
-// NextLeafHash implements LeafHasher.
-func (rlh *ReaderLeafHasher) NextLeafHash() ([]byte, error) {
-	n, err := io.ReadFull(rlh.r, rlh.leaf)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+// nextLeaf returns the next leaf, or nil if no leaves remain.
+func (ish *IteratorSubtreeHasher) nextLeaf() ([]byte, error) {
+	if ish.done {
+		return nil, nil
+	}
+	leaf, ok, err := ish.next()
+	if err != nil {
 		return nil, err
-	} else if n == 0 {
-		return nil, io.EOF
+	} else if !ok {
+		ish.done = true
+		return nil, nil
+	} else if len(leaf) > ish.leafSize {
+		return nil, errors.New("leaf is larger than leafSize")
+	} else if leaf == nil {
+		// nil signals the end of the tree to the caller, so an empty leaf
+		// must be non-nil
+		leaf = []byte{}
 	}
-	return leafSum(rlh.h, rlh.leaf[:n]), nil
+	return leaf, nil
 }
 
-// NewReaderLeafHasher creates a ReaderLeafHasher with the specified stream,
-// hash, and leaf size.
-func NewReaderLeafHasher(r io.Reader, h hash.Hash, leafSize int) *ReaderLeafHasher {
-	return &ReaderLeafHasher{
-		r:    r,
-		h:    h,
-		leaf: make([]byte, leafSize),
+// NextSubtreeRoot implements SubtreeHasher.
+func (ish *IteratorSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 || ish.exhausted {
+		return nil, ErrHasherMisuse
 	}
-}
-
+	ish.folder.reset()
+	for i := 0; i < subtreeSize; i++ {
+		leaf, err := ish.nextLeaf()
+		if err != nil {
+			return nil, err
+		} else if leaf == nil {
+			break
+		}
+		ish.folder.pushLeaf(leaf)
+	}
+	root := ish.folder.root()
+	if root == nil {
+		ish.exhausted = true
+		return nil, io.EOF
+	}
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (ish *IteratorSubtreeHasher) Skip(n int) error {
+	if n < 0 || (ish.exhausted && n > 0) {
+		return ErrHasherMisuse
+	}
+	for i := 0; i < n; i++ {
+		leaf, err := ish.nextLeaf()
+		if err != nil {
+			return err
+		} else if leaf == nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+// NewIteratorSubtreeHasher returns an IteratorSubtreeHasher that pulls leaf
+// data from next. Each call to next should return the data of the next leaf
+// and true, or false once no leaves remain, after which next will not be
+// called again. Every leaf must be at most leafSize bytes; as with a stream
+// of leaf data, only the final leaf should be shorter than leafSize. A nil
+// leaf returned with true is an empty leaf, not the end of the tree.
+func NewIteratorSubtreeHasher(next func() ([]byte, bool, error), leafSize int, h hash.Hash) *IteratorSubtreeHasher {
+	return &IteratorSubtreeHasher{
+		next:     next,
+		leafSize: leafSize,
+		folder:   subtreeFolder{h: h},
+	}
+}
+
+// NewIteratorSubtreeHasherWithLeafHash is like NewIteratorSubtreeHasher, but
+// hashes leaves with leafHash and interior nodes with nodeHash, as in a Tree
+// created with NewWithLeafHash.
+func NewIteratorSubtreeHasherWithLeafHash(next func() ([]byte, bool, error), leafSize int, leafHash, nodeHash hash.Hash) *IteratorSubtreeHasher {
+	ish := NewIteratorSubtreeHasher(next, leafSize, nodeHash)
+	ish.folder.leafH = leafHash
+	return ish
+}
+
+// leafSubtreeHasher implements SubtreeHasher by folding the leaf hashes
+// produced by a LeafHasher.
+type leafSubtreeHasher struct {
+	lh     LeafHasher
+	folder subtreeFolder
+
+	// exhausted is set once NextSubtreeRoot has returned io.EOF.
+	exhausted bool
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (lsh *leafSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 || lsh.exhausted {
+		return nil, ErrHasherMisuse
+	}
+	lsh.folder.reset()
+	for i := 0; i < subtreeSize; i++ {
+		leafHash, err := lsh.lh.NextLeafHash()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		lsh.folder.cur = append(lsh.folder.cur[:0], leafHash...)
+		lsh.folder.pushCur()
+	}
+	root := lsh.folder.root()
+	if root == nil {
+		lsh.exhausted = true
+		return nil, io.EOF
+	}
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (lsh *leafSubtreeHasher) Skip(n int) error {
+	if n < 0 || (lsh.exhausted && n > 0) {
+		return ErrHasherMisuse
+	}
+	for i := 0; i < n; i++ {
+		if _, err := lsh.lh.NextLeafHash(); err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubtreeHasherFromLeafHasher returns a SubtreeHasher that computes subtree
+// roots by folding the leaf hashes produced by lh, which must produce the
+// hash of every leaf in the tree, in order. Since leaf hashes can only be
+// pulled from lh, Skip simply discards them.
+func SubtreeHasherFromLeafHasher(lh LeafHasher, h hash.Hash) SubtreeHasher {
+	return &leafSubtreeHasher{
+		lh:     lh,
+		folder: subtreeFolder{h: h},
+	}
+}
+
+// CachedSubtreeHasher implements SubtreeHasher using a set of precomputed
+// leaf hashes. Since the leaf hashes are precomputed, the same
+// CachedSubtreeHasher works for both plain and length-prefixed trees, as long
+// as the leaf hashes were computed accordingly (see LengthPrefixedLeafHash).
+type CachedSubtreeHasher struct {
+	leafHashes [][]byte
+	folder     subtreeFolder
+
+	// index, if non-nil, holds precomputed subtree roots for the full set of
+	// leaf hashes, of which leafHashes is a suffix.
+	index *SubtreeIndex
+
+	// exhausted is set once NextSubtreeRoot has returned io.EOF.
+	exhausted bool
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (csh *CachedSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 || csh.exhausted {
+		return nil, ErrHasherMisuse
+	}
+	if len(csh.leafHashes) == 0 {
+		csh.exhausted = true
+		return nil, io.EOF
+	}
+	if csh.index != nil {
+		offset := len(csh.index.levels[0]) - len(csh.leafHashes)
+		end := offset + subtreeSize
+		if end > len(csh.index.levels[0]) || end < offset {
+			end = len(csh.index.levels[0])
+		}
+		csh.leafHashes = csh.leafHashes[end-offset:]
+		return csh.index.root(offset, end), nil
+	}
+	csh.folder.reset()
+	for i := 0; i < subtreeSize && len(csh.leafHashes) > 0; i++ {
+		csh.folder.cur = append(csh.folder.cur[:0], csh.leafHashes[0]...)
+		csh.folder.pushCur()
+		csh.leafHashes = csh.leafHashes[1:]
+	}
+	return csh.folder.root(), nil
+}
+
+// Skip implements SubtreeHasher.
+func (csh *CachedSubtreeHasher) Skip(n int) error {
+	if n < 0 || (csh.exhausted && n > 0) {
+		return ErrHasherMisuse
+	} else if n > len(csh.leafHashes) {
+		return io.ErrUnexpectedEOF
+	}
+	csh.leafHashes = csh.leafHashes[n:]
+	return nil
+}
+
+// NewCachedSubtreeHasher creates a CachedSubtreeHasher using the specified
+// leaf hashes and hash function.
+func NewCachedSubtreeHasher(leafHashes [][]byte, h hash.Hash) *CachedSubtreeHasher {
+	return &CachedSubtreeHasher{
+		leafHashes: leafHashes,
+		folder:     subtreeFolder{h: h},
+	}
+}
+
+// A SubtreeIndex stores the roots of every aligned subtree of a set of leaf
+// hashes. Building a SubtreeIndex requires hashing the entire tree once, but
+// afterwards, any number of CachedSubtreeHashers can be created from it,
+// each of which computes subtree roots in O(log n) time rather than O(n).
+type SubtreeIndex struct {
+	// levels[i][j] is the root of the subtree containing leaves
+	// [j*2^i, (j+1)*2^i). Only complete subtrees are stored.
+	levels [][][]byte
+	h      hash.Hash
+}
+
+// root returns the root of the tree formed by the leaves [start, end).
+func (si *SubtreeIndex) root(start, end int) []byte {
+	// Fold the largest available subtrees that are aligned both within the
+	// index and relative to start. Such subtrees are never larger than the
+	// alignment of start, so their heights are non-increasing and they can
+	// always be pushed in order.
+	tree := New(si.h)
+	for pos := start; pos < end; {
+		height := 0
+		for height+1 < len(si.levels) {
+			size := 1 << uint(height+1)
+			if (pos-start)%size != 0 || pos%size != 0 || pos+size > end {
+				break
+			}
+			height++
+		}
+		if err := tree.PushSubTree(height, si.levels[height][pos>>uint(height)]); err != nil {
+			panic(err) // should never happen
+		}
+		pos += 1 << uint(height)
+	}
+	return tree.Root()
+}
+
+// NewSubtreeIndex creates a SubtreeIndex from the specified leaf hashes and
+// hash function.
+func NewSubtreeIndex(leafHashes [][]byte, h hash.Hash) *SubtreeIndex {
+	levels := [][][]byte{leafHashes}
+	for prev := leafHashes; len(prev) > 1; prev = levels[len(levels)-1] {
+		level := make([][]byte, len(prev)/2)
+		for i := range level {
+			level[i] = nodeSum(h, prev[2*i], prev[2*i+1])
+		}
+		levels = append(levels, level)
+	}
+	return &SubtreeIndex{
+		levels: levels,
+		h:      h,
+	}
+}
+
+// NewCachedSubtreeHasherFromIndex creates a CachedSubtreeHasher that uses the
+// precomputed subtree roots of si. The SubtreeIndex is not modified, and may
+// be used to create any number of CachedSubtreeHashers.
+func NewCachedSubtreeHasherFromIndex(si *SubtreeIndex) *CachedSubtreeHasher {
+	return &CachedSubtreeHasher{
+		leafHashes: si.levels[0],
+		folder:     subtreeFolder{h: si.h},
+		index:      si,
+	}
+}
+
+// SparsePrecalcSubtreeHasher wraps an underlying SubtreeHasher. It uses a
+// set of precalculated subtree roots, which may cover arbitrary spans of the
+// tree, whenever the span requested by NextSubtreeRoot has been precalculated,
+// only falling back to the underlying SubtreeHasher if needed.
+type SparsePrecalcSubtreeHasher struct {
+	roots  map[SubtreeSpan][]byte
+	sh     SubtreeHasher
+	offset int
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (sp *SparsePrecalcSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 {
+		return nil, ErrHasherMisuse
+	}
+	span := SubtreeSpan{Offset: sp.offset, Size: subtreeSize}
+	if root, ok := sp.roots[span]; ok {
+		if err := sp.sh.Skip(subtreeSize); err != nil {
+			return nil, err
+		}
+		sp.offset += subtreeSize
+		return root, nil
+	}
+	root, err := sp.sh.NextSubtreeRoot(subtreeSize)
+	if err != nil {
+		return nil, err
+	}
+	sp.offset += subtreeSize
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (sp *SparsePrecalcSubtreeHasher) Skip(n int) error {
+	if err := sp.sh.Skip(n); err != nil {
+		return err
+	}
+	sp.offset += n
+	return nil
+}
+
+// NewSparsePrecalcSubtreeHasher returns a SparsePrecalcSubtreeHasher that
+// uses the precalculated roots, keyed by the perfect subtree they cover, and
+// falls back to sh for any other span. sh must produce the leaves of the same
+// tree, starting at leaf 0. The map is not modified.
+func NewSparsePrecalcSubtreeHasher(roots map[SubtreeSpan][]byte, sh SubtreeHasher) *SparsePrecalcSubtreeHasher {
+	return &SparsePrecalcSubtreeHasher{
+		roots: roots,
+		sh:    sh,
+	}
+}
+
+// A RangeProofBuilder builds range proofs over a fixed set of leaf data,
+// remembering every subtree root it computes. Each proof consults the roots
+// computed by earlier proofs, so when building many proofs for overlapping
+// ranges of the same data (e.g. a sector), shared subtrees are hashed only
+// once. The memory used by the builder grows with the number of distinct
+// subtrees it has hashed. A RangeProofBuilder is not safe for concurrent use.
+type RangeProofBuilder struct {
+	data     []byte
+	leafSize int
+	h        hash.Hash
+	leafH    hash.Hash // if non-nil, used in place of h for leaves
+	roots    map[SubtreeSpan][]byte
+}
+
+// BuildRangeProof constructs a proof for the leaf range [proofStart,
+// proofEnd), as BuildRangeProof does, reusing any subtree roots computed by
+// previous calls.
+func (b *RangeProofBuilder) BuildRangeProof(proofStart, proofEnd int) ([][]byte, error) {
+	rsh := NewReaderSubtreeHasher(bytes.NewReader(b.data), b.leafSize, b.h)
+	rsh.folder.leafH = b.leafH
+	return BuildRangeProof(proofStart, proofEnd, &memoSubtreeHasher{
+		roots: b.roots,
+		sh:    rsh,
+	})
+}
+
+// NewRangeProofBuilder returns a RangeProofBuilder for data, split into
+// leaves of leafSize bytes. data must not be modified while the builder is in
+// use.
+func NewRangeProofBuilder(data []byte, leafSize int, h hash.Hash) *RangeProofBuilder {
+	return &RangeProofBuilder{
+		data:     data,
+		leafSize: leafSize,
+		h:        h,
+		roots:    make(map[SubtreeSpan][]byte),
+	}
+}
+
+// NewRangeProofBuilderWithLeafHash is like NewRangeProofBuilder, but hashes
+// leaves with leafHash and interior nodes with nodeHash, as in a Tree created
+// with NewWithLeafHash.
+func NewRangeProofBuilderWithLeafHash(data []byte, leafSize int, leafHash, nodeHash hash.Hash) *RangeProofBuilder {
+	b := NewRangeProofBuilder(data, leafSize, nodeHash)
+	b.leafH = leafHash
+	return b
+}
+
+// memoSubtreeHasher is like SparsePrecalcSubtreeHasher, but adds each root
+// that it computes using sh to roots.
+type memoSubtreeHasher struct {
+	roots  map[SubtreeSpan][]byte
+	sh     SubtreeHasher
+	offset int
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (m *memoSubtreeHasher) NextSubtreeRoot(subtreeSize int) ([]byte, error) {
+	if subtreeSize <= 0 {
+		return nil, ErrHasherMisuse
+	}
+	span := SubtreeSpan{Offset: m.offset, Size: subtreeSize}
+	root, ok := m.roots[span]
+	if ok {
+		// a cached span may extend past the end of the tree, in which case
+		// it covers all of the remaining leaves, and skipping it leaves sh
+		// at the end of the tree
+		if err := m.sh.Skip(subtreeSize); err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	} else {
+		var err error
+		root, err = m.sh.NextSubtreeRoot(subtreeSize)
+		if err != nil {
+			return nil, err
+		}
+		m.roots[span] = root
+	}
+	m.offset += subtreeSize
+	return root, nil
+}
+
+// Skip implements SubtreeHasher.
+func (m *memoSubtreeHasher) Skip(n int) error {
+	if err := m.sh.Skip(n); err != nil {
+		return err
+	}
+	m.offset += n
+	return nil
+}
+
+// A SubtreeRoot pairs a SubtreeSpan with the Merkle root of the leaves it
+// covers.
+type SubtreeRoot struct {
+	SubtreeSpan
+	Root []byte
+}
+
+// VerifySubtreeRoots reports whether roots exactly tile the leaves [0,
+// numLeaves) and fold to claimedRoot. The spans must be in order, contiguous,
+// and non-overlapping, and each must be a perfect subtree aligned to its own
+// size, as in CoveringSubtrees(0, numLeaves) or any finer decomposition of
+// it. This can be used to validate a cache of subtree roots before passing
+// them to a SparsePrecalcSubtreeHasher.
+func VerifySubtreeRoots(roots []SubtreeRoot, claimedRoot []byte, numLeaves int, h hash.Hash) bool {
+	if numLeaves <= 0 {
+		return false
+	}
+	tree := New(h)
+	pos := 0
+	for _, sr := range roots {
+		size := sr.Size
+		if sr.Offset != pos || size <= 0 || size&(size-1) != 0 || sr.Offset%size != 0 ||
+			sr.Offset+size > numLeaves || len(sr.Root) != h.Size() {
+			return false
+		}
+		// since each span is aligned, its height never exceeds that of the
+		// smallest subtree in the tree
+		if err := tree.PushSubTree(bits.TrailingZeros64(uint64(size)), sr.Root); err != nil {
+			return false
+		}
+		pos += size
+	}
+	return pos == numLeaves && bytes.Equal(tree.Root(), claimedRoot)
+}
+
+// A HashAllocator supplies the memory for the hashes of a proof, e.g. from a
+// pool or an arena, allowing proof memory to be reused across builds.
+// BuildRangeProofAlloc calls Alloc once per proof hash; the returned slice
+// must have length size. Once BuildRangeProofAlloc returns, the proof hashes
+// are owned by the caller, who is responsible for returning them to the
+// allocator (if appropriate) when they are no longer in use. If
+// BuildRangeProofAlloc returns an error, the hashes allocated so far are
+// discarded, not returned to the allocator.
+type HashAllocator interface {
+	Alloc(size int) []byte
+}
+
+// BuildRangeProof constructs a proof for the leaf range [proofStart,
+// proofEnd) using the provided SubtreeHasher.
+func BuildRangeProof(proofStart, proofEnd int, h SubtreeHasher) (proof [][]byte, err error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("BuildRangeProof: illegal proof range")
+	}
+	return BuildRangeProofAlloc(proofStart, proofEnd, h, nil)
+}
+
+// BuildRangeProofAlloc is like BuildRangeProof, but copies each proof hash
+// into memory obtained from alloc. If alloc is nil, the proof hashes are
+// those returned by the SubtreeHasher, as in BuildRangeProof.
+func BuildRangeProofAlloc(proofStart, proofEnd int, h SubtreeHasher, alloc HashAllocator) (proof [][]byte, err error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("BuildRangeProofAlloc: illegal proof range")
+	}
+	appendHash := func(root []byte) {
+		if alloc != nil {
+			root = append(alloc.Alloc(len(root))[:0], root...)
+		}
+		proof = append(proof, root)
+	}
+
+	// NOTE: this implementation is a bit magical. Essentially, the binary
+	// property of Merkle trees allows us to determine which subtrees are
+	// present in the proof just by looking at the binary representation of
+	// the proofStart and proofEnd integers.
+	//
+	// As an example, imagine we are constructing the following proof:
+	//
+	//               ┌────────┴────────*
+	//         ┌─────┴─────┐           │
+	//      *──┴──┐     ┌──┴──*     ┌──┴──┐
+	//    ┌─┴─┐ *─┴─┐ ┌─┴─* ┌─┴─┐ ┌─┴─┐ ┌─┴─┐
+	//    0   1 2   3 4   5 6   7 8   9 10  11
+	//              ^^^
+	//
+	// That is, proofStart = 3, proofEnd = 5, and there are 12 total leaves.
+	// Each * represents a hash that should be included in the proof. But how
+	// do we find these *s?
+	//
+	// We begin by examining the 1 bits in the binary representation of 3.
+	// There are two 1 bits set, at exponents 1 and 0, which tells us that
+	// there are two subtrees in the first half of the proof: one with 2^1
+	// leaves, and one with 2^0 leaves. So we call NextSubtreeRoot(2) to get
+	// the first proof hash, and NextSubtreeRoot(1) to get the second. The
+	// order is important here: SubtreeHashers are stateful and proceed left-
+	// to-right, so we should examine the bits in big-endian order to ensure
+	// that we process larger subtrees first.
+	//
+	// The SubtreeHasher is now inside the proof range, so we call Skip to
+	// proceed to the subtrees in the second half of the proof.
+	//
+	// We calculate the second half of the proof by examining bits again.
+	// However, instead of looking at the 1 bits in proofStart, we look at the
+	// 0 bits in proofEnd-1. All of the bits are 0 except for 2^2, so we call
+	// NextSubtreeRoot on 2^0, 2^1, 2^3, and 2^4. Again, due to the nature of
+	// the SubtreeHasher, order is important: we proceed in little-endian
+	// order to ensure that we process smaller subtrees first. Finally, when
+	// we attempt to call NextSubtreeRoot(2^4), it returns io.EOF, since we
+	// are past the end of the tree, so the proof is complete.
+	//
+	// Why does this work? Well, it helps to realize that in a binary tree,
+	// the bits of an leaf index describe the *path* from the root of the tree
+	// to that leaf. For example: to reach leaf 2 in the above tree, start at
+	// the top, then go left, left, right, left -- i.e. 0010. Thus, when we
+	// want to construct a Merkle proof for a single leaf, we can use this
+	// path to figure out which subtree hashes to include in the proof. But in
+	// a multi-leaf proof, there are two paths: the path to proofStart, and
+	// the path to proofEnd. So first we look at the path to proofStart, and
+	// throw away all the hashes "to the right" of it, since we know those
+	// will either be inside the proof range or part of the second half of the
+	// proof; then, we look at the path to proofEnd, and do the opposite,
+	// throwing away all the hashes "to the left" of it. That's why we look at
+	// the 1 bits in proofStart, but the 0 bits in proofEnd. Visually:
+	//
+	//               ┌────────┴────────*          This is the Merkle proof for
+	//         ┌─────┴─────*           │          leaf 3. Each "left-side" hash
+	//      *──┴──┐     ┌──┴──┐     ┌──┴──┐       corresponds to a 1 bit in the
+	//    ┌─┴─┐ *─┴─┐ ┌─┴─┐ ┌─┴─┐ ┌─┴─┐ ┌─┴─┐     binary string 1100.
+	//    0   1 2   3 4   5 6   7 8   9 10  11
+	//              ^
+	//
+	//               ┌────────┴────────*          This is the Merkle proof for
+	//         *─────┴─────┐           │          leaf 4. Each "right-side" hash
+	//      ┌──┴──┐     ┌──┴──*     ┌──┴──┐       corresponds to a 0 bit in the
+	//    ┌─┴─┐ ┌─┴─┐ ┌─┴─* ┌─┴─┐ ┌─┴─┐ ┌─┴─┐     binary string 0010.
+	//    0   1 2   3 4   5 6   7 8   9 10  11
+	//                ^
+	//
+	// Combining the "left side" of the first proof with the "right side" of
+	// the second yields the full range proof shown in the first diagram.
+
+	// add proof hashes from leaves [0, proofStart)
+	for i := maxSubtreeHeight; i >= 0; i-- {
+		subtreeSize := 1 << uint64(i)
+		if proofStart&subtreeSize != 0 {
+			root, err := h.NextSubtreeRoot(subtreeSize)
+			if err != nil {
+				return nil, err
+			}
+			appendHash(root)
+		}
+	}
+
+	// skip leaves within proof range
+	if err := h.Skip(proofEnd - proofStart); err != nil {
+		return nil, err
+	}
+
+	// add proof hashes from proofEnd onward, stopping when NextSubtreeRoot
+	// returns io.EOF. If the tree ends partway through a subtree, the final
+	// call returns the root of the remaining leaves, and the next call
+	// returns io.EOF; all SubtreeHashers must behave this way, so that the
+	// proof does not depend on which SubtreeHasher was used.
+	//
+	// Subtree sizes are limited to those that fit in an int; a tree can never
+	// contain more leaves than that, so this always reaches the end of the
+	// tree.
+	endMask := proofEnd - 1
+	for i := 0; i <= maxSubtreeHeight; i++ {
+		subtreeSize := 1 << uint64(i)
+		if endMask&subtreeSize == 0 {
+			root, err := h.NextSubtreeRoot(subtreeSize)
+			if IsEndOfTree(err) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			appendHash(root)
+		}
+	}
+
+	return proof, nil
+}
+
+// BuildRangeProofOmitLeft constructs a proof for the leaf range [proofStart,
+// proofEnd) that omits the hashes for leaves [0, proofStart). Such a proof can
+// only be verified by VerifyRangeProofFromLeft, using left subtree roots that
+// the verifier already trusts.
+func BuildRangeProofOmitLeft(proofStart, proofEnd int, h SubtreeHasher) (proof [][]byte, err error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("BuildRangeProofOmitLeft: illegal proof range")
+	}
+	// skip both the omitted leaves and the leaves within the proof range
+	if err := h.Skip(proofEnd); err != nil {
+		return nil, err
+	}
+
+	// add proof hashes from proofEnd onward, stopping when NextSubtreeRoot
+	// returns io.EOF.
+	endMask := proofEnd - 1
+	for i := 0; i <= maxSubtreeHeight; i++ {
+		subtreeSize := 1 << uint64(i)
+		if endMask&subtreeSize == 0 {
+			root, err := h.NextSubtreeRoot(subtreeSize)
+			if IsEndOfTree(err) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			proof = append(proof, root)
+		}
+	}
+	return proof, nil
+}
+
+// BuildPrefixProof constructs a proof for the leaf range [0, prefixLeaves).
+// Such a proof contains only right-side hashes, and is identical to the proof
+// returned by BuildRangeProof(0, prefixLeaves, sh). It can be verified with
+// VerifyPrefixProof using the roots of the prefix, without the prefix's
+// leaves.
+func BuildPrefixProof(prefixLeaves int, sh SubtreeHasher) (proof [][]byte, err error) {
+	if prefixLeaves <= 0 {
+		panic("BuildPrefixProof: illegal prefix length")
+	}
+	return BuildRangeProof(0, prefixLeaves, sh)
+}
+
+// BuildRangeProofFromBytes constructs a proof for the leaf range
+// [proofStart, proofEnd) of data, split into leaves of leafSize bytes. It is
+// a convenience wrapper around BuildRangeProof. For a single proof, each leaf
+// is hashed exactly once regardless of the SubtreeHasher used, so there is no
+// benefit to pre-hashing the leaves; a ReaderSubtreeHasher is used, since it
+// requires no additional memory. When building many proofs over the same
+// data, use a CachedSubtreeHasher or SubtreeIndex instead.
+func BuildRangeProofFromBytes(data []byte, leafSize, proofStart, proofEnd int, h hash.Hash) ([][]byte, error) {
+	return BuildRangeProof(proofStart, proofEnd, NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, h))
+}
+
+// BoundaryHash returns the hash at the boundary between the adjacent ranges
+// [start, mid) and [mid, end): the root of the aligned subtree that begins at
+// mid and contains mid&-mid leaves. This is the first right-side hash in a
+// proof for [start, mid), and covers leaves that are proven by a proof for
+// [mid, end); it is therefore the hash that is dropped when the two proofs are
+// combined into a proof for [start, end), and added when such a proof is
+// split at mid. The subtree must lie entirely within [mid, end). sh must be
+// positioned at the start of the tree.
+func BoundaryHash(start, mid, end int, sh SubtreeHasher, h hash.Hash) ([]byte, error) {
+	if start < 0 || start >= mid || mid >= end {
+		panic("BoundaryHash: illegal ranges")
+	}
+	size := mid & -mid
+	if mid+size > end {
+		return nil, fmt.Errorf("boundary subtree [%v, %v) extends past end of range", mid, mid+size)
+	}
+	if err := sh.Skip(mid); err != nil {
+		return nil, err
+	}
+	root, err := sh.NextSubtreeRoot(size)
+	if IsEndOfTree(err) {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	} else if len(root) != h.Size() {
+		return nil, ErrBadHashLength
+	}
+	return root, nil
+}
+
+// FindAndProve searches the leaf hashes of sh for leafHash and constructs a
+// proof for the first matching leaf, returning the index of that leaf along
+// with the proof. Only the first numLeaves leaves are searched. Since most
+// SubtreeHashers cannot be searched without consuming them, sh must be a
+// *CachedSubtreeHasher.
+func FindAndProve(leafHash []byte, sh SubtreeHasher, numLeaves int) (index int, proof [][]byte, err error) {
+	csh, ok := sh.(*CachedSubtreeHasher)
+	if !ok {
+		return 0, nil, errors.New("FindAndProve requires a CachedSubtreeHasher")
+	}
+	leafHashes := csh.leafHashes
+	if numLeaves < len(leafHashes) {
+		leafHashes = leafHashes[:numLeaves]
+	}
+	for i := range leafHashes {
+		if bytes.Equal(leafHashes[i], leafHash) {
+			proof, err := BuildRangeProof(i, i+1, csh)
+			return i, proof, err
+		}
+	}
+	return 0, nil, errors.New("no leaf matches the supplied hash")
+}
+
+// A LeafHasher returns the leaves of a Merkle tree in sequential order. When
+// no more leaves are available, NextLeafHash must return io.EOF.
+type LeafHasher interface {
+	NextLeafHash() ([]byte, error)
+}
+
+// ReaderLeafHasher implements the LeafHasher interface by reading leaf data
+// from the underlying stream.
+type ReaderLeafHasher struct {
+	r            io.Reader
+	h            hash.Hash
+	leaf         []byte
+	lengthPrefix bool
+}
+
+// NextLeafHash implements LeafHasher.
+func (rlh *ReaderLeafHasher) NextLeafHash() ([]byte, error) {
+	n, err := io.ReadFull(rlh.r, rlh.leaf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	} else if n == 0 {
+		return nil, io.EOF
+	}
+	if rlh.lengthPrefix {
+		return lengthPrefixedLeafSum(rlh.h, rlh.leaf[:n]), nil
+	}
+	return leafSum(rlh.h, rlh.leaf[:n]), nil
+}
+
+// NewReaderLeafHasher creates a ReaderLeafHasher with the specified stream,
+// hash, and leaf size.
+func NewReaderLeafHasher(r io.Reader, h hash.Hash, leafSize int) *ReaderLeafHasher {
+	return NewReaderLeafHasherBuffer(r, h, make([]byte, leafSize))
+}
+
+// NewReaderLeafHasherBuffer is like NewReaderLeafHasher, but uses leaf as its
+// buffer for reading leaf data, rather than allocating a new one. The leaf
+// size is len(leaf). As with NewReaderSubtreeHasherBuffer, leaf must not be
+// reused until the ReaderLeafHasher is no longer in use.
+func NewReaderLeafHasherBuffer(r io.Reader, h hash.Hash, leaf []byte) *ReaderLeafHasher {
+	return &ReaderLeafHasher{
+		r:    r,
+		h:    h,
+		leaf: leaf,
+	}
+}
+
+// NewReaderLeafHasherLengthPrefixed creates a ReaderLeafHasher that hashes
+// each leaf with its length prepended, as in a Tree created with
+// NewLengthPrefixed.
+func NewReaderLeafHasherLengthPrefixed(r io.Reader, h hash.Hash, leafSize int) *ReaderLeafHasher {
+	rlh := NewReaderLeafHasher(r, h, leafSize)
+	rlh.lengthPrefix = true
+	return rlh
+}
+
+// NewFileRangeLeafHasher creates a ReaderLeafHasher that reads the leaves
+// [start, end) from f, which is typically an *os.File. If the range extends
+// past the end of f, the final leaf may be shorter than leafSize, just as
+// when reading from any other stream.
+func NewFileRangeLeafHasher(f io.ReaderAt, h hash.Hash, leafSize, start, end int) *ReaderLeafHasher {
+	if leafSize <= 0 {
+		panic("NewFileRangeLeafHasher: leafSize must be positive")
+	} else if start < 0 || start > end {
+		panic("NewFileRangeLeafHasher: illegal leaf range")
+	}
+	off := int64(start) * int64(leafSize)
+	n := int64(end-start) * int64(leafSize)
+	return NewReaderLeafHasher(io.NewSectionReader(f, off, n), h, leafSize)
+}
+
 // CachedLeafHasher implements the LeafHasher interface by returning
 // precomputed leaf hashes.
 type CachedLeafHasher struct {
@@ -268,39 +1354,921 @@ type CachedLeafHasher struct {
 }
 
 // NextLeafHash implements LeafHasher.
-func (clh *CachedLeafHasher) NextLeafHash() ([]byte, error) {
-	if len(clh.leafHashes) == 0 {
+func (clh *CachedLeafHasher) NextLeafHash() ([]byte, error) {
+	if len(clh.leafHashes) == 0 {
+		return nil, io.EOF
+	}
+	h := clh.leafHashes[0]
+	clh.leafHashes = clh.leafHashes[1:]
+	return h, nil
+}
+
+// NewCachedLeafHasher creates a CachedLeafHasher from a set of precomputed
+// leaf hashes.
+func NewCachedLeafHasher(leafHashes [][]byte) *CachedLeafHasher {
+	return &CachedLeafHasher{
+		leafHashes: leafHashes,
+	}
+}
+
+// MapLeafHasher implements the LeafHasher interface by hashing leaf data
+// stored in a map, keyed by leaf index. The leaves are produced in ascending
+// order of index, which is the order required by the verifier.
+type MapLeafHasher struct {
+	indices []int
+	leaves  map[int][]byte
+	h       hash.Hash
+}
+
+// NextLeafHash implements LeafHasher. It returns an error if the next index
+// is not present in the map.
+func (mlh *MapLeafHasher) NextLeafHash() ([]byte, error) {
+	if len(mlh.indices) == 0 {
+		return nil, io.EOF
+	}
+	leaf, ok := mlh.leaves[mlh.indices[0]]
+	if !ok {
+		return nil, fmt.Errorf("leaf %v is missing", mlh.indices[0])
+	}
+	mlh.indices = mlh.indices[1:]
+	return leafSum(mlh.h, leaf), nil
+}
+
+// NewMapLeafHasher creates a MapLeafHasher that produces the hashes of the
+// leaves at the specified indices, which are sorted in ascending order. The
+// indices slice and leaves map are not modified.
+func NewMapLeafHasher(indices []int, leaves map[int][]byte, h hash.Hash) *MapLeafHasher {
+	indices = append([]int(nil), indices...)
+	sort.Ints(indices)
+	return &MapLeafHasher{
+		indices: indices,
+		leaves:  leaves,
+		h:       h,
+	}
+}
+
+// FetchLeafHasher implements the LeafHasher interface by hashing leaf data
+// obtained from a callback, one leaf at a time. This allows leaves to be
+// fetched on demand, e.g. from a cache or over the network, as the verifier
+// consumes them.
+type FetchLeafHasher struct {
+	fetch func(index int) ([]byte, error)
+	h     hash.Hash
+	index int
+	end   int
+}
+
+// NextLeafHash implements LeafHasher. Errors returned by the callback are
+// wrapped with the index of the leaf.
+func (flh *FetchLeafHasher) NextLeafHash() ([]byte, error) {
+	if flh.index >= flh.end {
+		return nil, io.EOF
+	}
+	leaf, err := flh.fetch(flh.index)
+	if err != nil {
+		return nil, fmt.Errorf("leaf %v: %w", flh.index, err)
+	}
+	flh.index++
+	return leafSum(flh.h, leaf), nil
+}
+
+// NewFetchLeafHasher creates a FetchLeafHasher that produces the hashes of the
+// leaves [start, end), calling fetch for each index in order.
+func NewFetchLeafHasher(fetch func(index int) ([]byte, error), h hash.Hash, start, end int) *FetchLeafHasher {
+	if start < 0 || start > end {
+		panic("NewFetchLeafHasher: illegal leaf range")
+	}
+	return &FetchLeafHasher{
+		fetch: fetch,
+		h:     h,
+		index: start,
+		end:   end,
+	}
+}
+
+// ReversedLeafHasher implements the LeafHasher interface by reversing the
+// order of the leaf hashes produced by another LeafHasher. This is useful
+// when the leaves of a proof range arrive last-to-first. Since the range must
+// be reversed in its entirety, the first call to NextLeafHash buffers all of
+// its leaf hashes.
+type ReversedLeafHasher struct {
+	lh         LeafHasher
+	numLeaves  int
+	leafHashes [][]byte
+	buffered   bool
+}
+
+// NextLeafHash implements LeafHasher.
+func (rlh *ReversedLeafHasher) NextLeafHash() ([]byte, error) {
+	if !rlh.buffered {
+		rlh.buffered = true
+		rlh.leafHashes = make([][]byte, 0, rlh.numLeaves)
+		for len(rlh.leafHashes) < rlh.numLeaves {
+			leafHash, err := rlh.lh.NextLeafHash()
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return nil, err
+			}
+			rlh.leafHashes = append(rlh.leafHashes, append([]byte(nil), leafHash...))
+		}
+	}
+	if len(rlh.leafHashes) == 0 {
+		return nil, io.EOF
+	}
+	leafHash := rlh.leafHashes[len(rlh.leafHashes)-1]
+	rlh.leafHashes = rlh.leafHashes[:len(rlh.leafHashes)-1]
+	return leafHash, nil
+}
+
+// NewReversedLeafHasher creates a ReversedLeafHasher that reads numLeaves
+// leaf hashes from lh, in reverse order, and produces them in forward order.
+// numLeaves is typically the size of the proof range; lh is never read past
+// numLeaves leaf hashes, so the amount of memory buffered is bounded.
+func NewReversedLeafHasher(lh LeafHasher, numLeaves int) *ReversedLeafHasher {
+	return &ReversedLeafHasher{
+		lh:        lh,
+		numLeaves: numLeaves,
+	}
+}
+
+// checkHashLengths returns ErrBadHashLength if any of the supplied hashes is
+// not exactly h.Size() bytes long.
+func checkHashLengths(hashes [][]byte, h hash.Hash) error {
+	for _, b := range hashes {
+		if len(b) != h.Size() {
+			return ErrBadHashLength
+		}
+	}
+	return nil
+}
+
+// checkProofHashSizes is like checkHashLengths, but for a proof for the leaf
+// range [proofStart, proofEnd) in a tree whose leaf hashes are leafSize bytes
+// and whose node hashes are nodeSize bytes. Each proof hash covering a single
+// leaf must be leafSize bytes, and every other hash nodeSize bytes. The
+// exception is the final right-side hash, which may cover a subtree truncated
+// by the end of the tree to a single leaf, and so may have either size. The
+// proof must already have been checked with checkProofLength.
+func checkProofHashSizes(proofStart, proofEnd int, proof [][]byte, leafSize, nodeSize int) error {
+	wantSize := func(height int) int {
+		if height == 0 {
+			return leafSize
+		}
+		return nodeSize
+	}
+	for i := maxSubtreeHeight; i >= 0; i-- {
+		if proofStart&(1<<uint(i)) != 0 {
+			if len(proof[0]) != wantSize(i) {
+				return ErrBadHashLength
+			}
+			proof = proof[1:]
+		}
+	}
+	endMask := proofEnd - 1
+	for i := 0; i <= maxSubtreeHeight && len(proof) > 0; i++ {
+		if endMask&(1<<uint(i)) == 0 {
+			truncated := len(proof) == 1 && len(proof[0]) == leafSize
+			if len(proof[0]) != wantSize(i) && !truncated {
+				return ErrBadHashLength
+			}
+			proof = proof[1:]
+		}
+	}
+	return nil
+}
+
+// SubtreeRootLeafHasher implements the LeafHasher interface by returning a
+// single precomputed root for the entire proof range, rather than the hash of
+// each leaf. This allows a verifier who already knows the root of the range
+// to skip hashing the leaves. VerifyRangeProof only accepts a
+// SubtreeRootLeafHasher if the proof range forms a single aligned subtree,
+// e.g. [4, 8) or [8, 16).
+type SubtreeRootLeafHasher struct {
+	root []byte
+}
+
+// NextLeafHash implements LeafHasher. It returns the root of the range once,
+// and then io.EOF.
+func (srlh *SubtreeRootLeafHasher) NextLeafHash() ([]byte, error) {
+	if srlh.root == nil {
+		return nil, io.EOF
+	}
+	root := srlh.root
+	srlh.root = nil
+	return root, nil
+}
+
+// NewSubtreeRootLeafHasher creates a SubtreeRootLeafHasher from the root of
+// the proof range.
+func NewSubtreeRootLeafHasher(root []byte) *SubtreeRootLeafHasher {
+	return &SubtreeRootLeafHasher{
+		root: root,
+	}
+}
+
+// VerifyRangeProof verifies a proof produced by BuildRangeProof using leaf
+// hashes produced by lh, which must contain only the leaf hashes within the
+// proof range. The leaf hashes must be computed with the same hash algorithm
+// as h; otherwise, verification will silently fail. VerifyRangeProofH avoids
+// this pitfall by using a single hash for both. If lh produces no leaf
+// hashes, ErrNoLeafHashes is returned.
+//
+// The structure of the proof is checked before any leaf hashes are consumed:
+// a proof containing a hash of the wrong length is rejected with
+// ErrBadHashLength, and a proof with the wrong number of hashes for the
+// range is reported as invalid, without reading the proof range from lh.
+func VerifyRangeProof(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProof: illegal proof range")
+	}
+	proofRoot, err := rangeProofRoot(lh, h, proofStart, proofEnd, proof)
+	if err == ErrBadProofLength {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(proofRoot, root), nil
+}
+
+// VerifyRangeProofWithLeafHash is like VerifyRangeProof, but for trees whose
+// leaves are hashed with leafHash and whose interior nodes are hashed with
+// nodeHash, as in a Tree created with NewWithLeafHash. lh must produce leaf
+// hashes using leafHash. A proof hash covering a single leaf must be the size
+// of leafHash, and every other proof hash the size of nodeHash; see
+// checkProofHashSizes.
+func VerifyRangeProofWithLeafHash(lh LeafHasher, leafHash, nodeHash hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofWithLeafHash: illegal proof range")
+	}
+	if err := checkProofLength(proofStart, proofEnd, proof); err != nil {
+		return false, nil
+	} else if err := checkProofHashSizes(proofStart, proofEnd, proof, leafHash.Size(), nodeHash.Size()); err != nil {
+		return false, err
+	}
+	proofRoot, err := foldRangeProof(lh, nodeHash, proofStart, proofEnd, proof, nil)
+	if err == ErrBadProofLength {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(proofRoot, root), nil
+}
+
+// ReconstructRoot returns the Merkle root implied by a proof for the leaf
+// range [proofStart, proofEnd) and the leaf hashes within that range. This is
+// the same computation performed by VerifyRangeProof, which compares its
+// result to the expected root; ReconstructRoot can be used to derive the root
+// when it is not known in advance.
+func ReconstructRoot(proofStart, proofEnd int, proof [][]byte, leafHashes [][]byte, h hash.Hash) ([]byte, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("ReconstructRoot: illegal proof range")
+	}
+	return rangeProofRoot(NewCachedLeafHasher(leafHashes), h, proofStart, proofEnd, proof)
+}
+
+// ProofInputs bundles a range proof with the inputs needed to reconstruct
+// the Merkle root it implies: the leaf hashes within the proof range, and the
+// hash function used to build the tree.
+type ProofInputs struct {
+	Start  int
+	End    int
+	Proof  [][]byte
+	Leaves LeafHasher
+	Hash   hash.Hash
+}
+
+// ProofsShareRoot reports whether p1 and p2 imply the same Merkle root,
+// without either root being supplied. Both roots are reconstructed as in
+// ReconstructRoot and compared in constant time. A proof that is
+// structurally malformed implies no root, and so shares no root with the
+// other proof. p1 and p2 may use the same hash.Hash.
+func ProofsShareRoot(p1, p2 ProofInputs) (bool, error) {
+	for _, p := range []ProofInputs{p1, p2} {
+		if p.Start < 0 || p.Start > p.End || p.Start == p.End {
+			panic("ProofsShareRoot: illegal proof range")
+		}
+	}
+	root1, err := rangeProofRoot(p1.Leaves, p1.Hash, p1.Start, p1.End, p1.Proof)
+	if err == ErrBadProofLength {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	root2, err := rangeProofRoot(p2.Leaves, p2.Hash, p2.Start, p2.End, p2.Proof)
+	if err == ErrBadProofLength {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(root1, root2) == 1, nil
+}
+
+// VerifyExclusion verifies that the leaf at index lies outside of the leaf
+// range [start, end), where both the leaf and the range are proven against
+// the same root: leafProof is a proof for the range [index, index+1), with
+// its leaf hash supplied by leaf, and rangeProof is a proof for [start, end),
+// with its leaf hashes supplied by rangeLeaves. It returns false if index is
+// within the range, or if either proof does not verify.
+func VerifyExclusion(h hash.Hash, index int, leaf LeafHasher, leafProof [][]byte, start, end int, rangeLeaves LeafHasher, rangeProof [][]byte, root []byte) (bool, error) {
+	if index < 0 || start < 0 || start >= end {
+		panic("VerifyExclusion: illegal proof range")
+	}
+	if ProofCoversIndex(start, end, index) {
+		return false, nil
+	}
+	if ok, err := VerifyRangeProof(leaf, h, index, index+1, leafProof, root); !ok || err != nil {
+		return false, err
+	}
+	return VerifyRangeProof(rangeLeaves, h, start, end, rangeProof, root)
+}
+
+// MMRRoot returns the root of a Merkle mountain range with the given peaks,
+// ordered from left to right (i.e. from tallest to shortest). The peaks are
+// "bagged" right-to-left with nodeSum, so that the root of an MMR whose peaks
+// are the roots of CoveringSubtrees(0, numLeaves) is the same as the root of
+// a Tree containing those leaves. MMRRoot returns nil if there are no peaks.
+func MMRRoot(peaks [][]byte, h hash.Hash) []byte {
+	if len(peaks) == 0 {
+		return nil
+	}
+	root := append([]byte(nil), peaks[len(peaks)-1]...)
+	for i := len(peaks) - 2; i >= 0; i-- {
+		root = nodeSum(h, peaks[i], root)
+	}
+	return root
+}
+
+// VerifyMMRProof verifies that the leaf at index, whose hash is supplied by
+// lh, is part of a Merkle mountain range of numLeaves leaves with the given
+// root. peaks are the roots of the perfect subtrees of the MMR, as in
+// MMRRoot, and proof is a proof for the leaf within the peak that contains
+// it, as constructed by BuildRangeProof over that peak's leaves.
+func VerifyMMRProof(lh LeafHasher, h hash.Hash, index, numLeaves int, proof [][]byte, peaks [][]byte, root []byte) (bool, error) {
+	if index < 0 || index >= numLeaves {
+		panic("VerifyMMRProof: illegal leaf index")
+	}
+	spans := CoveringSubtrees(0, numLeaves)
+	if len(peaks) != len(spans) {
+		return false, errors.New("wrong number of peaks")
+	} else if err := checkHashLengths(peaks, h); err != nil {
+		return false, err
+	} else if !bytes.Equal(MMRRoot(peaks, h), root) {
+		return false, nil
+	}
+	for i, span := range spans {
+		if ProofCoversIndex(span.Offset, span.Offset+span.Size, index) {
+			return VerifyRangeProof(lh, h, index-span.Offset, index-span.Offset+1, proof, peaks[i])
+		}
+	}
+	panic("unreachable")
+}
+
+// A TranscriptStep records a single subtree pushed onto the tree while
+// verifying a range proof: the height of the subtree and its root.
+type TranscriptStep struct {
+	Height int
+	Hash   []byte
+}
+
+// A Transcript records a range proof verification: every subtree pushed while
+// computing the root, in order, and the root they produced.
+type Transcript struct {
+	Steps []TranscriptStep
+	Root  []byte
+}
+
+// VerifyRangeProofTranscript is like VerifyRangeProof, but also returns a
+// transcript of the verification. The transcript is returned even if the
+// proof is invalid, so long as err is nil, in which case its Root differs
+// from root. It can be checked independently with ReplayTranscript.
+func VerifyRangeProofTranscript(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, Transcript, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofTranscript: illegal proof range")
+	}
+	var t Transcript
+	proofRoot, err := recordRangeProofRoot(lh, h, proofStart, proofEnd, proof, func(height int, sum []byte) {
+		t.Steps = append(t.Steps, TranscriptStep{
+			Height: height,
+			Hash:   append([]byte(nil), sum...),
+		})
+	})
+	if err == ErrBadProofLength {
+		return false, Transcript{}, nil
+	} else if err != nil {
+		return false, Transcript{}, err
+	}
+	t.Root = proofRoot
+	return bytes.Equal(proofRoot, root), t, nil
+}
+
+// ReplayTranscript re-executes the subtree pushes recorded by
+// VerifyRangeProofTranscript, confirms that they fold to the root recorded in
+// the transcript, and reports whether that root is root. An error is returned
+// if the transcript is malformed, i.e. if it is empty, contains a hash of the
+// wrong length, pushes a subtree taller than the one before it, or does not
+// fold to its recorded root.
+func ReplayTranscript(t Transcript, root []byte, h hash.Hash) (bool, error) {
+	steps := t.Steps
+	if len(steps) == 0 {
+		return false, errors.New("empty transcript")
+	}
+	tree := New(h)
+	for i, step := range steps {
+		if len(step.Hash) != h.Size() {
+			return false, fmt.Errorf("transcript step %v has a hash of length %v, expected %v", i, len(step.Hash), h.Size())
+		} else if step.Height < 0 || step.Height > maxSubtreeHeight {
+			return false, fmt.Errorf("transcript step %v has illegal height %v", i, step.Height)
+		}
+		if err := tree.PushSubTree(step.Height, step.Hash); err != nil {
+			return false, fmt.Errorf("transcript step %v: %v", i, err)
+		}
+	}
+	if !bytes.Equal(tree.Root(), t.Root) {
+		return false, errors.New("transcript steps do not fold to the recorded root")
+	}
+	return bytes.Equal(t.Root, root), nil
+}
+
+// VerifyRangeProofSubtrees is like VerifyRangeProof, but if the proof is
+// valid, it also returns the roots of every perfect subtree authenticated by
+// the verification, keyed by span: the subtrees covered by the proof hashes,
+// the leaves within the range, and every subtree formed by joining them. The
+// roots can be cached (e.g. in a SparsePrecalcSubtreeHasher) for use with
+// future proofs against the same tree. numLeaves is the number of leaves in
+// the tree; it is needed to exclude the rightmost proof hash when it covers
+// an imperfect subtree. If the proof is invalid, the returned map is nil.
+func VerifyRangeProofSubtrees(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte, numLeaves int) (bool, map[SubtreeSpan][]byte, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd || proofEnd > numLeaves {
+		panic("VerifyRangeProofSubtrees: illegal proof range")
+	}
+	ok, transcript, err := VerifyRangeProofTranscript(lh, h, proofStart, proofEnd, proof, root)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+
+	// replay the transcript, joining subtrees of equal size as a Tree does
+	roots := make(map[SubtreeSpan][]byte)
+	var stack []SubtreeSpan
+	pos := 0
+	add := func(span SubtreeSpan, sum []byte) {
+		stack = append(stack, span)
+		if span.Offset+span.Size <= numLeaves {
+			roots[span] = sum
+		}
+	}
+	for _, step := range transcript.Steps {
+		add(SubtreeSpan{Offset: pos, Size: 1 << uint(step.Height)}, step.Hash)
+		pos += 1 << uint(step.Height)
+		for len(stack) >= 2 && stack[len(stack)-2].Size == stack[len(stack)-1].Size {
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			// the joined subtree is only perfect if both halves are
+			var sum []byte
+			if left.Offset+2*left.Size <= numLeaves {
+				sum = nodeSum(h, roots[left], roots[right])
+			}
+			add(SubtreeSpan{Offset: left.Offset, Size: 2 * left.Size}, sum)
+		}
+	}
+	return true, roots, nil
+}
+
+// A VerifyReason describes the outcome of VerifyRangeProofDetailed.
+type VerifyReason int
+
+const (
+	// Verified indicates that the proof is valid.
+	Verified VerifyReason = iota
+	// RootMismatch indicates that the proof is well-formed, but does not
+	// produce the expected root. This may simply mean that the prover's data
+	// differs from the verifier's.
+	RootMismatch
+	// MalformedProof indicates that the proof could not have been produced
+	// by BuildRangeProof for the specified range, e.g. because it contains
+	// a hash of the wrong length or too few hashes.
+	MalformedProof
+	// LeafCountMismatch indicates that the LeafHasher produced more or fewer
+	// leaf hashes than the proof range contains.
+	LeafCountMismatch
+)
+
+// String implements fmt.Stringer.
+func (r VerifyReason) String() string {
+	switch r {
+	case Verified:
+		return "verified"
+	case RootMismatch:
+		return "root mismatch"
+	case MalformedProof:
+		return "malformed proof"
+	case LeafCountMismatch:
+		return "leaf count mismatch"
+	default:
+		return "unknown reason"
+	}
+}
+
+// A VerifyRangeProofResult is the result of VerifyRangeProofDetailed.
+type VerifyRangeProofResult struct {
+	OK     bool
+	Reason VerifyReason
+}
+
+// tallyLeafHasher wraps a LeafHasher, counting the leaf hashes it produces
+// and recording any error other than io.EOF.
+type tallyLeafHasher struct {
+	lh  LeafHasher
+	n   int
+	err error
+}
+
+// NextLeafHash implements LeafHasher.
+func (tlh *tallyLeafHasher) NextLeafHash() ([]byte, error) {
+	leafHash, err := tlh.lh.NextLeafHash()
+	if err == nil {
+		tlh.n++
+	} else if err != io.EOF {
+		tlh.err = err
+	}
+	return leafHash, err
+}
+
+// VerifyRangeProofDetailed is like VerifyRangeProof, but reports why
+// verification failed. Structural problems with the proof or the leaf hashes
+// are reported via the Reason field of the result rather than as errors,
+// allowing callers to distinguish a malformed (possibly adversarial) proof
+// from an honest root mismatch. An error is returned only if lh returns an
+// error, or if lh is a SubtreeRootLeafHasher and the proof range does not
+// form a single aligned subtree.
+func VerifyRangeProofDetailed(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (VerifyRangeProofResult, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofDetailed: illegal proof range")
+	}
+	fail := func(reason VerifyReason) (VerifyRangeProofResult, error) {
+		return VerifyRangeProofResult{Reason: reason}, nil
+	}
+	if checkHashLengths(proof, h) != nil || checkProofLength(proofStart, proofEnd, proof) != nil {
+		return fail(MalformedProof)
+	}
+	// a SubtreeRootLeafHasher supplies a single root in place of the leaf
+	// hashes, so the leaves cannot be counted
+	var tlh *tallyLeafHasher
+	if _, ok := lh.(*SubtreeRootLeafHasher); ok {
+		if _, aligned := alignedSubtreeHeight(proofStart, proofEnd); !aligned {
+			return VerifyRangeProofResult{}, errors.New("SubtreeRootLeafHasher requires a range that forms a single aligned subtree")
+		}
+	} else {
+		tlh = &tallyLeafHasher{lh: lh}
+		lh = tlh
+	}
+	proofRoot, err := rangeProofRoot(lh, h, proofStart, proofEnd, proof)
+	if tlh != nil {
+		if tlh.err != nil {
+			return VerifyRangeProofResult{}, tlh.err
+		} else if tlh.n != proofEnd-proofStart {
+			return fail(LeafCountMismatch)
+		}
+	}
+	if err != nil {
+		if tlh == nil {
+			return VerifyRangeProofResult{}, err
+		}
+		return fail(MalformedProof)
+	} else if !bytes.Equal(proofRoot, root) {
+		return fail(RootMismatch)
+	}
+	return VerifyRangeProofResult{OK: true, Reason: Verified}, nil
+}
+
+// A Root is a Merkle root.
+type Root []byte
+
+// Valid reports whether r has the correct length for roots produced by h.
+func (r Root) Valid(h hash.Hash) bool {
+	return len(r) == h.Size()
+}
+
+// A LeafHash is the hash of a single leaf, as computed by leafSum or
+// LengthPrefixedLeafHash. Leaf hashes and node hashes are both represented
+// as []byte elsewhere in this package; the distinct types allow the compiler
+// to catch code that, e.g., supplies a leaf hash where a proof hash is
+// expected. The LeafHasher and SubtreeHasher interfaces still use []byte, so
+// that existing implementations continue to satisfy them; the typed
+// functions below are adapters around their []byte counterparts.
+type LeafHash []byte
+
+// A NodeHash is the root of a subtree, such as a proof hash.
+type NodeHash []byte
+
+// leafHashBytes converts leafHashes to [][]byte. The underlying hashes are
+// not copied.
+func leafHashBytes(leafHashes []LeafHash) [][]byte {
+	b := make([][]byte, len(leafHashes))
+	for i := range leafHashes {
+		b[i] = leafHashes[i]
+	}
+	return b
+}
+
+// nodeHashBytes converts nodeHashes to [][]byte. The underlying hashes are
+// not copied.
+func nodeHashBytes(nodeHashes []NodeHash) [][]byte {
+	b := make([][]byte, len(nodeHashes))
+	for i := range nodeHashes {
+		b[i] = nodeHashes[i]
+	}
+	return b
+}
+
+// NewCachedSubtreeHasherTyped is like NewCachedSubtreeHasher, but takes typed
+// leaf hashes.
+func NewCachedSubtreeHasherTyped(leafHashes []LeafHash, h hash.Hash) *CachedSubtreeHasher {
+	return NewCachedSubtreeHasher(leafHashBytes(leafHashes), h)
+}
+
+// NewCachedLeafHasherTyped is like NewCachedLeafHasher, but takes typed leaf
+// hashes.
+func NewCachedLeafHasherTyped(leafHashes []LeafHash) *CachedLeafHasher {
+	return NewCachedLeafHasher(leafHashBytes(leafHashes))
+}
+
+// BuildRangeProofTyped is like BuildRangeProof, but returns the proof as
+// typed node hashes.
+func BuildRangeProofTyped(proofStart, proofEnd int, sh SubtreeHasher) ([]NodeHash, error) {
+	proof, err := BuildRangeProof(proofStart, proofEnd, sh)
+	if err != nil {
+		return nil, err
+	}
+	typed := make([]NodeHash, len(proof))
+	for i := range proof {
+		typed[i] = proof[i]
+	}
+	return typed, nil
+}
+
+// VerifyRangeProofTyped is like VerifyRangeProof, but returns
+// ErrBadRootLength if root is not a valid root for h, rather than silently
+// failing verification.
+func VerifyRangeProofTyped(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root Root) (bool, error) {
+	if !root.Valid(h) {
+		return false, ErrBadRootLength
+	}
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// VerifyRangeProofNodeHashes is like VerifyRangeProofTyped, but takes the
+// proof as typed node hashes, as returned by BuildRangeProofTyped.
+func VerifyRangeProofNodeHashes(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof []NodeHash, root Root) (bool, error) {
+	return VerifyRangeProofTyped(lh, h, proofStart, proofEnd, nodeHashBytes(proof), root)
+}
+
+// VerifyRangeProofHex is like VerifyRangeProofTyped, but takes the root as a
+// hex string. An error is returned if rootHex is not valid hex, or if it does
+// not decode to a root of the correct length.
+func VerifyRangeProofHex(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, rootHex string) (bool, error) {
+	root, err := hex.DecodeString(rootHex)
+	if err != nil {
+		return false, fmt.Errorf("invalid root: %v", err)
+	}
+	if !Root(root).Valid(h) {
+		return false, ErrBadRootLength
+	}
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// VerifyRangeProofSplit is like VerifyRangeProof, but takes the proof as two
+// halves: leftProof, the hashes covering the leaves [0, proofStart), and
+// rightProof, the hashes covering the leaves after proofEnd. A proof built by
+// BuildRangeProof is split at index bits.OnesCount(uint(proofStart)), since
+// there is one left-side hash for each 1 bit in proofStart; leftProof must
+// contain exactly that many hashes.
+func VerifyRangeProofSplit(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, leftProof, rightProof [][]byte, root []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofSplit: illegal proof range")
+	}
+	if len(leftProof) != rangeProofSizeLeft(proofStart) {
+		return false, errors.New("wrong number of left-side proof hashes")
+	}
+	proof := make([][]byte, 0, len(leftProof)+len(rightProof))
+	proof = append(proof, leftProof...)
+	proof = append(proof, rightProof...)
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// VerifyRangeProofSalted is like VerifyRangeProof, but verifies the proof
+// against a salted commitment to the Merkle root, H(root || salt), rather
+// than the root itself. The hash is a plain hash of the concatenation,
+// without a leaf or node prefix. The commitment is compared in constant time.
+func VerifyRangeProofSalted(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, saltedRoot, salt []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofSalted: illegal proof range")
+	}
+	proofRoot, err := rangeProofRoot(lh, h, proofStart, proofEnd, proof)
+	if err == ErrBadProofLength {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(sum(h, proofRoot, salt), saltedRoot) == 1, nil
+}
+
+// VerifyRangeProofCommitted is like VerifyRangeProof, but for verifiers that
+// hold only a commitment to the Merkle root, H(root), while the root itself
+// is revealed alongside the proof. It first checks that H(root) equals
+// rootCommitment, in constant time, and then verifies the proof against the
+// revealed root. If the commitment does not match, no leaf hashes are
+// consumed from lh.
+func VerifyRangeProofCommitted(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root, rootCommitment []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofCommitted: illegal proof range")
+	}
+	if subtle.ConstantTimeCompare(sum(h, root), rootCommitment) != 1 {
+		return false, nil
+	}
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// VerifyRangeProofReaderAt is like VerifyRangeProof, but reads the leaves
+// [proofStart, proofEnd) directly from their offsets in r, split into leaves
+// of leafSize bytes. The final leaf may be shorter than leafSize if r ends
+// within it; if r ends before the final leaf begins, an error wrapping
+// io.ErrUnexpectedEOF is returned.
+func VerifyRangeProofReaderAt(r io.ReaderAt, leafSize int, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofReaderAt: illegal proof range")
+	}
+	// check that the final leaf is present before reading the range
+	var probe [1]byte
+	if n, err := r.ReadAt(probe[:], int64(proofEnd-1)*int64(leafSize)); n == 0 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, fmt.Errorf("ReaderAt ends before leaf %v: %w", proofEnd-1, err)
+	}
+	lh := NewFileRangeLeafHasher(r, h, leafSize, proofStart, proofEnd)
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// VerifyRangeProofFetch is like VerifyRangeProof, but obtains the leaves
+// [proofStart, proofEnd) lazily from fetchLeaf, which is called once for each
+// index, in order, as the verifier consumes the leaves. If fetchLeaf returns
+// an error, verification stops and the error is returned.
+func VerifyRangeProofFetch(fetchLeaf func(index int) ([]byte, error), h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofFetch: illegal proof range")
+	}
+	lh := NewFetchLeafHasher(fetchLeaf, h, proofStart, proofEnd)
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// VerifyRangeProofFlat is like VerifyRangeProof, but takes the leaf hashes
+// within the proof range as a single contiguous buffer of (proofEnd -
+// proofStart) * h.Size() bytes, avoiding the overhead of a slice per leaf.
+func VerifyRangeProofFlat(leafHashesFlat []byte, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofFlat: illegal proof range")
+	}
+	if len(leafHashesFlat) != (proofEnd-proofStart)*h.Size() {
+		return false, errors.New("flat leaf hash buffer has wrong length")
+	}
+	lh := &flatLeafHasher{leafHashes: leafHashesFlat, size: h.Size()}
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// flatLeafHasher implements the LeafHasher interface by returning successive
+// leaf hashes of size bytes from a contiguous buffer.
+type flatLeafHasher struct {
+	leafHashes []byte
+	size       int
+}
+
+// NextLeafHash implements LeafHasher.
+func (flh *flatLeafHasher) NextLeafHash() ([]byte, error) {
+	if len(flh.leafHashes) == 0 {
 		return nil, io.EOF
 	}
-	h := clh.leafHashes[0]
-	clh.leafHashes = clh.leafHashes[1:]
+	h := flh.leafHashes[:flh.size:flh.size]
+	flh.leafHashes = flh.leafHashes[flh.size:]
 	return h, nil
 }
 
-// NewCachedLeafHasher creates a CachedLeafHasher from a set of precomputed
-// leaf hashes.
-func NewCachedLeafHasher(leafHashes [][]byte) *CachedLeafHasher {
-	return &CachedLeafHasher{
-		leafHashes: leafHashes,
+// VerifyRangeProofWithDigest is like VerifyRangeProof, but reads the leaf
+// data within the proof range from r, split into leaves of leafSize bytes,
+// and additionally writes the raw leaf data to digest as it is read. It
+// returns the sum of digest, i.e. a plain (non-Merkle) hash of the
+// concatenated leaves, which can be used for a separate integrity check.
+// digest is reset before use.
+func VerifyRangeProofWithDigest(r io.Reader, leafSize int, h, digest hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (ok bool, sum []byte, err error) {
+	digest.Reset()
+	lh := NewReaderLeafHasher(io.TeeReader(r, digest), h, leafSize)
+	ok, err = VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+	if err != nil {
+		return false, nil, err
 	}
+	return ok, digest.Sum(nil), nil
 }
 
-// VerifyRangeProof verifies a proof produced by BuildRangeProof using leaf
-// hashes produced by lh, which must contain only the leaf hashes within the
-// proof range.
-func VerifyRangeProof(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+// budgetLeafHasher wraps a LeafHasher, returning ErrBudgetExceeded instead of
+// requesting more than remaining leaf hashes from it. If the proof range is
+// exactly as large as the budget, io.EOF is returned instead, since the
+// verifier would otherwise need to read past the budget just to observe the
+// end of the stream.
+type budgetLeafHasher struct {
+	lh        LeafHasher
+	remaining int
+	exact     bool
+}
+
+// NextLeafHash implements LeafHasher.
+func (blh *budgetLeafHasher) NextLeafHash() ([]byte, error) {
+	if blh.remaining == 0 {
+		if blh.exact {
+			return nil, io.EOF
+		}
+		return nil, ErrBudgetExceeded
+	}
+	leafHash, err := blh.lh.NextLeafHash()
+	if err != nil {
+		return nil, err
+	}
+	blh.remaining--
+	return leafHash, nil
+}
+
+// VerifyRangeProofN is like VerifyRangeProof, but consumes at most maxLeaves
+// leaf hashes from lh, returning ErrBudgetExceeded if the proof range or lh
+// exceeds the budget. This protects verifiers whose LeafHasher is controlled
+// by an untrusted party. If maxLeaves is 0, no budget is enforced.
+func VerifyRangeProofN(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte, maxLeaves int) (bool, error) {
 	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
-		panic("VerifyRangeProof: illegal proof range")
+		panic("VerifyRangeProofN: illegal proof range")
+	} else if maxLeaves < 0 {
+		panic("VerifyRangeProofN: negative leaf budget")
+	}
+	if maxLeaves > 0 {
+		if proofEnd-proofStart > maxLeaves {
+			return false, ErrBudgetExceeded
+		}
+		// a SubtreeRootLeafHasher produces a single hash regardless of the
+		// size of the range, so it cannot exceed the budget
+		if _, ok := lh.(*SubtreeRootLeafHasher); !ok {
+			lh = &budgetLeafHasher{
+				lh:        lh,
+				remaining: maxLeaves,
+				exact:     proofEnd-proofStart == maxLeaves,
+			}
+		}
+	}
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// rangeProofRoot computes the Merkle root implied by a range proof and the
+// leaf hashes produced by lh.
+func rangeProofRoot(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte) ([]byte, error) {
+	return recordRangeProofRoot(lh, h, proofStart, proofEnd, proof, nil)
+}
+
+// recordRangeProofRoot is like rangeProofRoot, but if record is non-nil, it
+// is called with the height and hash of each subtree pushed onto the tree, in
+// order.
+func recordRangeProofRoot(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, record func(height int, sum []byte)) ([]byte, error) {
+	if err := checkHashLengths(proof, h); err != nil {
+		return nil, err
+	}
+	return foldRangeProof(lh, h, proofStart, proofEnd, proof, record)
+}
+
+// foldRangeProof is like recordRangeProofRoot, but does not check the length
+// of each proof hash.
+func foldRangeProof(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, record func(height int, sum []byte)) ([]byte, error) {
+	// check the structure of the proof before consuming any leaf hashes, so
+	// that malformed proofs are rejected without reading the (possibly
+	// large) proof range
+	if err := checkProofLength(proofStart, proofEnd, proof); err != nil {
+		return nil, err
 	}
 
-	// manually build a tree using the proof hashes
+	// manually build a tree using the proof hashes. PushSubTree joins
+	// subtrees of equal height as soon as they are pushed, so the tree never
+	// holds more than one pending subtree root per height, regardless of the
+	// size of the proof range.
 	tree := New(h)
+	push := func(height int, sum []byte) error {
+		if err := tree.PushSubTree(height, sum); err != nil {
+			return err
+		}
+		if record != nil {
+			record(height, sum)
+		}
+		return nil
+	}
 
 	// add proof hashes up to proofStart
-	for i := 63; i >= 0 && len(proof) > 0; i-- {
+	for i := maxSubtreeHeight; i >= 0 && len(proof) > 0; i-- {
 		subtreeSize := 1 << uint64(i)
 		if proofStart&subtreeSize != 0 {
-			if err := tree.PushSubTree(i, proof[0]); err != nil {
+			if err := push(i, proof[0]); err != nil {
 				// PushSubTree only returns an error if i is greater than the
 				// current smallest subtree. Since the loop proceeds in
 				// descending order, this should never happen.
@@ -310,28 +2278,195 @@ func VerifyRangeProof(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proo
 		}
 	}
 
+	// add leaf hashes, or the root of the range if it was supplied directly
+	if srlh, ok := lh.(*SubtreeRootLeafHasher); ok {
+		height, ok := alignedSubtreeHeight(proofStart, proofEnd)
+		if !ok {
+			return nil, errors.New("SubtreeRootLeafHasher requires a range that forms a single aligned subtree")
+		}
+		root, err := srlh.NextLeafHash()
+		if err != nil {
+			return nil, err
+		}
+		if err := push(height, root); err != nil {
+			panic(err)
+		}
+	} else {
+		numLeaves := 0
+		for ; ; numLeaves++ {
+			leafHash, err := lh.NextLeafHash()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if err := push(0, leafHash); err != nil {
+				panic(err)
+			}
+		}
+		if numLeaves == 0 {
+			return nil, ErrNoLeafHashes
+		}
+	}
+
+	// add proof hashes after proofEnd
+	endMask := proofEnd - 1
+	for i := 0; i <= maxSubtreeHeight && len(proof) > 0; i++ {
+		subtreeSize := 1 << uint64(i)
+		if endMask&subtreeSize == 0 {
+			if err := push(i, proof[0]); err != nil {
+				// This *probably* should never happen, but just to guard
+				// against adversarial inputs, return an error instead of
+				// panicking.
+				return nil, err
+			}
+			proof = proof[1:]
+		}
+	}
+
+	return tree.Root(), nil
+}
+
+// alignedSubtreeHeight reports whether the leaf range [start, end) forms a
+// single aligned subtree, i.e. whether end-start is a power of two and start
+// is a multiple of end-start. If so, it also returns the height of that
+// subtree.
+func alignedSubtreeHeight(start, end int) (int, bool) {
+	n := end - start
+	if n <= 0 || n&(n-1) != 0 || start%n != 0 {
+		return 0, false
+	}
+	return bits.TrailingZeros64(uint64(n)), true
+}
+
+// VerifyRangeProofH is a convenience wrapper around VerifyRangeProof that
+// uses h for both leaf and node hashing. If leafHashes is non-nil, it is used
+// as the set of precomputed leaf hashes within the proof range. Otherwise,
+// leafData is split into leaves of leafSize bytes, each of which is hashed
+// with h. Leaf and node hashing must always use the same hash algorithm.
+func VerifyRangeProofH(h hash.Hash, leafData []byte, leafSize int, leafHashes [][]byte, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	var lh LeafHasher
+	if leafHashes != nil {
+		lh = NewCachedLeafHasher(leafHashes)
+	} else {
+		lh = NewReaderLeafHasher(bytes.NewReader(leafData), h, leafSize)
+	}
+	return VerifyRangeProof(lh, h, proofStart, proofEnd, proof, root)
+}
+
+// VerifyRangeProofFromLeft is like VerifyRangeProof, but allows the verifier
+// to supply trusted subtree roots for the leaves [0, leftLeaves) instead of
+// reading them from the proof. leftRoots must contain one root for each 1 bit
+// in leftLeaves, ordered from largest to smallest subtree, and leftLeaves must
+// equal proofStart. If leftRoots is nil, the left-side hashes are read from
+// the proof as usual.
+//
+// If the proof is valid, VerifyRangeProofFromLeft also returns the subtree
+// roots covering [0, proofEnd), which can be passed as leftRoots when
+// verifying a subsequent range beginning at proofEnd. In this way, a sequence
+// of consecutive ranges can be verified using proofs built by
+// BuildRangeProofOmitLeft.
+func VerifyRangeProofFromLeft(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proof [][]byte, root []byte, leftRoots [][]byte, leftLeaves int) (ok bool, nextLeftRoots [][]byte, err error) {
+	if proofStart < 0 || proofStart > proofEnd || proofStart == proofEnd {
+		panic("VerifyRangeProofFromLeft: illegal proof range")
+	}
+	if err := checkHashLengths(proof, h); err != nil {
+		return false, nil, err
+	} else if err := checkHashLengths(leftRoots, h); err != nil {
+		return false, nil, err
+	}
+
+	tree := New(h)
+
+	// add trusted left roots or proof hashes up to proofStart
+	left := proof
+	if leftRoots != nil {
+		if leftLeaves != proofStart {
+			return false, nil, errors.New("left roots must cover exactly [0, proofStart)")
+		} else if len(leftRoots) != bits.OnesCount64(uint64(leftLeaves)) {
+			return false, nil, errors.New("wrong number of left roots")
+		}
+		left = leftRoots
+	}
+	for i := maxSubtreeHeight; i >= 0 && len(left) > 0; i-- {
+		subtreeSize := 1 << uint64(i)
+		if proofStart&subtreeSize != 0 {
+			if err := tree.PushSubTree(i, left[0]); err != nil {
+				panic(err)
+			}
+			left = left[1:]
+		}
+	}
+	if leftRoots == nil {
+		proof = left
+	}
+
 	// add leaf hashes
 	for {
 		leafHash, err := lh.NextLeafHash()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return false, err
+			return false, nil, err
 		}
 		if err := tree.PushSubTree(0, leafHash); err != nil {
 			panic(err)
 		}
 	}
+	nextLeftRoots = tree.subtreeRoots()
 
 	// add proof hashes after proofEnd
 	endMask := proofEnd - 1
-	for i := 0; i < 64 && len(proof) > 0; i++ {
+	for i := 0; i <= maxSubtreeHeight && len(proof) > 0; i++ {
 		subtreeSize := 1 << uint64(i)
 		if endMask&subtreeSize == 0 {
 			if err := tree.PushSubTree(i, proof[0]); err != nil {
-				// This *probably* should never happen, but just to guard
-				// against adversarial inputs, return an error instead of
-				// panicking.
+				return false, nil, err
+			}
+			proof = proof[1:]
+		}
+	}
+
+	if !bytes.Equal(tree.Root(), root) {
+		return false, nil, nil
+	}
+	return true, nextLeftRoots, nil
+}
+
+// VerifyPrefixProof verifies a proof produced by BuildPrefixProof for the leaf
+// range [0, prefixLeaves). prefixRoots must contain the roots of the perfect
+// subtrees covering the prefix, one for each 1 bit in prefixLeaves, ordered
+// from largest to smallest subtree. If prefixLeaves is a power of two,
+// prefixRoots is simply the Merkle root of the prefix.
+func VerifyPrefixProof(h hash.Hash, prefixLeaves int, prefixRoots [][]byte, proof [][]byte, root []byte) (bool, error) {
+	if prefixLeaves <= 0 {
+		panic("VerifyPrefixProof: illegal prefix length")
+	}
+	if err := checkHashLengths(proof, h); err != nil {
+		return false, err
+	} else if err := checkHashLengths(prefixRoots, h); err != nil {
+		return false, err
+	} else if len(prefixRoots) != bits.OnesCount64(uint64(prefixLeaves)) {
+		return false, errors.New("wrong number of prefix roots")
+	}
+
+	tree := New(h)
+
+	// add prefix roots
+	for i := maxSubtreeHeight; i >= 0; i-- {
+		if prefixLeaves&(1<<uint64(i)) != 0 {
+			if err := tree.PushSubTree(i, prefixRoots[0]); err != nil {
+				panic(err)
+			}
+			prefixRoots = prefixRoots[1:]
+		}
+	}
+
+	// add proof hashes after the prefix
+	endMask := prefixLeaves - 1
+	for i := 0; i <= maxSubtreeHeight && len(proof) > 0; i++ {
+		if endMask&(1<<uint64(i)) == 0 {
+			if err := tree.PushSubTree(i, proof[0]); err != nil {
 				return false, err
 			}
 			proof = proof[1:]
@@ -340,3 +2475,439 @@ func VerifyRangeProof(lh LeafHasher, h hash.Hash, proofStart, proofEnd int, proo
 
 	return bytes.Equal(tree.Root(), root), nil
 }
+
+// A RangeProof bundles a range proof with the parameters needed to verify it.
+type RangeProof struct {
+	// Start and End denote the leaf range [Start, End) covered by the proof.
+	Start int
+	End   int
+	// LeafSize is the size, in bytes, of the leaves of the tree the proof was
+	// built from.
+	LeafSize int
+	// Hashes are the proof hashes, as returned by BuildRangeProof.
+	Hashes [][]byte
+}
+
+// VerifyRangeProofStruct verifies proof using the leaf data read from r,
+// which is split into leaves of leafSize bytes. If leafSize does not match
+// the leaf size recorded in the proof, ErrLeafSizeMismatch is returned.
+func VerifyRangeProofStruct(r io.Reader, leafSize int, h hash.Hash, proof RangeProof, root []byte) (bool, error) {
+	if leafSize != proof.LeafSize {
+		return false, ErrLeafSizeMismatch
+	}
+	return VerifyRangeProof(NewReaderLeafHasher(r, h, leafSize), h, proof.Start, proof.End, proof.Hashes, root)
+}
+
+// BuildComplementProof constructs a proof for every leaf in the tree except
+// the leaf at excludeIndex. The proof consists of a single hash: the hash of
+// the excluded leaf. This is the minimal proof for the complement of a single
+// leaf.
+func BuildComplementProof(excludeIndex, numLeaves int, sh SubtreeHasher) (proof [][]byte, err error) {
+	if excludeIndex < 0 || excludeIndex >= numLeaves {
+		panic("BuildComplementProof: illegal exclude index")
+	}
+	if err := sh.Skip(excludeIndex); err != nil {
+		return nil, err
+	}
+	leafHash, err := sh.NextSubtreeRoot(1)
+	if IsEndOfTree(err) {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return [][]byte{leafHash}, nil
+}
+
+// VerifyComplementProof verifies a proof produced by BuildComplementProof.
+// lh must produce the hashes of every leaf in the tree except the leaf at
+// excludeIndex, in order.
+func VerifyComplementProof(lh LeafHasher, h hash.Hash, excludeIndex, numLeaves int, proof [][]byte, root []byte) (bool, error) {
+	if excludeIndex < 0 || excludeIndex >= numLeaves {
+		panic("VerifyComplementProof: illegal exclude index")
+	}
+	if len(proof) != 1 {
+		return false, errors.New("complement proof must contain exactly one hash")
+	} else if err := checkHashLengths(proof, h); err != nil {
+		return false, err
+	}
+	tree := New(h)
+	for i := 0; i < numLeaves; i++ {
+		leafHash := proof[0]
+		if i != excludeIndex {
+			var err error
+			leafHash, err = lh.NextLeafHash()
+			if err == io.EOF {
+				return false, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return false, err
+			}
+		}
+		if err := tree.PushSubTree(0, leafHash); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := lh.NextLeafHash(); err != io.EOF {
+		return false, errors.New("too many leaf hashes supplied")
+	}
+	return bytes.Equal(tree.Root(), root), nil
+}
+
+// PaddedSubtreeHasher wraps a SubtreeHasher, padding its leaves with
+// zero-filled leaves up to a fixed number of leaves. If the padded leaf count
+// is a power of two, 1<<H, every proof for a single leaf contains exactly H
+// hashes, regardless of how many leaves contain data. Proofs built with a
+// PaddedSubtreeHasher can be verified with VerifyPaddedRangeProof.
+type PaddedSubtreeHasher struct {
+	sh           SubtreeHasher
+	h            hash.Hash
+	dataLeaves   int
+	paddedLeaves int
+	zeroRoot     func(n int) []byte
+
+	// pos is the index of the next leaf.
+	pos int
+}
+
+// NextSubtreeRoot implements SubtreeHasher.
+func (psh *PaddedSubtreeHasher) NextSubtreeRoot(n int) ([]byte, error) {
+	if n <= 0 {
+		return nil, ErrHasherMisuse
+	} else if psh.pos >= psh.paddedLeaves {
+		return nil, io.EOF
+	}
+	if n > psh.paddedLeaves-psh.pos {
+		n = psh.paddedLeaves - psh.pos
+	}
+	numData := psh.dataLeaves - psh.pos
+	if numData < 0 {
+		numData = 0
+	} else if numData > n {
+		numData = n
+	}
+	psh.pos += n
+
+	// if the subtree is entirely data, or entirely padding, it can be
+	// computed directly
+	if numData == 0 {
+		return psh.zeroRoot(n), nil
+	} else if numData == n {
+		root, err := psh.sh.NextSubtreeRoot(n)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return root, err
+	}
+
+	// otherwise, join the data subtrees with the padding subtrees
+	tree := New(psh.h)
+	for _, span := range CoveringSubtrees(0, numData) {
+		root, err := psh.sh.NextSubtreeRoot(span.Size)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		if err := tree.PushSubTree(bits.TrailingZeros64(uint64(span.Size)), root); err != nil {
+			panic(err) // should never happen
+		}
+	}
+	for _, span := range CoveringSubtrees(numData, n) {
+		if err := tree.PushSubTree(bits.TrailingZeros64(uint64(span.Size)), psh.zeroRoot(span.Size)); err != nil {
+			panic(err) // should never happen
+		}
+	}
+	return tree.Root(), nil
+}
+
+// Skip implements SubtreeHasher.
+func (psh *PaddedSubtreeHasher) Skip(n int) error {
+	if n < 0 {
+		return ErrHasherMisuse
+	} else if n > psh.paddedLeaves-psh.pos {
+		return io.ErrUnexpectedEOF
+	}
+	numData := psh.dataLeaves - psh.pos
+	if numData < 0 {
+		numData = 0
+	} else if numData > n {
+		numData = n
+	}
+	psh.pos += n
+	return psh.sh.Skip(numData)
+}
+
+// NewPaddedSubtreeHasher returns a PaddedSubtreeHasher that reads the first
+// dataLeaves leaves from sh, followed by zero-filled leaves of leafSize bytes
+// up to a total of paddedLeaves leaves. sh must contain exactly dataLeaves
+// leaves; since a SubtreeHasher does not report how many leaves a subtree
+// contained, a shortfall is only detected if it affects a subtree that
+// straddles the end of the data.
+func NewPaddedSubtreeHasher(sh SubtreeHasher, h hash.Hash, leafSize, dataLeaves, paddedLeaves int) *PaddedSubtreeHasher {
+	if dataLeaves < 0 || dataLeaves > paddedLeaves {
+		panic("NewPaddedSubtreeHasher: illegal leaf counts")
+	}
+	return &PaddedSubtreeHasher{
+		sh:           sh,
+		h:            h,
+		dataLeaves:   dataLeaves,
+		paddedLeaves: paddedLeaves,
+		zeroRoot:     zeroSubtreeRoots(h, leafSize),
+	}
+}
+
+// paddedLeafHasher wraps a LeafHasher, yielding the hash of a zero-filled
+// leaf in place of each padding leaf once the underlying leaves run out.
+type paddedLeafHasher struct {
+	lh          LeafHasher
+	dataLeaves  int // number of leaves remaining in lh
+	padLeaves   int // number of padding leaves remaining
+	zeroLeafSum []byte
+}
+
+// NextLeafHash implements LeafHasher.
+func (plh *paddedLeafHasher) NextLeafHash() ([]byte, error) {
+	if plh.dataLeaves > 0 {
+		plh.dataLeaves--
+		leafHash, err := plh.lh.NextLeafHash()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return leafHash, err
+	} else if plh.padLeaves > 0 {
+		plh.padLeaves--
+		return plh.zeroLeafSum, nil
+	}
+	return nil, io.EOF
+}
+
+// VerifyPaddedRangeProof verifies a proof for a tree whose data occupies the
+// first dataLeaves leaves, and which has been padded with zero-filled leaves
+// of leafSize bytes up to paddedLeaves leaves. lh must produce only the leaf
+// hashes of the data leaves within the proof range; the hashes of any padding
+// leaves within the range are supplied automatically.
+func VerifyPaddedRangeProof(lh LeafHasher, h hash.Hash, leafSize, dataLeaves, paddedLeaves, proofStart, proofEnd int, proof [][]byte, root []byte) (bool, error) {
+	if dataLeaves > paddedLeaves || proofEnd > paddedLeaves {
+		panic("VerifyPaddedRangeProof: illegal proof range")
+	}
+	dataEnd := proofEnd
+	if dataEnd > dataLeaves {
+		dataEnd = dataLeaves
+	}
+	numData := dataEnd - proofStart
+	if numData < 0 {
+		numData = 0
+	}
+	plh := &paddedLeafHasher{
+		lh:          lh,
+		dataLeaves:  numData,
+		padLeaves:   proofEnd - proofStart - numData,
+		zeroLeafSum: leafSum(h, make([]byte, leafSize)),
+	}
+	return VerifyRangeProof(plh, h, proofStart, proofEnd, proof, root)
+}
+
+// ProofDigest returns a fixed-size commitment to a range proof, computed by
+// hashing a canonical serialization of proofStart, proofEnd, proof, and root
+// with h. It is not a Merkle operation, and the digest carries no meaning
+// beyond identifying the proof; it is useful, for example, for recording
+// proofs in an audit log and later detecting whether a replayed proof
+// differs. Each value is encoded as a little-endian uint64, and each hash is
+// prefixed with its length, so that distinct proofs cannot serialize to the
+// same bytes.
+func ProofDigest(proofStart, proofEnd int, proof [][]byte, root []byte, h hash.Hash) []byte {
+	var buf [8]byte
+	writeUint64 := func(n int) {
+		binary.LittleEndian.PutUint64(buf[:], uint64(n))
+		_, _ = h.Write(buf[:])
+	}
+	writeHash := func(b []byte) {
+		writeUint64(len(b))
+		_, _ = h.Write(b)
+	}
+
+	h.Reset()
+	writeUint64(proofStart)
+	writeUint64(proofEnd)
+	writeUint64(len(proof))
+	for _, p := range proof {
+		writeHash(p)
+	}
+	writeHash(root)
+	return h.Sum(nil)
+}
+
+// A ProofDiff describes a position at which two proofs differ.
+type ProofDiff struct {
+	// Index is the position of the differing hashes within the proofs.
+	Index int
+	// A and B are the hashes at Index in each proof, or nil if the proof is
+	// too short to contain Index.
+	A, B []byte
+	// MissingA and MissingB indicate that the corresponding proof is too
+	// short to contain Index, i.e. that the proofs differ in length.
+	MissingA, MissingB bool
+}
+
+// DiffProofs compares two proofs hash by hash, returning a ProofDiff for
+// each position at which they differ, in order. If one proof is longer than
+// the other, each of its excess hashes is reported as a difference, with
+// MissingA or MissingB set. If the proofs are identical, DiffProofs returns
+// nil.
+func DiffProofs(a, b [][]byte) []ProofDiff {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	var diffs []ProofDiff
+	for i := 0; i < n; i++ {
+		d := ProofDiff{Index: i}
+		if i < len(a) {
+			d.A = a[i]
+		} else {
+			d.MissingA = true
+		}
+		if i < len(b) {
+			d.B = b[i]
+		} else {
+			d.MissingB = true
+		}
+		if d.MissingA || d.MissingB || !bytes.Equal(d.A, d.B) {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// PackProof encodes proof as a single byte slice, e.g. for storage in a
+// database. The encoding is the number of hashes as a uvarint, followed (if
+// there are any hashes) by the size of each hash as a uvarint, followed by the
+// concatenated hashes. ErrBadHashLength is returned if the hashes in proof
+// are empty or do not all have the same length.
+func PackProof(proof [][]byte) ([]byte, error) {
+	var buf [binary.MaxVarintLen64]byte
+	data := append([]byte(nil), buf[:binary.PutUvarint(buf[:], uint64(len(proof)))]...)
+	if len(proof) == 0 {
+		return data, nil
+	}
+	hashSize := len(proof[0])
+	if hashSize == 0 {
+		return nil, ErrBadHashLength
+	}
+	data = append(data, buf[:binary.PutUvarint(buf[:], uint64(hashSize))]...)
+	for _, p := range proof {
+		if len(p) != hashSize {
+			return nil, ErrBadHashLength
+		}
+		data = append(data, p...)
+	}
+	return data, nil
+}
+
+// UnpackProof decodes a proof encoded by PackProof. It returns an error if
+// data is truncated, has trailing bytes, or is otherwise malformed. The
+// returned hashes alias data.
+func UnpackProof(data []byte) ([][]byte, error) {
+	numHashes, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("invalid proof hash count")
+	}
+	data = data[n:]
+	if numHashes == 0 {
+		if len(data) != 0 {
+			return nil, errors.New("packed proof has trailing data")
+		}
+		return nil, nil
+	}
+	hashSize, n := binary.Uvarint(data)
+	if n <= 0 || hashSize == 0 {
+		return nil, errors.New("invalid proof hash size")
+	}
+	data = data[n:]
+	if hashSize > uint64(len(data)) || numHashes != uint64(len(data))/hashSize || uint64(len(data))%hashSize != 0 {
+		return nil, errors.New("packed proof has wrong length")
+	}
+	proof := make([][]byte, numHashes)
+	for i := range proof {
+		proof[i] = data[:hashSize:hashSize]
+		data = data[hashSize:]
+	}
+	return proof, nil
+}
+
+// An InlineRangeProof is a self-contained range proof: it carries the data of
+// the leaves [Start, End) alongside the proof hashes, so that it can be
+// verified against a Merkle root without any other input. Each leaf is
+// LeafSize bytes, except that the final leaf may be shorter if it is the last
+// leaf in the tree.
+type InlineRangeProof struct {
+	Start    int
+	End      int
+	LeafSize int
+	Data     []byte
+	Proof    [][]byte
+}
+
+// Verify verifies the proof against root, hashing the inline leaf data with
+// h. It returns an error if the proof is malformed, e.g. if its range is
+// illegal or Data does not contain the right number of leaves.
+func (p InlineRangeProof) Verify(root []byte, h hash.Hash) (bool, error) {
+	if p.Start < 0 || p.Start >= p.End || p.LeafSize <= 0 {
+		return false, errors.New("inline proof has illegal range")
+	}
+	numLeaves := p.End - p.Start
+	if len(p.Data) <= (numLeaves-1)*p.LeafSize || len(p.Data) > numLeaves*p.LeafSize {
+		return false, errors.New("inline proof has wrong amount of leaf data")
+	}
+	lh := NewReaderLeafHasher(bytes.NewReader(p.Data), h, p.LeafSize)
+	return VerifyRangeProof(lh, h, p.Start, p.End, p.Proof, root)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding is Start,
+// End, LeafSize, and the length of Data, all as uvarints, followed by Data and
+// the proof hashes as encoded by PackProof.
+func (p InlineRangeProof) MarshalBinary() ([]byte, error) {
+	if p.Start < 0 || p.End < 0 || p.LeafSize < 0 {
+		return nil, errors.New("inline proof has illegal range")
+	}
+	packed, err := PackProof(p.Proof)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4*binary.MaxVarintLen64, 4*binary.MaxVarintLen64+len(p.Data))
+	n := binary.PutUvarint(buf, uint64(p.Start))
+	n += binary.PutUvarint(buf[n:], uint64(p.End))
+	n += binary.PutUvarint(buf[n:], uint64(p.LeafSize))
+	n += binary.PutUvarint(buf[n:], uint64(len(p.Data)))
+	buf = append(buf[:n], p.Data...)
+	return append(buf, packed...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (p *InlineRangeProof) UnmarshalBinary(b []byte) error {
+	var fields [4]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(b)
+		if n <= 0 || v > uint64(^uint(0)>>1) {
+			return errors.New("invalid inline proof")
+		}
+		fields[i], b = v, b[n:]
+	}
+	dataLen := fields[3]
+	if dataLen > uint64(len(b)) {
+		return errors.New("inline proof is truncated")
+	}
+	data, b := b[:dataLen], b[dataLen:]
+	proof, err := UnpackProof(b)
+	if err != nil {
+		return err
+	}
+	p.Start = int(fields[0])
+	p.End = int(fields[1])
+	p.LeafSize = int(fields[2])
+	p.Data = append([]byte(nil), data...)
+	p.Proof = make([][]byte, len(proof))
+	for i := range proof {
+		p.Proof[i] = append([]byte(nil), proof[i]...)
+	}
+	return nil
+}
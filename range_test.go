@@ -2,16 +2,54 @@ package merkletree
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
+	"math/bits"
+	"math/rand"
+	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/HyperspaceApp/fastrand"
 	"golang.org/x/crypto/blake2b"
 )
 
+// testDataRoot is the Merkle root of testData(1, 1<<22), with 64-byte leaves
+// and BLAKE2b-256.
+const testDataRoot = "51ec3a5168d53e5b4c576266a87aa59ea8e27efee403678ec5fb5fb22e6d680c"
+
+// testData returns size bytes of pseudo-random data, determined by seed.
+// Tests and benchmarks that use the same seed and size operate on the same
+// tree, allowing benchmarks to check their results against known roots such
+// as testDataRoot.
+func testData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// TestTestData tests that testData is deterministic, and that its root
+// matches testDataRoot.
+func TestTestData(t *testing.T) {
+	if !bytes.Equal(testData(1, 100), testData(1, 100)) {
+		t.Fatal("testData is not deterministic")
+	} else if bytes.Equal(testData(1, 100), testData(2, 100)) {
+		t.Fatal("testData ignores its seed")
+	}
+	blake, _ := blake2b.New256(nil)
+	if root := hex.EncodeToString(bytesRoot(testData(1, 1<<22), blake, 64)); root != testDataRoot {
+		t.Fatal("wrong root for test data:", root)
+	}
+}
+
 // bytesRoot is a helper function that calculates the Merkle root of b.
 func bytesRoot(b []byte, h hash.Hash, leafSize int) []byte {
 	root, err := ReaderRoot(bytes.NewReader(b), h, leafSize)
@@ -325,103 +363,3365 @@ func TestBuildProofRangeEOF(t *testing.T) {
 	}
 }
 
-// BenchmarkBuildRangeProof benchmarks the performance of BuildRangeProof for
-// various proof ranges.
-func BenchmarkBuildRangeProof(b *testing.B) {
+// TestFindAndProve tests the FindAndProve function.
+func TestFindAndProve(t *testing.T) {
 	blake, _ := blake2b.New256(nil)
-	leafData := fastrand.Bytes(1 << 22)
 	const leafSize = 64
-	numLeaves := len(leafData) / 64
+	const numLeaves = 64
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
 
-	benchRange := func(start, end int) func(*testing.B) {
-		return func(b *testing.B) {
-			b.ReportAllocs()
-			for i := 0; i < b.N; i++ {
-				_, _ = BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	// find a known leaf and verify the resulting proof
+	index, proof, err := FindAndProve(leafHashes[37], NewCachedSubtreeHasher(leafHashes, blake), numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	} else if index != 37 {
+		t.Fatal("FindAndProve returned wrong index:", index)
+	}
+	ok, err := VerifyRangeProof(NewCachedLeafHasher(leafHashes[37:38]), blake, 37, 38, proof, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("FindAndProve constructed an invalid proof")
+	}
+
+	// an unknown leaf hash should produce an error
+	if _, _, err := FindAndProve(make([]byte, blake.Size()), NewCachedSubtreeHasher(leafHashes, blake), numLeaves); err == nil {
+		t.Fatal("expected error when searching for unknown leaf hash")
+	}
+
+	// a leaf beyond numLeaves should not be found
+	if _, _, err := FindAndProve(leafHashes[63], NewCachedSubtreeHasher(leafHashes, blake), 32); err == nil {
+		t.Fatal("expected error when searching beyond numLeaves")
+	}
+
+	// a non-cached SubtreeHasher should produce an error
+	rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	if _, _, err := FindAndProve(leafHashes[0], rsh, numLeaves); err == nil {
+		t.Fatal("expected error when using a ReaderSubtreeHasher")
+	}
+}
+
+// TestVerifyRangeProofH tests the VerifyRangeProofH function.
+func TestVerifyRangeProofH(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 12
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
+
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// verify using raw leaf data
+			ok, err := VerifyRangeProofH(blake, leafData[start*leafSize:end*leafSize], leafSize, nil, start, end, proof, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Errorf("VerifyRangeProofH failed to verify range %v-%v using leaf data", start, end)
+			}
+			// verify using cached leaf hashes
+			ok, err = VerifyRangeProofH(blake, nil, leafSize, leafHashes[start:end], start, end, proof, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Errorf("VerifyRangeProofH failed to verify range %v-%v using leaf hashes", start, end)
 			}
 		}
 	}
+}
 
-	b.Run("single", benchRange(0, 1))
-	b.Run("half", benchRange(0, numLeaves/2))
-	b.Run("mid", benchRange(numLeaves/2, 1+numLeaves/2))
-	b.Run("full", benchRange(0, numLeaves-1))
+// TestVerifyRangeProofFromLeft tests that consecutive ranges can be verified
+// by reusing the left subtree roots accumulated from previous verifications.
+func TestVerifyRangeProofFromLeft(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 64
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+	}
+	root := bytesRoot(leafData, blake, leafSize)
+
+	// verify the first range normally
+	proof, err := BuildRangeProof(0, 10, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, leftRoots, err := VerifyRangeProofFromLeft(NewCachedLeafHasher(leafHashes[0:10]), blake, 0, 10, proof, root, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify first range")
+	} else if len(leftRoots) != 2 {
+		t.Fatal("expected 2 left roots, got", len(leftRoots))
+	}
+
+	// verify the second range using the accumulated left roots
+	fullProof, err := BuildRangeProof(10, 25, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err = BuildRangeProofOmitLeft(10, 25, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(proof) >= len(fullProof) {
+		t.Fatal("proof omitting left hashes should be smaller than full proof")
+	}
+	ok, leftRoots, err = VerifyRangeProofFromLeft(NewCachedLeafHasher(leafHashes[10:25]), blake, 10, 25, proof, root, leftRoots, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify second range using accumulated left roots")
+	}
+
+	// the accumulated roots should match the left-side hashes of a normal
+	// proof beginning at 25
+	fullProof, err = BuildRangeProof(25, 30, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(leftRoots, fullProof[:len(leftRoots)]) {
+		t.Fatal("accumulated left roots do not match proof hashes")
+	}
+
+	// corrupted left roots should fail to verify
+	proof, _ = BuildRangeProofOmitLeft(25, 30, NewCachedSubtreeHasher(leafHashes, blake))
+	leftRoots[0][0]++
+	ok, _, err = VerifyRangeProofFromLeft(NewCachedLeafHasher(leafHashes[25:30]), blake, 25, 30, proof, root, leftRoots, 25)
+	if err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("verified proof using corrupted left roots")
+	}
+
+	// mismatched leftLeaves or wrong number of roots should be rejected
+	if _, _, err := VerifyRangeProofFromLeft(NewCachedLeafHasher(leafHashes[25:30]), blake, 25, 30, proof, root, leftRoots, 24); err == nil {
+		t.Fatal("expected error for mismatched leftLeaves")
+	}
+	if _, _, err := VerifyRangeProofFromLeft(NewCachedLeafHasher(leafHashes[25:30]), blake, 25, 30, proof, root, leftRoots[1:], 25); err == nil {
+		t.Fatal("expected error for wrong number of left roots")
+	}
 }
 
-// BenchmarkBuildRangeProof benchmarks the performance of BuildRangeProof for
-// various proof ranges when a subset of the roots have been precalculated.
-func BenchmarkBuildRangeProofPrecalc(b *testing.B) {
+// TestVerifyRangeProofBadHashLength tests that VerifyRangeProof rejects
+// proofs containing hashes of the wrong length.
+func TestVerifyRangeProofBadHashLength(t *testing.T) {
 	blake, _ := blake2b.New256(nil)
-	leafData := fastrand.Bytes(1 << 22)
 	const leafSize = 64
-	numLeaves := len(leafData) / 64
+	const numLeaves = 12
+	leafData := fastrand.Bytes(leafSize * numLeaves)
 	root := bytesRoot(leafData, blake, leafSize)
 
-	verifyProof := func(start, end int, proof [][]byte) bool {
-		lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
-		ok, err := VerifyRangeProof(lh, blake, start, end, proof, root)
-		if err != nil {
-			b.Fatal(err)
+	proof, err := BuildRangeProof(3, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lh := NewReaderLeafHasher(bytes.NewReader(leafData[3*leafSize:5*leafSize]), blake, leafSize)
+	if ok, err := VerifyRangeProof(lh, blake, 3, 5, proof, root); err != nil || !ok {
+		t.Fatal("failed to verify valid proof:", err)
+	}
+
+	// truncate one of the proof hashes
+	proof[2] = proof[2][:blake.Size()-1]
+	lh = NewReaderLeafHasher(bytes.NewReader(leafData[3*leafSize:5*leafSize]), blake, leafSize)
+	if _, err := VerifyRangeProof(lh, blake, 3, 5, proof, root); err != ErrBadHashLength {
+		t.Fatal("expected ErrBadHashLength, got", err)
+	}
+}
+
+// TestSubtreeIndex tests that CachedSubtreeHashers created from a
+// SubtreeIndex produce the same proofs as ordinary CachedSubtreeHashers.
+func TestSubtreeIndex(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(leafSize * 33)
+	leafHashes := make([][]byte, 33)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+	}
+
+	for _, nLeaves := range []int{1, 2, 3, 7, 8, 12, 16, 33} {
+		si := NewSubtreeIndex(leafHashes[:nLeaves], blake)
+		for start := 0; start < nLeaves; start++ {
+			for end := start + 1; end <= nLeaves; end++ {
+				proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasherFromIndex(si))
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes[:nLeaves], blake))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(proof, expected) {
+					t.Errorf("indexed proof for nLeaves=%v, range %v-%v does not match", nLeaves, start, end)
+				}
+			}
 		}
-		return ok
 	}
 
-	// precalculate nodes to depth 4
-	precalcRoots := make([][]byte, 16)
-	precalcSize := numLeaves / 16
-	for i := range precalcRoots {
-		precalcRoots[i] = bytesRoot(leafData[i*precalcSize*leafSize:][:precalcSize*leafSize], blake, leafSize)
+	// unaligned subtree roots should also match
+	si := NewSubtreeIndex(leafHashes, blake)
+	for start := 0; start < len(leafHashes); start++ {
+		for n := 1; n <= len(leafHashes); n++ {
+			csh := NewCachedSubtreeHasherFromIndex(si)
+			if err := csh.Skip(start); err != nil {
+				t.Fatal(err)
+			}
+			root, err := csh.NextSubtreeRoot(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := NewCachedSubtreeHasher(leafHashes[start:], blake).NextSubtreeRoot(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(root, expected) {
+				t.Fatalf("indexed root of %v leaves at %v does not match", n, start)
+			}
+		}
 	}
+}
 
-	benchRange := func(start, end int) func(*testing.B) {
-		return func(b *testing.B) {
-			precalc := newPrecalcSubtreeHasher(precalcRoots, precalcSize, blake, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
-			b.ReportAllocs()
-			proof, _ := BuildRangeProof(start, end, precalc)
-			if !verifyProof(start, end, proof) {
-				b.Fatal("precalculated roots are incorrect")
+// TestSparsePrecalcSubtreeHasher tests that SparsePrecalcSubtreeHasher
+// produces the same proofs as a ReaderSubtreeHasher, and that it uses the
+// precalculated roots.
+func TestSparsePrecalcSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 27
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	subtreeRoot := func(span SubtreeSpan) []byte {
+		return bytesRoot(leafData[span.Offset*leafSize:][:span.Size*leafSize], blake, leafSize)
+	}
+	spans := []SubtreeSpan{{0, 8}, {8, 2}, {12, 4}, {16, 8}, {25, 1}}
+	roots := make(map[SubtreeSpan][]byte)
+	for _, span := range spans {
+		roots[span] = subtreeRoot(span)
+	}
+
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			sp := NewSparsePrecalcSubtreeHasher(roots, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			proof, err := BuildRangeProof(start, end, sp)
+			if err != nil {
+				t.Fatal(err)
 			}
-			for i := 0; i < b.N; i++ {
-				precalc = newPrecalcSubtreeHasher(precalcRoots, precalcSize, blake, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
-				_, _ = BuildRangeProof(start, end, precalc)
+			expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(proof, expected) {
+				t.Fatalf("proof for range %v-%v does not match", start, end)
 			}
 		}
 	}
 
-	b.Run("single", benchRange(numLeaves-1, numLeaves))
-	b.Run("sixteenth", benchRange(numLeaves-numLeaves/16, numLeaves))
+	// corrupt the precalculated roots; proofs that use them should change
+	bad := make(map[SubtreeSpan][]byte)
+	for span := range roots {
+		bad[span] = make([]byte, blake.Size())
+	}
+	sp := NewSparsePrecalcSubtreeHasher(bad, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	proof, err := BuildRangeProof(8, 12, sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(proof[0], bad[SubtreeSpan{0, 8}]) || !bytes.Equal(proof[1], bad[SubtreeSpan{12, 4}]) {
+		t.Fatal("precalculated roots were not used")
+	}
 }
 
-// BenchmarkVerifyRange benchmarks the performance of VerifyRangeProof
-// for various proof ranges.
-func BenchmarkVerifyRangeProof(b *testing.B) {
+// TestVerifySubtreeRoots tests that VerifySubtreeRoots accepts valid tilings
+// and rejects malformed ones.
+func TestVerifySubtreeRoots(t *testing.T) {
 	blake, _ := blake2b.New256(nil)
-	leafData := fastrand.Bytes(1 << 22)
 	const leafSize = 64
-	numLeaves := len(leafData) / 64
+	const numLeaves = 13
+	leafData := fastrand.Bytes(leafSize * numLeaves)
 	root := bytesRoot(leafData, blake, leafSize)
+	subtreeRoots := func(spans ...SubtreeSpan) []SubtreeRoot {
+		var roots []SubtreeRoot
+		for _, span := range spans {
+			end := span.Offset + span.Size
+			if end > numLeaves {
+				end = numLeaves
+			}
+			roots = append(roots, SubtreeRoot{
+				SubtreeSpan: span,
+				Root:        bytesRoot(leafData[span.Offset*leafSize:end*leafSize], blake, leafSize),
+			})
+		}
+		return roots
+	}
 
-	verifyProof := func(start, end int, proof [][]byte) bool {
-		lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
-		ok, err := VerifyRangeProof(lh, blake, start, end, proof, root)
+	// valid tilings
+	valid := [][]SubtreeRoot{
+		subtreeRoots(SubtreeSpan{0, 8}, SubtreeSpan{8, 4}, SubtreeSpan{12, 1}),
+		subtreeRoots(SubtreeSpan{0, 4}, SubtreeSpan{4, 4}, SubtreeSpan{8, 2}, SubtreeSpan{10, 1}, SubtreeSpan{11, 1}, SubtreeSpan{12, 1}),
+	}
+	for i, roots := range valid {
+		if !VerifySubtreeRoots(roots, root, numLeaves, blake) {
+			t.Errorf("valid tiling %v was rejected", i)
+		}
+	}
+
+	// malformed tilings
+	tilings := map[string][]SubtreeRoot{
+		"empty":      nil,
+		"gap":        subtreeRoots(SubtreeSpan{0, 8}, SubtreeSpan{12, 1}),
+		"overlap":    subtreeRoots(SubtreeSpan{0, 8}, SubtreeSpan{4, 4}, SubtreeSpan{8, 4}, SubtreeSpan{12, 1}),
+		"unaligned":  subtreeRoots(SubtreeSpan{0, 2}, SubtreeSpan{2, 4}, SubtreeSpan{6, 2}, SubtreeSpan{8, 4}, SubtreeSpan{12, 1}),
+		"not pow2":   subtreeRoots(SubtreeSpan{0, 12}, SubtreeSpan{12, 1}),
+		"incomplete": subtreeRoots(SubtreeSpan{0, 8}, SubtreeSpan{8, 4}),
+		"overhang":   subtreeRoots(SubtreeSpan{0, 8}, SubtreeSpan{8, 8}),
+		"out of order": append(subtreeRoots(SubtreeSpan{8, 4}, SubtreeSpan{0, 8}),
+			subtreeRoots(SubtreeSpan{12, 1})...),
+	}
+	for name, roots := range tilings {
+		if VerifySubtreeRoots(roots, root, numLeaves, blake) {
+			t.Errorf("malformed tiling (%v) was accepted", name)
+		}
+	}
+
+	// wrong roots
+	roots := subtreeRoots(SubtreeSpan{0, 8}, SubtreeSpan{8, 4}, SubtreeSpan{12, 1})
+	roots[1].Root = append([]byte(nil), roots[1].Root...)
+	roots[1].Root[0] ^= 1
+	if VerifySubtreeRoots(roots, root, numLeaves, blake) {
+		t.Error("tiling with wrong root was accepted")
+	}
+	roots[1].Root = roots[1].Root[:10]
+	if VerifySubtreeRoots(roots, root, numLeaves, blake) {
+		t.Error("tiling with truncated root was accepted")
+	}
+}
+
+// TestSubtreeRootLeafHasher tests that VerifyRangeProof accepts the root of
+// an aligned proof range in place of its leaf hashes.
+func TestSubtreeRootLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 12
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	for _, r := range []struct{ start, end int }{{0, 1}, {5, 6}, {4, 8}, {0, 8}, {8, 12}, {10, 12}} {
+		proof, err := BuildRangeProof(r.start, r.end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
 		if err != nil {
-			b.Fatal(err)
+			t.Fatal(err)
+		}
+		rangeRoot := bytesRoot(leafData[r.start*leafSize:r.end*leafSize], blake, leafSize)
+		ok, err := VerifyRangeProof(NewSubtreeRootLeafHasher(rangeRoot), blake, r.start, r.end, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify range %v-%v using its subtree root", r.start, r.end)
+		}
+		// a bad root should not verify
+		rangeRoot[0]++
+		ok, err = VerifyRangeProof(NewSubtreeRootLeafHasher(rangeRoot), blake, r.start, r.end, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Errorf("verified range %v-%v using an incorrect subtree root", r.start, r.end)
 		}
-		return ok
 	}
 
-	benchRange := func(start, end int) func(*testing.B) {
-		proof, _ := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
-		return func(b *testing.B) {
-			b.ReportAllocs()
-			for i := 0; i < b.N; i++ {
-				_ = verifyProof(start, end, proof)
+	// unaligned ranges are not supported
+	proof, err := BuildRangeProof(3, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeRoot := bytesRoot(leafData[3*leafSize:5*leafSize], blake, leafSize)
+	if _, err := VerifyRangeProof(NewSubtreeRootLeafHasher(rangeRoot), blake, 3, 5, proof, root); err == nil {
+		t.Error("expected error when verifying an unaligned range using its subtree root")
+	}
+}
+
+// TestSubtreeRootFastPath tests that, for every aligned range, verifying
+// with a SubtreeRootLeafHasher produces the same result as verifying with the
+// individual leaf hashes, for both valid and invalid proofs.
+func TestSubtreeRootFastPath(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 27
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	var tested int
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			if _, ok := alignedSubtreeHeight(start, end); !ok {
+				continue
+			}
+			tested++
+			proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rangeData := leafData[start*leafSize : end*leafSize]
+			rangeRoot := bytesRoot(rangeData, blake, leafSize)
+			verify := func(proof [][]byte) {
+				fast, err := VerifyRangeProof(NewSubtreeRootLeafHasher(rangeRoot), blake, start, end, proof, root)
+				if err != nil {
+					t.Fatal(err)
+				}
+				general, err := VerifyRangeProof(NewReaderLeafHasher(bytes.NewReader(rangeData), blake, leafSize), blake, start, end, proof, root)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fast != general {
+					t.Fatalf("fast path for range %v-%v returned %v, general path returned %v", start, end, fast, general)
+				}
+			}
+			verify(proof)
+			for i := range proof {
+				bad := append([][]byte(nil), proof...)
+				bad[i] = append([]byte(nil), proof[i]...)
+				bad[i][0] ^= 1
+				verify(bad)
 			}
 		}
 	}
+	if tested == 0 {
+		t.Fatal("no aligned ranges were tested")
+	}
+}
 
-	b.Run("single", benchRange(0, 1))
-	b.Run("half", benchRange(0, numLeaves/2))
-	b.Run("mid", benchRange(numLeaves/2, 1+numLeaves/2))
-	b.Run("full", benchRange(0, numLeaves-1))
+// TestEndOfTreeHelpers tests IsEndOfTree and IsTruncated against the
+// relevant sentinel errors and the errors returned by the SubtreeHashers.
+func TestEndOfTreeHelpers(t *testing.T) {
+	tests := []struct {
+		err                  error
+		endOfTree, truncated bool
+	}{
+		{nil, false, false},
+		{io.EOF, true, false},
+		{io.ErrUnexpectedEOF, false, true},
+		{fmt.Errorf("wrapped: %w", io.EOF), true, false},
+		{fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF), false, true},
+		{ErrHasherMisuse, false, false},
+		{errors.New("EOF"), false, false},
+	}
+	for _, test := range tests {
+		if IsEndOfTree(test.err) != test.endOfTree {
+			t.Errorf("IsEndOfTree(%v) should be %v", test.err, test.endOfTree)
+		}
+		if IsTruncated(test.err) != test.truncated {
+			t.Errorf("IsTruncated(%v) should be %v", test.err, test.truncated)
+		}
+	}
+
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(64 * 4)
+	leafHashes := make([][]byte, 4)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[i*64:][:64])
+	}
+	newHashers := []func() SubtreeHasher{
+		func() SubtreeHasher { return NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake) },
+		func() SubtreeHasher { return NewCachedSubtreeHasher(leafHashes, blake) },
+		func() SubtreeHasher { return NewReaderAtSubtreeHasher(bytes.NewReader(leafData), 64, blake) },
+	}
+	for _, newHasher := range newHashers {
+		sh := newHasher()
+		if err := sh.Skip(5); !IsTruncated(err) || IsEndOfTree(err) {
+			t.Error("expected Skip past the end of the tree to be truncated, got", err)
+		}
+		sh = newHasher()
+		if err := sh.Skip(4); IsTruncated(err) || err != nil {
+			t.Error("expected Skip to the end of the tree to succeed, got", err)
+		}
+		if _, err := sh.NextSubtreeRoot(1); !IsEndOfTree(err) || IsTruncated(err) {
+			t.Error("expected NextSubtreeRoot at the end of the tree to signal end of tree, got", err)
+		}
+	}
+}
+
+// TestBuildRangeProofTwoLeaves tests every range of a two-leaf tree with each
+// SubtreeHasher. In such a tree, a single subtree spans the whole tree, so
+// both the left-side and right-side loops of BuildRangeProof reach their
+// boundaries; the proofs must not depend on the hasher.
+func TestBuildRangeProofTwoLeaves(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for _, dataLen := range []int{2 * 64, 64 + 10} { // second leaf full or short
+		leafData := fastrand.Bytes(dataLen)
+		leafHashes := [][]byte{leafSum(blake, leafData[:64]), leafSum(blake, leafData[64:])}
+		root := nodeSum(blake, leafHashes[0], leafHashes[1])
+		newHashers := map[string]func() SubtreeHasher{
+			"Reader":     func() SubtreeHasher { return NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake) },
+			"ReaderAt":   func() SubtreeHasher { return NewReaderAtSubtreeHasher(bytes.NewReader(leafData), 64, blake) },
+			"Cached":     func() SubtreeHasher { return NewCachedSubtreeHasher(leafHashes, blake) },
+			"Index":      func() SubtreeHasher { return NewCachedSubtreeHasherFromIndex(NewSubtreeIndex(leafHashes, blake)) },
+			"LeafHasher": func() SubtreeHasher { return SubtreeHasherFromLeafHasher(NewCachedLeafHasher(leafHashes), blake) },
+		}
+		expected := map[[2]int][][]byte{
+			{0, 1}: {leafHashes[1]},
+			{1, 2}: {leafHashes[0]},
+			{0, 2}: nil,
+		}
+		for r, exp := range expected {
+			for name, newHasher := range newHashers {
+				proof, err := BuildRangeProof(r[0], r[1], newHasher())
+				if err != nil {
+					t.Fatalf("%v: [%v, %v): %v", name, r[0], r[1], err)
+				} else if len(proof) != len(exp) || (len(exp) > 0 && !reflect.DeepEqual(proof, exp)) {
+					t.Fatalf("%v: [%v, %v): wrong proof", name, r[0], r[1])
+				}
+				lh := NewCachedLeafHasher(leafHashes[r[0]:r[1]])
+				if ok, err := VerifyRangeProof(lh, blake, r[0], r[1], proof, root); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatalf("%v: [%v, %v): proof does not verify", name, r[0], r[1])
+				}
+			}
+		}
+	}
+}
+
+// TestIteratorSubtreeHasher tests that an IteratorSubtreeHasher produces the
+// same proofs as a ReaderSubtreeHasher.
+func TestIteratorSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 13
+	leafData := fastrand.Bytes(leafSize*(numLeaves-1) + 10)
+	newIterator := func() func() ([]byte, bool, error) {
+		rows := make([][]byte, 0, numLeaves)
+		for i := 0; i < len(leafData); i += leafSize {
+			end := i + leafSize
+			if end > len(leafData) {
+				end = len(leafData)
+			}
+			rows = append(rows, leafData[i:end])
+		}
+		return func() ([]byte, bool, error) {
+			if len(rows) == 0 {
+				return nil, false, nil
+			}
+			row := rows[0]
+			rows = rows[1:]
+			return row, true, nil
+		}
+	}
+
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			proof, err := BuildRangeProof(start, end, NewIteratorSubtreeHasher(newIterator(), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(proof, expected) {
+				t.Fatalf("proof for range %v-%v does not match", start, end)
+			}
+		}
+	}
+
+	// skipping past the end should be reported as truncation
+	ish := NewIteratorSubtreeHasher(newIterator(), leafSize, blake)
+	if err := ish.Skip(numLeaves + 1); !IsTruncated(err) {
+		t.Fatal("expected truncation, got", err)
+	}
+
+	// errors from the iterator should be propagated
+	errIter := errors.New("iterator error")
+	ish = NewIteratorSubtreeHasher(func() ([]byte, bool, error) { return nil, false, errIter }, leafSize, blake)
+	if _, err := ish.NextSubtreeRoot(4); err != errIter {
+		t.Fatal("expected iterator error, got", err)
+	}
+
+	// oversized leaves should be rejected
+	ish = NewIteratorSubtreeHasher(func() ([]byte, bool, error) { return make([]byte, leafSize+1), true, nil }, leafSize, blake)
+	if _, err := ish.NextSubtreeRoot(1); err == nil {
+		t.Fatal("expected error for oversized leaf")
+	}
+
+	// a nil leaf is an empty leaf, not the end of the tree
+	rows := [][]byte{leafData[:leafSize], nil, leafData[leafSize : 2*leafSize]}
+	ish = NewIteratorSubtreeHasher(func() ([]byte, bool, error) {
+		if len(rows) == 0 {
+			return nil, false, nil
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, true, nil
+	}, leafSize, blake)
+	tree := New(blake)
+	tree.Push(leafData[:leafSize])
+	tree.Push([]byte{})
+	tree.Push(leafData[leafSize : 2*leafSize])
+	if root, err := ish.NextSubtreeRoot(4); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(root, tree.Root()) {
+		t.Fatal("nil leaf was not hashed as an empty leaf")
+	} else if _, err := ish.NextSubtreeRoot(1); err != io.EOF {
+		t.Fatal("expected io.EOF after the final leaf, got", err)
+	}
+}
+
+// TestMapLeafHasher tests verifying proofs using leaf data stored in a map.
+func TestMapLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 12
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	leaves := make(map[int][]byte)
+	for i := 0; i < numLeaves; i++ {
+		leaves[i] = leafData[i*leafSize:][:leafSize]
+	}
+
+	// the indices may be supplied in any order
+	proof, err := BuildRangeProof(3, 7, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices := []int{5, 3, 6, 4}
+	if ok, err := VerifyRangeProof(NewMapLeafHasher(indices, leaves, blake), blake, 3, 7, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof using map-backed leaves")
+	}
+	if indices[0] != 5 {
+		t.Fatal("NewMapLeafHasher modified its input")
+	}
+
+	// scattered indices, each proven individually
+	for _, i := range []int{0, 2, 9, 11} {
+		proof, err := BuildRangeProof(i, i+1, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := VerifyRangeProof(NewMapLeafHasher([]int{i}, leaves, blake), blake, i, i+1, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify proof for leaf %v using map-backed leaves", i)
+		}
+	}
+
+	// a missing index should cause an error
+	delete(leaves, 4)
+	if _, err := VerifyRangeProof(NewMapLeafHasher(indices, leaves, blake), blake, 3, 7, proof, root); err == nil {
+		t.Fatal("expected error for missing leaf")
+	}
+}
+
+// TestSubtreeHasherMisuse tests that the SubtreeHasher implementations return
+// ErrHasherMisuse when used incorrectly.
+func TestSubtreeHasherMisuse(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 8
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+	}
+
+	newHashers := func() []SubtreeHasher {
+		return []SubtreeHasher{
+			NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake),
+			NewCachedSubtreeHasher(leafHashes, blake),
+			NewCachedSubtreeHasherFromIndex(NewSubtreeIndex(leafHashes, blake)),
+		}
+	}
+
+	// skipping backward
+	for _, sh := range newHashers() {
+		if err := sh.Skip(-1); err != ErrHasherMisuse {
+			t.Errorf("%T: expected ErrHasherMisuse when skipping backward, got %v", sh, err)
+		}
+	}
+
+	// requesting an empty or negative subtree
+	for _, sh := range newHashers() {
+		if _, err := sh.NextSubtreeRoot(0); err != ErrHasherMisuse {
+			t.Errorf("%T: expected ErrHasherMisuse for empty subtree, got %v", sh, err)
+		}
+		if _, err := sh.NextSubtreeRoot(-4); err != ErrHasherMisuse {
+			t.Errorf("%T: expected ErrHasherMisuse for negative subtree, got %v", sh, err)
+		}
+	}
+
+	// continuing after the hasher is exhausted
+	for _, sh := range newHashers() {
+		if _, err := sh.NextSubtreeRoot(numLeaves + 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sh.NextSubtreeRoot(1); err != io.EOF {
+			t.Errorf("%T: expected io.EOF, got %v", sh, err)
+		}
+		if _, err := sh.NextSubtreeRoot(1); err != ErrHasherMisuse {
+			t.Errorf("%T: expected ErrHasherMisuse after io.EOF, got %v", sh, err)
+		}
+		if err := sh.Skip(1); err != ErrHasherMisuse {
+			t.Errorf("%T: expected ErrHasherMisuse when skipping after io.EOF, got %v", sh, err)
+		}
+	}
+}
+
+// TestReaderSubtreeHasherSkipPartialLeaf tests that ReaderSubtreeHasher.Skip
+// succeeds when the stream ends partway through the final skipped leaf, and
+// reports io.ErrUnexpectedEOF only when it ends before that leaf.
+func TestReaderSubtreeHasherSkipPartialLeaf(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	// 20 full leaves, followed by a partial leaf of 10 bytes
+	leafData := fastrand.Bytes(leafSize*20 + 10)
+
+	// skipping every leaf, including the partial one, should succeed and
+	// leave the hasher at the end of the stream
+	rsh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	if err := rsh.Skip(21); err != nil {
+		t.Fatal("expected to skip partial final leaf, got", err)
+	} else if _, err := rsh.NextSubtreeRoot(1); err != io.EOF {
+		t.Fatal("expected io.EOF after skipping every leaf, got", err)
+	}
+
+	// skipping up to the partial leaf should leave it to be hashed
+	rsh = NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	if err := rsh.Skip(20); err != nil {
+		t.Fatal(err)
+	} else if root, err := rsh.NextSubtreeRoot(1); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(root, leafSum(blake, leafData[20*leafSize:])) {
+		t.Fatal("wrong root for partial final leaf")
+	}
+
+	// skipping past the partial leaf should fail
+	rsh = NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	if err := rsh.Skip(22); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+
+	// with no partial leaf, skipping exactly to the end should succeed, and
+	// skipping one more leaf should fail
+	rsh = NewReaderSubtreeHasher(bytes.NewReader(leafData[:20*leafSize]), leafSize, blake)
+	if err := rsh.Skip(20); err != nil {
+		t.Fatal(err)
+	}
+	rsh = NewReaderSubtreeHasher(bytes.NewReader(leafData[:20*leafSize]), leafSize, blake)
+	if err := rsh.Skip(21); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+// TestFileRangeLeafHasher tests that proofs can be verified using leaves
+// read directly from a file.
+func TestFileRangeLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	// the final leaf is short
+	leafData := fastrand.Bytes(leafSize*20 + 10)
+	root := bytesRoot(leafData, blake, leafSize)
+
+	f, err := ioutil.TempFile("", "merkletree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(leafData); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct{ start, end int }{{0, 1}, {3, 9}, {19, 20}, {20, 21}, {15, 21}, {0, 21}} {
+		proof, err := BuildRangeProof(r.start, r.end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := VerifyRangeProof(NewFileRangeLeafHasher(f, blake, leafSize, r.start, r.end), blake, r.start, r.end, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify range %v-%v using file leaves", r.start, r.end)
+		}
+	}
+
+	// a non-positive leaf size triggers a panic
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for zero leafSize")
+		}
+	}()
+	NewFileRangeLeafHasher(f, blake, 0, 0, 1)
+}
+
+// TestVerifyRangeProofStruct tests that VerifyRangeProofStruct detects
+// mismatched leaf sizes.
+func TestVerifyRangeProofStruct(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(64 * 16)
+	root := bytesRoot(leafData, blake, 64)
+
+	hashes, err := BuildRangeProof(3, 7, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := RangeProof{
+		Start:    3,
+		End:      7,
+		LeafSize: 64,
+		Hashes:   hashes,
+	}
+	ok, err := VerifyRangeProofStruct(bytes.NewReader(leafData[3*64:7*64]), 64, blake, proof, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify valid proof")
+	}
+
+	// a verifier configured with a different leaf size should get a
+	// distinct error
+	if _, err := VerifyRangeProofStruct(bytes.NewReader(leafData[3*32:7*32]), 32, blake, proof, root); err != ErrLeafSizeMismatch {
+		t.Fatal("expected ErrLeafSizeMismatch, got", err)
+	}
+}
+
+// TestBuildVerifyComplementProof tests the BuildComplementProof and
+// VerifyComplementProof functions.
+func TestBuildVerifyComplementProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(leafSize * 33)
+
+	for _, numLeaves := range []int{1, 2, 3, 8, 12, 33} {
+		data := leafData[:numLeaves*leafSize]
+		root := bytesRoot(data, blake, leafSize)
+		for i := 0; i < numLeaves; i++ {
+			proof, err := BuildComplementProof(i, numLeaves, NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			} else if len(proof) != 1 || !bytes.Equal(proof[0], leafSum(blake, data[i*leafSize:][:leafSize])) {
+				t.Fatal("complement proof should contain only the excluded leaf hash")
+			}
+
+			// supply every leaf except i
+			others := append(append([]byte(nil), data[:i*leafSize]...), data[(i+1)*leafSize:]...)
+			lh := NewReaderLeafHasher(bytes.NewReader(others), blake, leafSize)
+			ok, err := VerifyComplementProof(lh, blake, i, numLeaves, proof, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Errorf("failed to verify complement proof for nLeaves=%v, index %v", numLeaves, i)
+			}
+
+			// a corrupted proof should not verify
+			proof[0][0]++
+			lh = NewReaderLeafHasher(bytes.NewReader(others), blake, leafSize)
+			ok, err = VerifyComplementProof(lh, blake, i, numLeaves, proof, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if ok {
+				t.Errorf("verified corrupted complement proof for nLeaves=%v, index %v", numLeaves, i)
+			}
+		}
+	}
+
+	// supplying too few or too many leaves is an error
+	data := leafData[:4*leafSize]
+	root := bytesRoot(data, blake, leafSize)
+	proof, _ := BuildComplementProof(1, 4, NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, blake))
+	if _, err := VerifyComplementProof(NewReaderLeafHasher(bytes.NewReader(data[:leafSize]), blake, leafSize), blake, 1, 4, proof, root); err == nil {
+		t.Error("expected error when supplying too few leaves")
+	}
+	if _, err := VerifyComplementProof(NewReaderLeafHasher(bytes.NewReader(data), blake, leafSize), blake, 1, 4, proof, root); err == nil {
+		t.Error("expected error when supplying too many leaves")
+	}
+}
+
+// TestLengthPrefixedRangeProof tests that length-prefixed trees produce
+// different roots than plain trees, and that proofs only verify within the
+// matching mode.
+func TestLengthPrefixedRangeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(leafSize*12 + 10)
+	numLeaves := 13
+
+	tree := NewLengthPrefixed(blake)
+	if err := tree.ReadAll(bytes.NewReader(leafData), leafSize); err != nil {
+		t.Fatal(err)
+	}
+	prefixedRoot := tree.Root()
+	plainRoot := bytesRoot(leafData, blake, leafSize)
+	if bytes.Equal(prefixedRoot, plainRoot) {
+		t.Fatal("length-prefixed root should differ from plain root")
+	}
+
+	// the leaf hashes should use the documented prefix encoding
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leaf := leafData[i*leafSize:]
+		if len(leaf) > leafSize {
+			leaf = leaf[:leafSize]
+		}
+		leafHashes[i] = LengthPrefixedLeafHash(blake, leaf)
+		if !bytes.Equal(leafHashes[i], sum(blake, []byte{0x00, byte(len(leaf))}, leaf)) {
+			t.Fatal("length-prefixed leaf hash does not match documented encoding")
+		}
+	}
+
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			var sh SubtreeHasher = NewReaderSubtreeHasherLengthPrefixed(bytes.NewReader(leafData), leafSize, blake)
+			if fastrand.Intn(2) == 0 {
+				sh = NewCachedSubtreeHasher(leafHashes, blake)
+			}
+			proof, err := BuildRangeProof(start, end, sh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rangeData := leafData[start*leafSize:]
+			if len(rangeData) > (end-start)*leafSize {
+				rangeData = rangeData[:(end-start)*leafSize]
+			}
+			lh := NewReaderLeafHasherLengthPrefixed(bytes.NewReader(rangeData), blake, leafSize)
+			if ok, err := VerifyRangeProof(lh, blake, start, end, proof, prefixedRoot); err != nil || !ok {
+				t.Fatalf("failed to verify length-prefixed proof for range %v-%v: %v", start, end, err)
+			}
+			// plain leaf hashes should not verify against the length-prefixed
+			// root
+			lh = NewReaderLeafHasher(bytes.NewReader(rangeData), blake, leafSize)
+			if ok, err := VerifyRangeProof(lh, blake, start, end, proof, prefixedRoot); err != nil || ok {
+				t.Fatalf("verified plain leaves against length-prefixed proof for range %v-%v", start, end)
+			}
+		}
+	}
+}
+
+// TestVerifyPaddedRangeProof tests verifying proofs for a tree of 5 data
+// leaves padded to 8 leaves without supplying the padding leaves.
+func TestVerifyPaddedRangeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const dataLeaves, paddedLeaves = 5, 8
+	data := fastrand.Bytes(leafSize * dataLeaves)
+	padded := append(append([]byte(nil), data...), make([]byte, leafSize*(paddedLeaves-dataLeaves))...)
+	root := bytesRoot(padded, blake, leafSize)
+
+	for start := 0; start < paddedLeaves; start++ {
+		for end := start + 1; end <= paddedLeaves; end++ {
+			proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(padded), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// supply only the data leaves within the range
+			var rangeData []byte
+			if start < dataLeaves {
+				dataEnd := end
+				if dataEnd > dataLeaves {
+					dataEnd = dataLeaves
+				}
+				rangeData = data[start*leafSize : dataEnd*leafSize]
+			}
+			lh := NewReaderLeafHasher(bytes.NewReader(rangeData), blake, leafSize)
+			ok, err := VerifyPaddedRangeProof(lh, blake, leafSize, dataLeaves, paddedLeaves, start, end, proof, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Errorf("failed to verify padded range %v-%v", start, end)
+			}
+		}
+	}
+
+	// supplying too few data leaves is an error
+	proof, _ := BuildRangeProof(3, 6, NewReaderSubtreeHasher(bytes.NewReader(padded), leafSize, blake))
+	lh := NewReaderLeafHasher(bytes.NewReader(data[3*leafSize:4*leafSize]), blake, leafSize)
+	if _, err := VerifyPaddedRangeProof(lh, blake, leafSize, dataLeaves, paddedLeaves, 3, 6, proof, root); err == nil {
+		t.Error("expected error when supplying too few data leaves")
+	}
+}
+
+// TestRangeProofSmallTrees tests every valid range proof for trees of one and
+// two leaves.
+func TestRangeProofSmallTrees(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(128)
+	leafHashes := [][]byte{
+		leafSum(blake, leafData[:64]),
+		leafSum(blake, leafData[64:]),
+	}
+
+	// the root of a single-leaf tree is the leaf hash itself
+	oneRoot := bytesRoot(leafData[:64], blake, 64)
+	if !bytes.Equal(oneRoot, leafHashes[0]) {
+		t.Fatal("root of single-leaf tree is not the leaf hash")
+	}
+	for _, sh := range []SubtreeHasher{
+		NewReaderSubtreeHasher(bytes.NewReader(leafData[:64]), 64, blake),
+		NewCachedSubtreeHasher(leafHashes[:1], blake),
+	} {
+		proof, err := BuildRangeProof(0, 1, sh)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(proof) != 0 {
+			t.Fatal("proof for single-leaf tree should be empty, got", len(proof), "hashes")
+		}
+	}
+	if ok, err := VerifyRangeProof(NewCachedLeafHasher(leafHashes[:1]), blake, 0, 1, nil, oneRoot); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify single-leaf proof")
+	}
+	if ok, _ := VerifyRangeProof(NewCachedLeafHasher(leafHashes[1:]), blake, 0, 1, nil, oneRoot); ok {
+		t.Fatal("verified single-leaf proof with wrong leaf")
+	}
+	if ok, _ := VerifyRangeProof(NewCachedLeafHasher(leafHashes[:1]), blake, 0, 1, leafHashes[1:], oneRoot); ok {
+		t.Fatal("verified single-leaf proof with extra hash")
+	}
+	if _, err := VerifyRangeProof(NewCachedLeafHasher(nil), blake, 0, 1, nil, nil); err != ErrNoLeafHashes {
+		t.Fatal("expected ErrNoLeafHashes when verifying without leaf hashes, got", err)
+	}
+
+	// two-leaf tree: [0,1), [1,2), and [0,2)
+	twoRoot := bytesRoot(leafData, blake, 64)
+	if !bytes.Equal(twoRoot, nodeSum(blake, leafHashes[0], leafHashes[1])) {
+		t.Fatal("root of two-leaf tree is not the nodeSum of its leaves")
+	}
+	for _, r := range []struct {
+		start, end int
+		proof      [][]byte
+	}{
+		{0, 1, [][]byte{leafHashes[1]}},
+		{1, 2, [][]byte{leafHashes[0]}},
+		{0, 2, nil},
+	} {
+		for _, sh := range []SubtreeHasher{
+			NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake),
+			NewCachedSubtreeHasher(leafHashes, blake),
+		} {
+			proof, err := BuildRangeProof(r.start, r.end, sh)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(proof) != len(r.proof) {
+				t.Fatalf("wrong proof length for range %v-%v: expected %v, got %v", r.start, r.end, len(r.proof), len(proof))
+			}
+			for i := range proof {
+				if !bytes.Equal(proof[i], r.proof[i]) {
+					t.Fatalf("wrong proof hash for range %v-%v", r.start, r.end)
+				}
+			}
+		}
+		lh := NewCachedLeafHasher(leafHashes[r.start:r.end])
+		if ok, err := VerifyRangeProof(lh, blake, r.start, r.end, r.proof, twoRoot); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify range %v-%v", r.start, r.end)
+		}
+		if ok, _ := VerifyRangeProof(NewCachedLeafHasher(leafHashes[r.start:r.end]), blake, r.start, r.end, r.proof, oneRoot); ok {
+			t.Fatalf("verified range %v-%v against wrong root", r.start, r.end)
+		}
+	}
+}
+
+// TestBuildRangeProofTreeBoundary tests that proofs for ranges ending at or
+// near the end of the tree are identical regardless of which SubtreeHasher is
+// used, including when the final leaf is partial and when the final subtree
+// is imperfect.
+func TestBuildRangeProofTreeBoundary(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	for numLeaves := 1; numLeaves <= 33; numLeaves++ {
+		// make the final leaf partial in every other tree
+		leafData := fastrand.Bytes(numLeaves*leafSize - (numLeaves%2)*(leafSize/2))
+		leafHashes := make([][]byte, numLeaves)
+		for i := range leafHashes {
+			end := (i + 1) * leafSize
+			if end > len(leafData) {
+				end = len(leafData)
+			}
+			leafHashes[i] = leafSum(blake, leafData[i*leafSize:end])
+		}
+		si := NewSubtreeIndex(leafHashes, blake)
+		root := bytesRoot(leafData, blake, leafSize)
+
+		for start := 0; start < numLeaves; start++ {
+			for _, end := range []int{numLeaves - 1, numLeaves} {
+				if end <= start {
+					continue
+				}
+				expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+				if err != nil {
+					t.Fatal(err)
+				} else if len(expected) != RangeProofSize(numLeaves, start, end) {
+					t.Fatalf("wrong proof length for range %v-%v of %v leaves", start, end, numLeaves)
+				}
+				for _, sh := range []SubtreeHasher{
+					NewCachedSubtreeHasher(leafHashes, blake),
+					NewCachedSubtreeHasherFromIndex(si),
+				} {
+					proof, err := BuildRangeProof(start, end, sh)
+					if err != nil {
+						t.Fatal(err)
+					} else if !reflect.DeepEqual(proof, expected) {
+						t.Fatalf("proofs for range %v-%v of %v leaves differ between hashers", start, end, numLeaves)
+					}
+				}
+				lh := NewCachedLeafHasher(leafHashes[start:end])
+				if ok, err := VerifyRangeProof(lh, blake, start, end, expected, root); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatalf("failed to verify range %v-%v of %v leaves", start, end, numLeaves)
+				}
+			}
+		}
+	}
+}
+
+// TestBuildVerifyRangeProofPowerOfTwo tests building and verifying every
+// range of trees whose leaf count is exactly a power of two, or one more than
+// a power of two.
+func TestBuildVerifyRangeProofPowerOfTwo(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	for _, numLeaves := range []int{2, 4, 8, 16, 32, 64, 3, 5, 9, 17, 33, 65} {
+		leafData := fastrand.Bytes(numLeaves * leafSize)
+		leafHashes := make([][]byte, numLeaves)
+		for i := range leafHashes {
+			leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+		}
+		root := bytesRoot(leafData, blake, leafSize)
+		powerOfTwo := numLeaves&(numLeaves-1) == 0
+
+		for start := 0; start < numLeaves; start++ {
+			for end := start + 1; end <= numLeaves; end++ {
+				proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sh := range []SubtreeHasher{
+					NewCachedSubtreeHasher(leafHashes, blake),
+					NewReaderAtSubtreeHasher(bytes.NewReader(leafData), leafSize, blake),
+				} {
+					other, err := BuildRangeProof(start, end, sh)
+					if err != nil {
+						t.Fatal(err)
+					} else if !reflect.DeepEqual(other, proof) {
+						t.Fatalf("proofs for range %v-%v of %v leaves differ between hashers", start, end, numLeaves)
+					}
+				}
+
+				numLeft := rangeProofSizeLeft(start)
+				if len(proof) != RangeProofSize(numLeaves, start, end) {
+					t.Fatalf("wrong proof length for range %v-%v of %v leaves", start, end, numLeaves)
+				} else if end == numLeaves && len(proof) != numLeft {
+					t.Fatalf("proof for range %v-%v of %v leaves has right-side hashes", start, end, numLeaves)
+				} else if start == 0 && end == numLeaves && len(proof) != 0 {
+					t.Fatalf("proof for entire %v-leaf tree is not empty", numLeaves)
+				}
+				// in a tree with one leaf past a power of two, a range ending
+				// at the power of two has a single right-side hash: the final
+				// leaf
+				if !powerOfTwo && end == numLeaves-1 {
+					if len(proof) != numLeft+1 || !bytes.Equal(proof[numLeft], leafHashes[numLeaves-1]) {
+						t.Fatalf("proof for range %v-%v of %v leaves has wrong right-side hashes", start, end, numLeaves)
+					}
+				}
+
+				lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+				if ok, err := VerifyRangeProof(lh, blake, start, end, proof, root); err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatalf("failed to verify range %v-%v of %v leaves", start, end, numLeaves)
+				}
+			}
+		}
+	}
+}
+
+// countingLeafHasher is a LeafHasher that produces an unbounded stream of
+// leaf hashes, counting how many have been requested.
+type countingLeafHasher struct {
+	leafHash []byte
+	n        int
+}
+
+func (clh *countingLeafHasher) NextLeafHash() ([]byte, error) {
+	clh.n++
+	return clh.leafHash, nil
+}
+
+// TestReconstructRoot tests that ReconstructRoot recovers the known root of a
+// tree from a proof and the leaf hashes within the proof range.
+func TestReconstructRoot(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 13
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	root, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ start, end int }{{0, 1}, {3, 5}, {4, 8}, {12, 13}, {0, numLeaves}} {
+		proof, err := BuildRangeProof(r.start, r.end, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reconstructed, err := ReconstructRoot(r.start, r.end, proof, leafHashes[r.start:r.end], blake)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(reconstructed, root) {
+			t.Errorf("ReconstructRoot returned the wrong root for range %v-%v", r.start, r.end)
+		}
+	}
+
+	// wrong leaf hashes should produce a different root
+	proof, err := BuildRangeProof(3, 5, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconstructed, err := ReconstructRoot(3, 5, proof, leafHashes[4:6], blake); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(reconstructed, root) {
+		t.Error("ReconstructRoot returned the known root for the wrong leaves")
+	}
+	if _, err := ReconstructRoot(3, 5, proof, nil, blake); err == nil {
+		t.Error("expected error when reconstructing without leaf hashes")
+	}
+}
+
+// TestVerifyRangeProofDetailed tests that VerifyRangeProofDetailed reports
+// the correct reason for each kind of verification failure.
+func TestVerifyRangeProofDetailed(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 12
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	root, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := BuildRangeProof(3, 5, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badRoot := append([]byte(nil), root...)
+	badRoot[0] ^= 1
+	shortHash := append([][]byte(nil), proof...)
+	shortHash[1] = shortHash[1][:10]
+
+	tests := []struct {
+		desc       string
+		leafHashes [][]byte
+		proof      [][]byte
+		root       []byte
+		reason     VerifyReason
+	}{
+		{"valid", leafHashes[3:5], proof, root, Verified},
+		{"wrong root", leafHashes[3:5], proof, badRoot, RootMismatch},
+		{"wrong leaf", leafHashes[4:6], proof, root, RootMismatch},
+		{"short hash", leafHashes[3:5], shortHash, root, MalformedProof},
+		{"missing left hashes", leafHashes[3:5], proof[:1], root, MalformedProof},
+		{"too many hashes", leafHashes[3:5], append(proof, make([][]byte, 64)...), root, MalformedProof},
+		{"too few leaves", leafHashes[3:4], proof, root, LeafCountMismatch},
+		{"too many leaves", leafHashes[3:6], proof, root, LeafCountMismatch},
+		{"no leaves", nil, proof, root, LeafCountMismatch},
+	}
+	for _, test := range tests {
+		for i := range test.proof {
+			if test.proof[i] == nil {
+				test.proof[i] = make([]byte, blake.Size())
+			}
+		}
+		res, err := VerifyRangeProofDetailed(NewCachedLeafHasher(test.leafHashes), blake, 3, 5, test.proof, test.root)
+		if err != nil {
+			t.Fatalf("%v: %v", test.desc, err)
+		} else if res.Reason != test.reason {
+			t.Errorf("%v: expected reason %v, got %v", test.desc, test.reason, res.Reason)
+		} else if res.OK != (test.reason == Verified) {
+			t.Errorf("%v: wrong OK value", test.desc)
+		}
+	}
+
+	// errors from the LeafHasher should be returned as errors
+	lh := NewReaderLeafHasher(iotest.ErrReader(errors.New("read error")), blake, 64)
+	if _, err := VerifyRangeProofDetailed(lh, blake, 3, 5, proof, root); err == nil {
+		t.Error("expected LeafHasher error to be returned")
+	}
+
+	// the fast path should report root mismatches as well
+	rangeRoot, _ := NewCachedSubtreeHasher(leafHashes[4:8], blake).NextSubtreeRoot(4)
+	proof, _ = BuildRangeProof(4, 8, NewCachedSubtreeHasher(leafHashes, blake))
+	if res, err := VerifyRangeProofDetailed(NewSubtreeRootLeafHasher(rangeRoot), blake, 4, 8, proof, root); err != nil || !res.OK {
+		t.Error("failed to verify aligned range using its subtree root:", err)
+	}
+	if res, err := VerifyRangeProofDetailed(NewSubtreeRootLeafHasher(rangeRoot), blake, 4, 8, proof, badRoot); err != nil || res.Reason != RootMismatch {
+		t.Error("expected root mismatch, got", res.Reason, err)
+	}
+}
+
+// TestVerifyRangeProofN tests that VerifyRangeProofN aborts once its leaf
+// budget is exceeded.
+func TestVerifyRangeProofN(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafHashes := make([][]byte, 16)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	root := NewSubtreeIndex(leafHashes, blake).root(0, len(leafHashes))
+	proof, err := BuildRangeProof(4, 12, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a budget equal to the range size is sufficient
+	if ok, err := VerifyRangeProofN(NewCachedLeafHasher(leafHashes[4:12]), blake, 4, 12, proof, root, 8); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof within budget")
+	}
+	// as is no budget at all
+	if ok, err := VerifyRangeProofN(NewCachedLeafHasher(leafHashes[4:12]), blake, 4, 12, proof, root, 0); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof without budget")
+	}
+
+	// a range larger than the budget is rejected up front
+	clh := &countingLeafHasher{leafHash: leafHashes[0]}
+	if _, err := VerifyRangeProofN(clh, blake, 4, 12, proof, root, 4); err != ErrBudgetExceeded {
+		t.Fatal("expected ErrBudgetExceeded, got", err)
+	} else if clh.n != 0 {
+		t.Fatal("expected no leaf hashes to be consumed, got", clh.n)
+	}
+
+	// a LeafHasher that yields too many leaves is cut off without consuming
+	// more than maxLeaves leaf hashes
+	clh = &countingLeafHasher{leafHash: leafHashes[0]}
+	const maxLeaves = 10
+	if _, err := VerifyRangeProofN(clh, blake, 4, 12, proof, root, maxLeaves); err != ErrBudgetExceeded {
+		t.Fatal("expected ErrBudgetExceeded, got", err)
+	} else if clh.n != maxLeaves {
+		t.Fatalf("expected %v leaf hashes to be consumed, got %v", maxLeaves, clh.n)
+	}
+	// if the budget equals the range size, the budget is never exceeded, but
+	// the proof cannot verify
+	clh = &countingLeafHasher{leafHash: leafHashes[0]}
+	if ok, err := VerifyRangeProofN(clh, blake, 4, 12, proof, root, 8); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("verified proof with wrong leaf hashes")
+	} else if clh.n != 8 {
+		t.Fatal("expected 8 leaf hashes to be consumed, got", clh.n)
+	}
+
+	// a SubtreeRootLeafHasher is not subject to the budget
+	srlh := NewSubtreeRootLeafHasher(NewSubtreeIndex(leafHashes, blake).root(8, 12))
+	proof, err = BuildRangeProof(8, 12, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyRangeProofN(srlh, blake, 8, 12, proof, root, 4); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof with SubtreeRootLeafHasher")
+	}
+}
+
+// TestBuildVerifyPrefixProof tests BuildPrefixProof and VerifyPrefixProof for
+// prefixes both at and off power-of-two boundaries.
+func TestBuildVerifyPrefixProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 23
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	root := NewSubtreeIndex(leafHashes, blake).root(0, numLeaves)
+
+	for k := 1; k <= numLeaves; k++ {
+		proof, err := BuildPrefixProof(k, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := BuildRangeProof(0, k, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(proof) != len(expected) || len(proof) != rangeProofSizeRight(numLeaves, k) {
+			t.Fatalf("prefix proof for k=%v has wrong length", k)
+		}
+
+		prefixTree := New(blake)
+		for _, lh := range leafHashes[:k] {
+			prefixTree.PushSubTree(0, lh)
+		}
+		prefixRoots := prefixTree.subtreeRoots()
+		if k&(k-1) == 0 && !bytes.Equal(prefixRoots[0], prefixTree.Root()) {
+			t.Fatal("prefix root of power-of-two prefix should be the prefix tree's root")
+		}
+		if ok, err := VerifyPrefixProof(blake, k, prefixRoots, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("failed to verify prefix proof for k=%v", k)
+		}
+
+		// corrupting a prefix root should cause verification to fail
+		prefixRoots[0] = leafHashes[k%numLeaves]
+		if ok, _ := VerifyPrefixProof(blake, k, prefixRoots, proof, root); ok {
+			t.Errorf("verified prefix proof with bad prefix root for k=%v", k)
+		}
+	}
+
+	// wrong number of prefix roots should be rejected
+	if _, err := VerifyPrefixProof(blake, 3, leafHashes[:1], nil, root); err == nil {
+		t.Fatal("expected error for wrong number of prefix roots")
+	}
+}
+
+// TestReversedLeafHasher tests that a range proof can be verified using leaf
+// hashes that arrive in reverse order.
+func TestReversedLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 20
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	root := NewSubtreeIndex(leafHashes, blake).root(0, numLeaves)
+
+	const start, end = 5, 13
+	proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed := make([][]byte, 0, end-start)
+	for i := end - 1; i >= start; i-- {
+		reversed = append(reversed, leafHashes[i])
+	}
+	rlh := NewReversedLeafHasher(NewCachedLeafHasher(reversed), end-start)
+	if ok, err := VerifyRangeProof(rlh, blake, start, end, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof with reversed leaves")
+	}
+
+	// leaves in forward order should not verify
+	rlh = NewReversedLeafHasher(NewCachedLeafHasher(leafHashes[start:end]), end-start)
+	if ok, _ := VerifyRangeProof(rlh, blake, start, end, proof, root); ok {
+		t.Fatal("verified proof with incorrectly ordered leaves")
+	}
+
+	// the underlying LeafHasher is not read past numLeaves
+	clh := NewCachedLeafHasher(append(reversed, leafHashes[0]))
+	rlh = NewReversedLeafHasher(clh, end-start)
+	if ok, err := VerifyRangeProof(rlh, blake, start, end, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify proof with reversed leaves")
+	} else if len(clh.leafHashes) != 1 {
+		t.Fatal("ReversedLeafHasher read too many leaf hashes")
+	}
+
+	// too few leaves is an error
+	rlh = NewReversedLeafHasher(NewCachedLeafHasher(reversed[1:]), end-start)
+	if _, err := VerifyRangeProof(rlh, blake, start, end, proof, root); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+// TestBuildRangeProofFromBytes tests that BuildRangeProofFromBytes matches
+// BuildRangeProof over an explicit ReaderSubtreeHasher.
+func TestBuildRangeProofFromBytes(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	data := fastrand.Bytes(leafSize*19 + 10)
+	const numLeaves = 20
+	root := bytesRoot(data, blake, leafSize)
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			proof, err := BuildRangeProofFromBytes(data, leafSize, start, end, blake)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			} else if len(proof) != len(expected) {
+				t.Fatalf("proof for range %v-%v has wrong length", start, end)
+			}
+			for i := range proof {
+				if !bytes.Equal(proof[i], expected[i]) {
+					t.Fatalf("proof for range %v-%v does not match", start, end)
+				}
+			}
+			rangeData := data[start*leafSize:]
+			if end*leafSize < len(data) {
+				rangeData = data[start*leafSize : end*leafSize]
+			}
+			lh := NewReaderLeafHasher(bytes.NewReader(rangeData), blake, leafSize)
+			if ok, err := VerifyRangeProof(lh, blake, start, end, proof, root); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("failed to verify proof for range %v-%v", start, end)
+			}
+		}
+	}
+}
+
+// TestVerifyRangeProofWithDigest tests that VerifyRangeProofWithDigest
+// verifies valid proofs and returns the hash of the leaf data in the range.
+func TestVerifyRangeProofWithDigest(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(leafSize*12 + 7)
+	const numLeaves = 13
+	root := bytesRoot(leafData, blake, leafSize)
+
+	for _, r := range []struct{ start, end int }{{0, 1}, {3, 5}, {4, 8}, {10, numLeaves}, {0, numLeaves}} {
+		proof, err := BuildRangeProof(r.start, r.end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rangeData := leafData[r.start*leafSize:]
+		if r.end*leafSize < len(leafData) {
+			rangeData = leafData[r.start*leafSize : r.end*leafSize]
+		}
+		ok, digest, err := VerifyRangeProofWithDigest(bytes.NewReader(rangeData), leafSize, blake, sha256.New(), r.start, r.end, proof, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify proof for range %v-%v", r.start, r.end)
+		}
+		expected := sha256.Sum256(rangeData)
+		if !bytes.Equal(digest, expected[:]) {
+			t.Fatalf("wrong digest for range %v-%v", r.start, r.end)
+		}
+	}
+}
+
+// TestVerifyRangeProofTyped tests that VerifyRangeProofTyped verifies valid
+// proofs and rejects roots of the wrong length with ErrBadRootLength.
+func TestVerifyRangeProofTyped(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 12
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := Root(bytesRoot(leafData, blake, leafSize))
+	if !root.Valid(blake) {
+		t.Fatal("root should be valid")
+	}
+
+	proof, err := BuildRangeProof(3, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lh := NewReaderLeafHasher(bytes.NewReader(leafData[3*leafSize:5*leafSize]), blake, leafSize)
+	if ok, err := VerifyRangeProofTyped(lh, blake, 3, 5, proof, root); err != nil || !ok {
+		t.Fatal("failed to verify valid proof:", err)
+	}
+
+	// use a truncated root, e.g. a 20-byte hash
+	badRoot := root[:20]
+	if badRoot.Valid(blake) {
+		t.Fatal("truncated root should not be valid")
+	}
+	lh = NewReaderLeafHasher(bytes.NewReader(leafData[3*leafSize:5*leafSize]), blake, leafSize)
+	if _, err := VerifyRangeProofTyped(lh, blake, 3, 5, proof, badRoot); err != ErrBadRootLength {
+		t.Fatal("expected ErrBadRootLength, got", err)
+	}
+}
+
+// TestTypedHashAdapters tests that the typed LeafHash and NodeHash adapters
+// produce the same proofs and verification results as their []byte
+// counterparts.
+func TestTypedHashAdapters(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 13
+	leafHashes := make([][]byte, numLeaves)
+	typedLeafHashes := make([]LeafHash, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+		typedLeafHashes[i] = leafHashes[i]
+	}
+	root, err := NewCachedSubtreeHasher(leafHashes, blake).NextSubtreeRoot(numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			typedProof, err := BuildRangeProofTyped(start, end, NewCachedSubtreeHasherTyped(typedLeafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			} else if len(typedProof) != len(proof) {
+				t.Fatalf("typed proof for range %v-%v has wrong length", start, end)
+			}
+			for i := range proof {
+				if !bytes.Equal(typedProof[i], proof[i]) {
+					t.Fatalf("typed proof for range %v-%v does not match", start, end)
+				}
+			}
+			ok, err := VerifyRangeProofNodeHashes(NewCachedLeafHasherTyped(typedLeafHashes[start:end]), blake, start, end, typedProof, root)
+			if err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("failed to verify typed proof for range %v-%v", start, end)
+			}
+		}
+	}
+}
+
+// TestProofDigest tests that ProofDigest is deterministic and changes if any
+// of its inputs change.
+func TestProofDigest(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 12
+	leafData := fastrand.Bytes(leafSize * numLeaves)
+	root := bytesRoot(leafData, blake, leafSize)
+	proof, err := BuildRangeProof(3, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := ProofDigest(3, 5, proof, root, blake)
+	if len(digest) != blake.Size() {
+		t.Fatal("digest has wrong length")
+	}
+	if !bytes.Equal(ProofDigest(3, 5, proof, root, blake), digest) {
+		t.Fatal("ProofDigest is not deterministic")
+	}
+
+	// a fixed input should always produce the same digest
+	fixedProof := [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)}
+	fixedRoot := bytes.Repeat([]byte{3}, 32)
+	const fixedDigest = "089c2c00b6e1d7d17d3e3ea86a2e7c3caffbb4a5ac0c2afc1c066756845853dc"
+	if got := hex.EncodeToString(ProofDigest(1, 2, fixedProof, fixedRoot, blake)); got != fixedDigest {
+		t.Fatalf("ProofDigest changed: expected %v, got %v", fixedDigest, got)
+	}
+
+	// changing any input should change the digest
+	if bytes.Equal(ProofDigest(2, 5, proof, root, blake), digest) {
+		t.Error("digest did not change with proofStart")
+	}
+	if bytes.Equal(ProofDigest(3, 6, proof, root, blake), digest) {
+		t.Error("digest did not change with proofEnd")
+	}
+	for i := range proof {
+		modified := append([][]byte(nil), proof...)
+		modified[i] = append([]byte(nil), proof[i]...)
+		modified[i][0] ^= 1
+		if bytes.Equal(ProofDigest(3, 5, modified, root, blake), digest) {
+			t.Errorf("digest did not change with proof hash %v", i)
+		}
+	}
+	if bytes.Equal(ProofDigest(3, 5, proof[:len(proof)-1], root, blake), digest) {
+		t.Error("digest did not change when a proof hash was removed")
+	}
+	badRoot := append([]byte(nil), root...)
+	badRoot[0] ^= 1
+	if bytes.Equal(ProofDigest(3, 5, proof, badRoot, blake), digest) {
+		t.Error("digest did not change with root")
+	}
+}
+
+// BenchmarkBuildRangeProof benchmarks the performance of BuildRangeProof for
+// various proof ranges.
+func BenchmarkBuildRangeProof(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := testData(1, 1<<22)
+	const leafSize = 64
+	numLeaves := len(leafData) / 64
+
+	benchRange := func(start, end int) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			}
+		}
+	}
+
+	b.Run("single", benchRange(0, 1))
+	b.Run("half", benchRange(0, numLeaves/2))
+	b.Run("mid", benchRange(numLeaves/2, 1+numLeaves/2))
+	b.Run("full", benchRange(0, numLeaves-1))
+}
+
+// BenchmarkBuildRangeProofWorstCase benchmarks the performance of
+// BuildRangeProof for the range [numLeaves/2-1, numLeaves/2+1), which
+// straddles the midpoint of the tree and thus produces the largest possible
+// proof, at various tree sizes.
+func BenchmarkBuildRangeProofWorstCase(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+
+	benchSize := func(numLeaves int) func(*testing.B) {
+		return func(b *testing.B) {
+			leafData := fastrand.Bytes(numLeaves * leafSize)
+			start, end := numLeaves/2-1, numLeaves/2+1
+			proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			if err != nil {
+				b.Fatal(err)
+			}
+			lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+			if ok, err := VerifyRangeProof(lh, blake, start, end, proof, bytesRoot(leafData, blake, leafSize)); err != nil || !ok {
+				b.Fatal("failed to verify proof:", err)
+			}
+
+			b.SetBytes(int64(len(leafData)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			}
+		}
+	}
+
+	b.Run("1k", benchSize(1<<10))
+	b.Run("16k", benchSize(1<<14))
+	b.Run("64k", benchSize(1<<16))
+}
+
+// BenchmarkBuildRangeProofCachedVsReader compares the performance of
+// BuildRangeProof using a CachedSubtreeHasher (over precomputed leaf hashes)
+// and a ReaderSubtreeHasher (over the raw leaf data) for various proof
+// ranges. The cost of precomputing the leaf hashes is not included.
+func BenchmarkBuildRangeProofCachedVsReader(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := testData(1, 1<<22)
+	const leafSize = 64
+	numLeaves := len(leafData) / leafSize
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[i*leafSize:][:leafSize])
+	}
+
+	benchRange := func(start, end int, cached bool) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var sh SubtreeHasher
+				if cached {
+					sh = NewCachedSubtreeHasher(leafHashes, blake)
+				} else {
+					sh = NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+				}
+				_, _ = BuildRangeProof(start, end, sh)
+			}
+		}
+	}
+
+	for _, r := range []struct {
+		name       string
+		start, end int
+	}{
+		{"single", 0, 1},
+		{"half", 0, numLeaves / 2},
+		{"mid", numLeaves / 2, 1 + numLeaves/2},
+		{"full", 0, numLeaves - 1},
+	} {
+		b.Run(r.name+"-cached", benchRange(r.start, r.end, true))
+		b.Run(r.name+"-reader", benchRange(r.start, r.end, false))
+	}
+}
+
+// BenchmarkBuildRangeProofIndexed compares the performance of BuildRangeProof
+// over cached leaf hashes with and without a SubtreeIndex.
+func BenchmarkBuildRangeProofIndexed(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 1 << 16
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	si := NewSubtreeIndex(leafHashes, blake)
+
+	benchRange := func(start, end int, indexed bool) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if indexed {
+					_, _ = BuildRangeProof(start, end, NewCachedSubtreeHasherFromIndex(si))
+				} else {
+					_, _ = BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+				}
+			}
+		}
+	}
+
+	b.Run("single", benchRange(0, 1, false))
+	b.Run("single-indexed", benchRange(0, 1, true))
+	b.Run("mid", benchRange(numLeaves/2, 1+numLeaves/2, false))
+	b.Run("mid-indexed", benchRange(numLeaves/2, 1+numLeaves/2, true))
+}
+
+// BenchmarkBuildRangeProof benchmarks the performance of BuildRangeProof for
+// various proof ranges when a subset of the roots have been precalculated.
+func BenchmarkBuildRangeProofPrecalc(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := testData(1, 1<<22)
+	const leafSize = 64
+	numLeaves := len(leafData) / 64
+	root := bytesRoot(leafData, blake, leafSize)
+	if hex.EncodeToString(root) != testDataRoot {
+		b.Fatal("wrong root for test data")
+	}
+
+	verifyProof := func(start, end int, proof [][]byte) bool {
+		lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+		ok, err := VerifyRangeProof(lh, blake, start, end, proof, root)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return ok
+	}
+
+	// precalculate nodes to depth 4
+	precalcRoots := make([][]byte, 16)
+	precalcSize := numLeaves / 16
+	for i := range precalcRoots {
+		precalcRoots[i] = bytesRoot(leafData[i*precalcSize*leafSize:][:precalcSize*leafSize], blake, leafSize)
+	}
+
+	benchRange := func(start, end int) func(*testing.B) {
+		return func(b *testing.B) {
+			precalc := newPrecalcSubtreeHasher(precalcRoots, precalcSize, blake, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+			b.ReportAllocs()
+			proof, _ := BuildRangeProof(start, end, precalc)
+			if !verifyProof(start, end, proof) {
+				b.Fatal("precalculated roots are incorrect")
+			}
+			for i := 0; i < b.N; i++ {
+				precalc = newPrecalcSubtreeHasher(precalcRoots, precalcSize, blake, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+				_, _ = BuildRangeProof(start, end, precalc)
+			}
+		}
+	}
+
+	b.Run("single", benchRange(numLeaves-1, numLeaves))
+	b.Run("sixteenth", benchRange(numLeaves-numLeaves/16, numLeaves))
+}
+
+// BenchmarkVerifyRange benchmarks the performance of VerifyRangeProof
+// for various proof ranges.
+func BenchmarkVerifyRangeProof(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	leafData := testData(1, 1<<22)
+	const leafSize = 64
+	numLeaves := len(leafData) / 64
+	root := bytesRoot(leafData, blake, leafSize)
+	if hex.EncodeToString(root) != testDataRoot {
+		b.Fatal("wrong root for test data")
+	}
+
+	verifyProof := func(start, end int, proof [][]byte) bool {
+		lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+		ok, err := VerifyRangeProof(lh, blake, start, end, proof, root)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return ok
+	}
+
+	benchRange := func(start, end int) func(*testing.B) {
+		proof, _ := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = verifyProof(start, end, proof)
+			}
+		}
+	}
+
+	b.Run("single", benchRange(0, 1))
+	b.Run("half", benchRange(0, numLeaves/2))
+	b.Run("mid", benchRange(numLeaves/2, 1+numLeaves/2))
+	b.Run("full", benchRange(0, numLeaves-1))
+}
+
+// virtualSubtreeHasher is a SubtreeHasher over a tree of numLeaves leaves
+// that are never materialized; every subtree root is the zero hash. It
+// records any subtree sizes that are not positive.
+type virtualSubtreeHasher struct {
+	pos, numLeaves int
+	badSizes       []int
+}
+
+func (h *virtualSubtreeHasher) NextSubtreeRoot(n int) ([]byte, error) {
+	if n <= 0 {
+		h.badSizes = append(h.badSizes, n)
+	}
+	if h.pos >= h.numLeaves {
+		return nil, io.EOF
+	}
+	h.pos += n
+	return make([]byte, 32), nil
+}
+
+func (h *virtualSubtreeHasher) Skip(n int) error {
+	if n <= 0 {
+		h.badSizes = append(h.badSizes, n)
+	}
+	if h.pos >= h.numLeaves {
+		return io.EOF
+	}
+	h.pos += n
+	return nil
+}
+
+// TestBuildRangeProofHugeTree tests that BuildRangeProof never requests a
+// subtree whose size overflows an int, even for trees near the maximum size.
+func TestBuildRangeProofHugeTree(t *testing.T) {
+	// the largest possible tree; its rightmost subtree has height
+	// bits.UintSize-2
+	numLeaves := int(^uint(0) >> 1)
+	for _, r := range []struct{ start, end int }{
+		{0, 1},
+		{numLeaves / 2, numLeaves/2 + 1},
+		{numLeaves/2 - 1, numLeaves / 2},
+		{numLeaves - 1, numLeaves},
+		{numLeaves/2 + 1, numLeaves - 3},
+	} {
+		sh := &virtualSubtreeHasher{numLeaves: numLeaves}
+		proof, err := BuildRangeProof(r.start, r.end, sh)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(sh.badSizes) != 0 {
+			t.Fatalf("BuildRangeProof(%v, %v) requested illegal subtree sizes: %v", r.start, r.end, sh.badSizes)
+		} else if len(proof) != RangeProofSize(numLeaves, r.start, r.end) {
+			t.Fatalf("BuildRangeProof(%v, %v) produced %v hashes, expected %v", r.start, r.end, len(proof), RangeProofSize(numLeaves, r.start, r.end))
+		}
+	}
+}
+
+// TestVerifyRangeProofTranscript tests recording a range proof verification
+// and replaying the resulting transcript.
+func TestVerifyRangeProofTranscript(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(19 * 64)
+	root := bytesRoot(leafData, blake, 64)
+	const start, end = 5, 11
+	proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*64:end*64]), blake, 64)
+	ok, transcript, err := VerifyRangeProofTranscript(lh, blake, start, end, proof, root)
+	steps := transcript.Steps
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("VerifyRangeProofTranscript failed to verify a valid proof")
+	} else if !bytes.Equal(transcript.Root, root) {
+		t.Fatal("transcript recorded the wrong root")
+	} else if len(steps) != len(proof)+(end-start) {
+		t.Fatalf("expected %v transcript steps, got %v", len(proof)+(end-start), len(steps))
+	}
+	// the leaf hashes are pushed at height 0, after the left-side proof hashes
+	for i := 0; i < end-start; i++ {
+		step := steps[rangeProofSizeLeft(start)+i]
+		if step.Height != 0 || !bytes.Equal(step.Hash, leafSum(blake, leafData[(start+i)*64:][:64])) {
+			t.Fatalf("transcript step for leaf %v is incorrect", start+i)
+		}
+	}
+
+	if ok, err := ReplayTranscript(transcript, root, blake); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("ReplayTranscript failed to reproduce the root")
+	}
+
+	// tampering with the steps or the recorded root should be detected
+	steps[0].Hash[0] ^= 1
+	if ok, err := ReplayTranscript(transcript, root, blake); err == nil || ok {
+		t.Fatal("ReplayTranscript accepted a tampered transcript")
+	}
+	steps[0].Hash[0] ^= 1
+	tampered := Transcript{Steps: steps, Root: append([]byte(nil), root...)}
+	tampered.Root[0] ^= 1
+	if ok, err := ReplayTranscript(tampered, root, blake); err == nil || ok {
+		t.Fatal("ReplayTranscript accepted a transcript with a tampered root")
+	}
+	outOfOrder := Transcript{Steps: append([]TranscriptStep{{Height: 0, Hash: steps[0].Hash}}, steps...), Root: root}
+	if _, err := ReplayTranscript(outOfOrder, root, blake); err == nil {
+		t.Fatal("ReplayTranscript accepted a transcript with out-of-order heights")
+	}
+	if _, err := ReplayTranscript(Transcript{Root: root}, root, blake); err == nil {
+		t.Fatal("ReplayTranscript accepted an empty transcript")
+	}
+
+	// the transcript of an invalid proof should replay to the same (wrong)
+	// root
+	proof[0][0] ^= 1
+	lh = NewReaderLeafHasher(bytes.NewReader(leafData[start*64:end*64]), blake, 64)
+	ok, transcript, err = VerifyRangeProofTranscript(lh, blake, start, end, proof, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("VerifyRangeProofTranscript verified an invalid proof")
+	} else if bytes.Equal(transcript.Root, root) {
+		t.Fatal("transcript of an invalid proof recorded the expected root")
+	} else if ok, err := ReplayTranscript(transcript, root, blake); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("ReplayTranscript accepted the transcript of an invalid proof")
+	} else if ok, err := ReplayTranscript(transcript, transcript.Root, blake); err != nil || !ok {
+		t.Fatal("transcript of an invalid proof does not replay to its recorded root")
+	}
+}
+
+// TestVerifyRangeProofHex tests verifying a range proof against a hex-encoded
+// root.
+func TestVerifyRangeProofHex(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(8 * 64)
+	root := bytesRoot(leafData, blake, 64)
+	proof, err := BuildRangeProof(2, 3, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(rootHex string) (bool, error) {
+		lh := NewReaderLeafHasher(bytes.NewReader(leafData[2*64:3*64]), blake, 64)
+		return VerifyRangeProofHex(lh, blake, 2, 3, proof, rootHex)
+	}
+
+	if ok, err := verify(hex.EncodeToString(root)); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("VerifyRangeProofHex failed to verify a valid proof")
+	}
+	if _, err := verify(hex.EncodeToString(root)[1:]); err == nil {
+		t.Fatal("VerifyRangeProofHex accepted an odd-length root")
+	}
+	if _, err := verify(hex.EncodeToString(root[1:])); err != ErrBadRootLength {
+		t.Fatal("expected ErrBadRootLength, got", err)
+	}
+}
+
+// TestVerifyRangeProofSalted tests that VerifyRangeProofSalted verifies
+// proofs against a salted root, but not against the bare root.
+func TestVerifyRangeProofSalted(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(8 * 64)
+	root := bytesRoot(leafData, blake, 64)
+	proof, err := BuildRangeProof(2, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("merkletree test salt")
+	saltedRoot := blake2b.Sum256(append(append([]byte(nil), root...), salt...))
+	verify := func(saltedRoot, salt []byte) (bool, error) {
+		lh := NewReaderLeafHasher(bytes.NewReader(leafData[2*64:5*64]), blake, 64)
+		return VerifyRangeProofSalted(lh, blake, 2, 5, proof, saltedRoot, salt)
+	}
+
+	if ok, err := verify(saltedRoot[:], salt); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("VerifyRangeProofSalted failed to verify a valid proof")
+	}
+	if ok, _ := verify(root, salt); ok {
+		t.Fatal("VerifyRangeProofSalted verified against the bare root")
+	}
+	if ok, _ := verify(saltedRoot[:], salt[1:]); ok {
+		t.Fatal("VerifyRangeProofSalted verified with the wrong salt")
+	}
+}
+
+// TestVerifyRangeProofCommitted tests that VerifyRangeProofCommitted verifies
+// proofs against a revealed root only if it matches the commitment.
+func TestVerifyRangeProofCommitted(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(8 * 64)
+	root := bytesRoot(leafData, blake, 64)
+	commitment := blake2b.Sum256(root)
+	proof, err := BuildRangeProof(2, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(root []byte) (bool, error) {
+		lh := NewReaderLeafHasher(bytes.NewReader(leafData[2*64:5*64]), blake, 64)
+		return VerifyRangeProofCommitted(lh, blake, 2, 5, proof, root, commitment[:])
+	}
+
+	if ok, err := verify(root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("VerifyRangeProofCommitted failed to verify a valid proof")
+	}
+	tampered := append([]byte(nil), root...)
+	tampered[0] ^= 1
+	if ok, _ := verify(tampered); ok {
+		t.Fatal("VerifyRangeProofCommitted verified a tampered root")
+	}
+}
+
+// TestVerifyRangeProofReaderAt tests verifying proofs with leaves read
+// directly from an io.ReaderAt.
+func TestVerifyRangeProofReaderAt(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(12*64 + 10) // final leaf is short
+	root := bytesRoot(leafData, blake, 64)
+	ra := bytes.NewReader(leafData)
+	for _, r := range [][2]int{{5, 9}, {12, 13}, {0, 13}} {
+		proof, err := BuildRangeProofFromBytes(leafData, 64, r[0], r[1], blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := VerifyRangeProofReaderAt(ra, 64, blake, r[0], r[1], proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("[%v, %v): proof does not verify", r[0], r[1])
+		}
+	}
+
+	// a ReaderAt that ends before the range should produce an error
+	proof, _ := BuildRangeProofFromBytes(leafData, 64, 12, 13, blake)
+	short := bytes.NewReader(leafData[:12*64])
+	if _, err := VerifyRangeProofReaderAt(short, 64, blake, 12, 13, proof, root); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+// TestVerifyingSubtreeHasher tests that a VerifyingSubtreeHasher reports
+// leaves that do not match their expected hashes.
+func TestVerifyingSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 16
+	leafData := fastrand.Bytes(numLeaves * 64)
+	var leafHashes [][]byte
+	for i := 0; i < numLeaves; i++ {
+		leafHashes = append(leafHashes, leafSum(blake, leafData[i*64:][:64]))
+	}
+
+	// uncorrupted data should produce the same proof as usual
+	expected, err := BuildRangeProof(3, 4, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vsh := NewVerifyingSubtreeHasher(NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake), leafHashes)
+	proof, err := BuildRangeProof(3, 4, vsh)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, expected) {
+		t.Fatal("VerifyingSubtreeHasher produced a different proof")
+	}
+	newHash := func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}
+	vsh = NewVerifyingSubtreeHasher(NewReaderSubtreeHasherParallel(bytes.NewReader(leafData), 64, newHash, 2), leafHashes)
+	if proof, err := BuildRangeProof(3, 4, vsh); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, expected) {
+		t.Fatal("VerifyingSubtreeHasher produced a different proof when wrapping a parallel hasher")
+	}
+
+	// corrupt a leaf within a subtree to the right of the range
+	corrupted := append([]byte(nil), leafData...)
+	corrupted[9*64] ^= 1
+	vsh = NewVerifyingSubtreeHasher(NewReaderSubtreeHasher(bytes.NewReader(corrupted), 64, blake), leafHashes)
+	_, err = BuildRangeProof(3, 4, vsh)
+	if !errors.Is(err, ErrLeafMismatch) {
+		t.Fatal("expected ErrLeafMismatch, got", err)
+	} else if err.Error() != "leaf 9: "+ErrLeafMismatch.Error() {
+		t.Fatal("mismatch reported with wrong index:", err)
+	}
+
+	// a corrupted leaf that is skipped should not be reported
+	vsh = NewVerifyingSubtreeHasher(NewReaderSubtreeHasher(bytes.NewReader(corrupted), 64, blake), leafHashes)
+	if _, err := BuildRangeProof(8, 12, vsh); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReaderHasherBuffer tests that hashers created with a caller-provided
+// buffer behave identically to those created with a fresh buffer.
+func TestReaderHasherBuffer(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(10*64 + 17)
+	buf := make([]byte, 64)
+
+	expected, err := BuildRangeProof(3, 7, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := BuildRangeProof(3, 7, NewReaderSubtreeHasherBuffer(bytes.NewReader(leafData), buf, blake))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, expected) {
+		t.Fatal("NewReaderSubtreeHasherBuffer produced a different proof")
+	}
+
+	root := bytesRoot(leafData, blake, 64)
+	lh := NewReaderLeafHasherBuffer(bytes.NewReader(leafData[3*64:7*64]), blake, buf)
+	if ok, err := VerifyRangeProof(lh, blake, 3, 7, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("NewReaderLeafHasherBuffer failed to verify proof")
+	}
+}
+
+// BenchmarkReaderSubtreeHasherBuffer compares creating many short-lived
+// ReaderSubtreeHashers with freshly-allocated and pooled leaf buffers.
+func BenchmarkReaderSubtreeHasherBuffer(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 4096
+	leafData := fastrand.Bytes(4 * leafSize)
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+			if _, err := sh.NextSubtreeRoot(4); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		pool := sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, leafSize)
+				return &buf
+			},
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := pool.Get().(*[]byte)
+			sh := NewReaderSubtreeHasherBuffer(bytes.NewReader(leafData), *buf, blake)
+			if _, err := sh.NextSubtreeRoot(4); err != nil {
+				b.Fatal(err)
+			}
+			pool.Put(buf)
+		}
+	})
+}
+
+// TestDiffProofs tests comparing two proofs with DiffProofs.
+func TestDiffProofs(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(12 * 64)
+	a, err := BuildRangeProof(5, 6, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := DiffProofs(a, a); diffs != nil {
+		t.Fatal("identical proofs should have no differences, got", diffs)
+	}
+
+	// differ at one position
+	b := append([][]byte(nil), a...)
+	b[2] = make([]byte, len(a[2]))
+	diffs := DiffProofs(a, b)
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 difference, got %v", len(diffs))
+	} else if d := diffs[0]; d.Index != 2 || !bytes.Equal(d.A, a[2]) || !bytes.Equal(d.B, b[2]) || d.MissingA || d.MissingB {
+		t.Fatal("difference reported incorrectly:", d)
+	}
+
+	// differ in length
+	diffs = DiffProofs(a[:len(a)-2], a)
+	if len(diffs) != 2 {
+		t.Fatalf("expected 2 differences, got %v", len(diffs))
+	}
+	for i, d := range diffs {
+		if d.Index != len(a)-2+i || !d.MissingA || d.MissingB || d.A != nil || !bytes.Equal(d.B, a[d.Index]) {
+			t.Fatal("length difference reported incorrectly:", d)
+		}
+	}
+	if diffs := DiffProofs(a, nil); len(diffs) != len(a) || !diffs[0].MissingB {
+		t.Fatal("length difference reported incorrectly:", diffs)
+	}
+}
+
+// TestVerifyRangeProofSubtrees tests that VerifyRangeProofSubtrees returns
+// the correct roots of aligned subtrees.
+func TestVerifyRangeProofSubtrees(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	for _, numLeaves := range []int{1, 7, 8, 13} {
+		leafData := fastrand.Bytes(numLeaves * leafSize)
+		root := bytesRoot(leafData, blake, leafSize)
+		for start := 0; start < numLeaves; start++ {
+			for end := start + 1; end <= numLeaves; end++ {
+				proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+				if err != nil {
+					t.Fatal(err)
+				}
+				lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*leafSize:end*leafSize]), blake, leafSize)
+				ok, roots, err := VerifyRangeProofSubtrees(lh, blake, start, end, proof, root, numLeaves)
+				if err != nil {
+					t.Fatal(err)
+				} else if !ok {
+					t.Fatal("VerifyRangeProofSubtrees failed to verify a valid proof")
+				}
+				for span, sum := range roots {
+					if span.Size&(span.Size-1) != 0 || span.Offset%span.Size != 0 || span.Offset+span.Size > numLeaves {
+						t.Fatalf("%v-leaf tree, range [%v, %v): span %v is not an aligned subtree", numLeaves, start, end, span)
+					}
+					data := leafData[span.Offset*leafSize : (span.Offset+span.Size)*leafSize]
+					if !bytes.Equal(sum, bytesRoot(data, blake, leafSize)) {
+						t.Fatalf("%v-leaf tree, range [%v, %v): wrong root for span %v", numLeaves, start, end, span)
+					}
+				}
+				// every leaf in the range should be present
+				for i := start; i < end; i++ {
+					if _, ok := roots[SubtreeSpan{Offset: i, Size: 1}]; !ok {
+						t.Fatalf("%v-leaf tree, range [%v, %v): missing leaf %v", numLeaves, start, end, i)
+					}
+				}
+				// as should every left-side proof subtree
+				for _, span := range CoveringSubtrees(0, start) {
+					if _, ok := roots[span]; !ok {
+						t.Fatalf("%v-leaf tree, range [%v, %v): missing span %v", numLeaves, start, end, span)
+					}
+				}
+			}
+		}
+	}
+
+	// an invalid proof should return no roots
+	leafData := fastrand.Bytes(8 * leafSize)
+	root := bytesRoot(leafData, blake, leafSize)
+	proof, err := BuildRangeProof(2, 5, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof[0][0] ^= 1
+	lh := NewReaderLeafHasher(bytes.NewReader(leafData[2*leafSize:5*leafSize]), blake, leafSize)
+	if ok, roots, err := VerifyRangeProofSubtrees(lh, blake, 2, 5, proof, root, 8); err != nil {
+		t.Fatal(err)
+	} else if ok || roots != nil {
+		t.Fatal("VerifyRangeProofSubtrees accepted an invalid proof")
+	}
+}
+
+// TestReaderAtSubtreeHasher tests that a ReaderAtSubtreeHasher produces the
+// same proofs as a ReaderSubtreeHasher, for various block sizes.
+func TestReaderAtSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const numLeaves = 13
+	leafData := fastrand.Bytes(leafSize*(numLeaves-1) + 10)
+	for _, blockSize := range []int{0, leafSize, 3*leafSize + 5, 4 * leafSize, DefaultReadAtBlockSize} {
+		for start := 0; start < numLeaves; start++ {
+			for end := start + 1; end <= numLeaves; end++ {
+				proof, err := BuildRangeProof(start, end, NewReaderAtSubtreeHasherBlockSize(bytes.NewReader(leafData), leafSize, blockSize, blake))
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, blake))
+				if err != nil {
+					t.Fatal(err)
+				} else if !reflect.DeepEqual(proof, expected) {
+					t.Fatalf("block size %v: proof for range %v-%v does not match", blockSize, start, end)
+				}
+			}
+		}
+	}
+
+	// skipping past the end should be reported as truncation, even if the
+	// final leaf is partial
+	rsh := NewReaderAtSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	if err := rsh.Skip(numLeaves); err != nil {
+		t.Fatal(err)
+	} else if _, err := rsh.NextSubtreeRoot(1); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+	rsh = NewReaderAtSubtreeHasher(bytes.NewReader(leafData), leafSize, blake)
+	if err := rsh.Skip(numLeaves + 1); !IsTruncated(err) {
+		t.Fatal("expected truncation, got", err)
+	}
+}
+
+// latencyReaderAt wraps an io.ReaderAt, simulating a fixed latency for each
+// call to ReadAt, as with a page fault on a memory-mapped file.
+type latencyReaderAt struct {
+	r       io.ReaderAt
+	latency time.Duration
+}
+
+func (r latencyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for start := time.Now(); time.Since(start) < r.latency; {
+	}
+	return r.r.ReadAt(p, off)
+}
+
+// BenchmarkReaderAtSubtreeHasher compares reading leaves one at a time with
+// reading them in blocks, over a ReaderAt with simulated per-read latency.
+func BenchmarkReaderAtSubtreeHasher(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	leafData := fastrand.Bytes(1 << 20)
+	numLeaves := len(leafData) / leafSize
+	r := latencyReaderAt{bytes.NewReader(leafData), time.Microsecond}
+
+	benchBlockSize := func(blockSize int) func(*testing.B) {
+		return func(b *testing.B) {
+			b.SetBytes(int64(len(leafData)))
+			for i := 0; i < b.N; i++ {
+				sh := NewReaderAtSubtreeHasherBlockSize(r, leafSize, blockSize, blake)
+				if _, err := BuildRangeProof(numLeaves/2, numLeaves/2+1, sh); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	b.Run("leaf", benchBlockSize(leafSize))
+	b.Run("block", benchBlockSize(DefaultReadAtBlockSize))
+}
+
+// TestPackProof tests encoding and decoding proofs with PackProof and
+// UnpackProof.
+func TestPackProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(12 * 64)
+	proof, err := BuildRangeProof(5, 6, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][][]byte{proof, nil, proof[:1]} {
+		data, err := PackProof(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacked, err := UnpackProof(data)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(unpacked) != len(p) || (len(p) > 0 && !reflect.DeepEqual(unpacked, p)) {
+			t.Fatalf("proof of %v hashes did not survive round trip", len(p))
+		}
+	}
+
+	// proofs with hashes of differing or zero length cannot be packed
+	for _, p := range [][][]byte{
+		{proof[0], proof[1][1:]},
+		{{}, {}},
+	} {
+		if _, err := PackProof(p); err != ErrBadHashLength {
+			t.Errorf("expected ErrBadHashLength, got %v", err)
+		}
+	}
+
+	data, _ := PackProof(proof)
+	empty, _ := PackProof(nil)
+	bad := [][]byte{
+		nil,
+		data[:len(data)-1],
+		append(data[:len(data):len(data)], 0),
+		append(empty, 0),
+		{2, 0},
+		{2, 32},
+		{1, 0x80},
+	}
+	for _, b := range bad {
+		if _, err := UnpackProof(b); err == nil {
+			t.Errorf("UnpackProof accepted malformed data %x", b)
+		}
+	}
+}
+
+// TestReaderSubtreeHasherParallel tests that a ReaderSubtreeHasher hashing
+// leaves in parallel produces the same roots and proofs as one hashing them
+// serially.
+func TestReaderSubtreeHasherParallel(t *testing.T) {
+	newHash := func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}
+	const leafSize = 16
+	numLeaves := 3*parallelBatchLeaves + 100
+	leafData := fastrand.Bytes(numLeaves*leafSize - 7)
+
+	for _, subtreeSize := range []int{1, parallelMinLeaves - 1, parallelMinLeaves, parallelBatchLeaves, 1 << 13, 1 << 14} {
+		for _, workers := range []int{1, 3, 0} {
+			serial := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, newHash())
+			parallel := NewReaderSubtreeHasherParallel(bytes.NewReader(leafData), leafSize, newHash, workers)
+			for {
+				expected, err1 := serial.NextSubtreeRoot(subtreeSize)
+				root, err2 := parallel.NextSubtreeRoot(subtreeSize)
+				if err1 != err2 {
+					t.Fatalf("subtree size %v: errors differ: %v, %v", subtreeSize, err1, err2)
+				} else if !bytes.Equal(root, expected) {
+					t.Fatalf("subtree size %v, %v workers: roots differ", subtreeSize, workers)
+				} else if err1 == io.EOF {
+					break
+				}
+			}
+		}
+	}
+
+	for _, r := range [][2]int{{0, 1}, {1000, 1001}, {parallelBatchLeaves + 5, numLeaves - 3}, {numLeaves - 1, numLeaves}} {
+		expected, err := BuildRangeProof(r[0], r[1], NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, newHash()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := BuildRangeProof(r[0], r[1], NewReaderSubtreeHasherParallel(bytes.NewReader(leafData), leafSize, newHash, 4))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, expected) {
+			t.Fatalf("proofs for range %v-%v differ", r[0], r[1])
+		}
+	}
+}
+
+// BenchmarkReaderSubtreeHasherParallel compares hashing a large subtree
+// serially and in parallel.
+func BenchmarkReaderSubtreeHasherParallel(b *testing.B) {
+	newHash := func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}
+	const leafSize = 1024
+	leafData := fastrand.Bytes(leafSize << 14)
+
+	b.Run("serial", func(b *testing.B) {
+		b.SetBytes(int64(len(leafData)))
+		for i := 0; i < b.N; i++ {
+			sh := NewReaderSubtreeHasher(bytes.NewReader(leafData), leafSize, newHash())
+			if _, err := sh.NextSubtreeRoot(1 << 14); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.SetBytes(int64(len(leafData)))
+		for i := 0; i < b.N; i++ {
+			sh := NewReaderSubtreeHasherParallel(bytes.NewReader(leafData), leafSize, newHash, 0)
+			if _, err := sh.NextSubtreeRoot(1 << 14); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestVerifyRangeProofSplit tests verifying a proof split into its left-side
+// and right-side hashes.
+func TestVerifyRangeProofSplit(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 27
+	leafData := fastrand.Bytes(numLeaves * 64)
+	root := bytesRoot(leafData, blake, 64)
+	for _, r := range [][2]int{{0, 1}, {5, 11}, {11, 27}, {26, 27}} {
+		start, end := r[0], r[1]
+		proof, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		split := bits.OnesCount(uint(start))
+		verify := func(left, right [][]byte) (bool, error) {
+			lh := NewReaderLeafHasher(bytes.NewReader(leafData[start*64:end*64]), blake, 64)
+			return VerifyRangeProofSplit(lh, blake, start, end, left, right, root)
+		}
+		if ok, err := verify(proof[:split], proof[split:]); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify split proof for range %v-%v", start, end)
+		}
+		// splitting at the wrong boundary should be rejected
+		if len(proof) > 0 {
+			wrong := split + 1
+			if split == len(proof) {
+				wrong = split - 1
+			}
+			if ok, err := verify(proof[:wrong], proof[wrong:]); err == nil || ok {
+				t.Fatalf("accepted proof for range %v-%v split at the wrong boundary", start, end)
+			}
+		}
+	}
+}
+
+// TestPaddedSubtreeHasher tests that a PaddedSubtreeHasher produces the same
+// proofs as a tree containing the padding leaves explicitly.
+func TestPaddedSubtreeHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const dataLeaves, paddedLeaves = 5, 1 << 3
+	data := fastrand.Bytes(dataLeaves * leafSize)
+	padded := append(append([]byte(nil), data...), make([]byte, (paddedLeaves-dataLeaves)*leafSize)...)
+	root := bytesRoot(padded, blake, leafSize)
+
+	for start := 0; start < paddedLeaves; start++ {
+		for end := start + 1; end <= paddedLeaves; end++ {
+			psh := NewPaddedSubtreeHasher(NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, blake), blake, leafSize, dataLeaves, paddedLeaves)
+			proof, err := BuildRangeProof(start, end, psh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(bytes.NewReader(padded), leafSize, blake))
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(proof, expected) {
+				t.Fatalf("proofs for range %v-%v differ", start, end)
+			}
+		}
+	}
+
+	// every single-leaf proof should contain exactly 3 hashes
+	for i := 0; i < dataLeaves; i++ {
+		psh := NewPaddedSubtreeHasher(NewReaderSubtreeHasher(bytes.NewReader(data), leafSize, blake), blake, leafSize, dataLeaves, paddedLeaves)
+		proof, err := BuildRangeProof(i, i+1, psh)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(proof) != 3 {
+			t.Fatalf("expected proof for leaf %v to contain 3 hashes, got %v", i, len(proof))
+		}
+		lh := NewReaderLeafHasher(bytes.NewReader(data[i*leafSize:][:leafSize]), blake, leafSize)
+		if ok, err := VerifyPaddedRangeProof(lh, blake, leafSize, dataLeaves, paddedLeaves, i, i+1, proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify proof for leaf %v", i)
+		}
+	}
+
+	// if the underlying hasher has fewer leaves than claimed, and the
+	// shortfall affects a subtree straddling the end of the data, the tree is
+	// truncated
+	psh := NewPaddedSubtreeHasher(NewReaderSubtreeHasher(bytes.NewReader(data[:2*leafSize]), leafSize, blake), blake, leafSize, dataLeaves, paddedLeaves)
+	if _, err := BuildRangeProof(7, 8, psh); !IsTruncated(err) {
+		t.Fatal("expected truncation, got", err)
+	}
+}
+
+// TestSubtreeHasherFromLeafHasher tests that a SubtreeHasher adapted from a
+// LeafHasher produces the same proofs as a CachedSubtreeHasher.
+func TestSubtreeHasherFromLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 19
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, []byte{byte(i)})
+	}
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			expected, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sh := SubtreeHasherFromLeafHasher(NewCachedLeafHasher(leafHashes), blake)
+			proof, err := BuildRangeProof(start, end, sh)
+			if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(proof, expected) {
+				t.Fatalf("proofs for range %v-%v differ", start, end)
+			}
+		}
+	}
+
+	sh := SubtreeHasherFromLeafHasher(NewCachedLeafHasher(leafHashes), blake)
+	if err := sh.Skip(numLeaves + 1); !IsTruncated(err) {
+		t.Fatal("expected truncation, got", err)
+	}
+	sh = SubtreeHasherFromLeafHasher(NewCachedLeafHasher(leafHashes), blake)
+	if err := sh.Skip(numLeaves); err != nil {
+		t.Fatal(err)
+	} else if _, err := sh.NextSubtreeRoot(1); !IsEndOfTree(err) {
+		t.Fatal("expected end of tree, got", err)
+	}
+}
+
+// BenchmarkCachedSubtreeHasher benchmarks building a worst-case proof with a
+// CachedSubtreeHasher, which requires hashing every leaf.
+func BenchmarkCachedSubtreeHasher(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 1 << 16
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sh := NewCachedSubtreeHasher(leafHashes, blake)
+		if _, err := BuildRangeProof(numLeaves/2-1, numLeaves/2+1, sh); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestVerifyRangeProofFastReject tests that structurally malformed proofs are
+// rejected without consuming any leaf hashes.
+func TestVerifyRangeProofFastReject(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	hash := make([]byte, blake.Size())
+	const start, end = 7, 1 << 30
+	numLeft := bits.OnesCount(start)
+	proofs := map[string][][]byte{
+		"too few left-side hashes": make([][]byte, numLeft-1),
+		"too many hashes":          make([][]byte, numLeft+maxSubtreeHeight+1),
+		"bad hash length":          {hash, hash, hash[1:]},
+	}
+	for name, proof := range proofs {
+		for i := range proof {
+			if proof[i] == nil {
+				proof[i] = hash
+			}
+		}
+		clh := &countingLeafHasher{leafHash: hash}
+		ok, err := VerifyRangeProof(clh, blake, start, end, proof, hash)
+		if ok {
+			t.Errorf("%v: VerifyRangeProof accepted a malformed proof", name)
+		} else if clh.n != 0 {
+			t.Errorf("%v: VerifyRangeProof consumed %v leaf hashes", name, clh.n)
+		}
+		if name == "bad hash length" && err != ErrBadHashLength {
+			t.Errorf("%v: expected ErrBadHashLength, got %v", name, err)
+		} else if name != "bad hash length" && err != nil {
+			t.Errorf("%v: expected no error, got %v", name, err)
+		}
+		if _, err := ReconstructRoot(start, end, proof, nil, blake); err == nil {
+			t.Errorf("%v: ReconstructRoot accepted a malformed proof", name)
+		}
+	}
+}
+
+// TestInlineRangeProof tests that InlineRangeProofs verify, including those
+// whose final leaf is short, and that they survive a marshal round trip.
+func TestInlineRangeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	data := fastrand.Bytes(leafSize*13 + 10) // final leaf is short
+	numLeaves := 14
+	root := bytesRoot(data, blake, leafSize)
+
+	for _, r := range [][2]int{{0, 1}, {3, 7}, {13, 14}, {5, 14}, {0, 14}} {
+		start, end := r[0], r[1]
+		proof, err := BuildRangeProofFromBytes(data, leafSize, start, end, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataEnd := end * leafSize
+		if end == numLeaves {
+			dataEnd = len(data)
+		}
+		p := InlineRangeProof{
+			Start:    start,
+			End:      end,
+			LeafSize: leafSize,
+			Data:     data[start*leafSize : dataEnd],
+			Proof:    proof,
+		}
+		b, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p2 InlineRangeProof
+		if err := p2.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(p, p2) && !(len(p.Proof) == 0 && len(p2.Proof) == 0) {
+			t.Fatalf("[%v, %v): round trip produced a different proof", start, end)
+		}
+		if ok, err := p2.Verify(root, blake); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("[%v, %v): inline proof does not verify", start, end)
+		}
+
+		// corrupt the leaf data
+		p2.Data[0] ^= 1
+		if ok, _ := p2.Verify(root, blake); ok {
+			t.Fatalf("[%v, %v): corrupted inline proof verified", start, end)
+		}
+		// append an extra leaf of data
+		p2.Data[0] ^= 1
+		p2.Data = append(p2.Data, make([]byte, leafSize)...)
+		if _, err := p2.Verify(root, blake); err == nil {
+			t.Fatalf("[%v, %v): expected error for excess leaf data", start, end)
+		}
+
+		// truncated encodings should be rejected
+		if err := p2.UnmarshalBinary(b[:len(b)-1]); err == nil {
+			t.Fatalf("[%v, %v): expected error for truncated encoding", start, end)
+		}
+	}
+}
+
+// countingAllocator is a HashAllocator that carves hashes out of a single
+// buffer, counting its calls.
+type countingAllocator struct {
+	buf   []byte
+	calls int
+}
+
+func (ca *countingAllocator) Alloc(size int) []byte {
+	ca.calls++
+	b := ca.buf[:size:size]
+	ca.buf = ca.buf[size:]
+	return b
+}
+
+// TestBuildRangeProofAlloc tests that BuildRangeProofAlloc obtains each proof
+// hash from its HashAllocator.
+func TestBuildRangeProofAlloc(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(13 * 64)
+	for _, r := range [][2]int{{0, 1}, {3, 5}, {5, 13}, {0, 13}} {
+		expected, err := BuildRangeProof(r[0], r[1], NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		arena := make([]byte, 64*blake.Size())
+		ca := &countingAllocator{buf: arena}
+		proof, err := BuildRangeProofAlloc(r[0], r[1], NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake), ca)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, expected) {
+			t.Fatalf("[%v, %v): BuildRangeProofAlloc produced a different proof", r[0], r[1])
+		} else if ca.calls != len(proof) {
+			t.Fatalf("[%v, %v): expected %v allocations, got %v", r[0], r[1], len(proof), ca.calls)
+		}
+		// the proof hashes should reside in the arena
+		for i := range proof {
+			if &proof[i][0] != &arena[i*blake.Size()] {
+				t.Fatalf("[%v, %v): proof hash %v was not allocated from the arena", r[0], r[1], i)
+			}
+		}
+	}
+}
+
+// TestBoundaryHash tests that BoundaryHash returns the hash that a proof for
+// [start, mid) contains for the leaves of [mid, end).
+func TestBoundaryHash(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(16 * 64)
+	for _, r := range [][3]int{{0, 4, 8}, {0, 8, 16}, {3, 4, 8}, {1, 2, 16}, {5, 6, 9}, {2, 12, 16}} {
+		start, mid, end := r[0], r[1], r[2]
+		sh := NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake)
+		boundary, err := BoundaryHash(start, mid, end, sh, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := mid & -mid
+		if exp := bytesRoot(leafData[mid*64:(mid+size)*64], blake, 64); !bytes.Equal(boundary, exp) {
+			t.Fatalf("[%v, %v, %v): wrong boundary hash", start, mid, end)
+		}
+		// the boundary hash should appear in the proof for [start, mid), but
+		// not in the proof for [start, end)
+		left, _ := BuildRangeProofFromBytes(leafData, 64, start, mid, blake)
+		if !bytes.Equal(left[rangeProofSizeLeft(start)], boundary) {
+			t.Fatalf("[%v, %v, %v): boundary hash is not in proof for left range", start, mid, end)
+		}
+		merged, _ := BuildRangeProofFromBytes(leafData, 64, start, end, blake)
+		for _, p := range merged {
+			if bytes.Equal(p, boundary) {
+				t.Fatalf("[%v, %v, %v): boundary hash is in merged proof", start, mid, end)
+			}
+		}
+	}
+
+	// a boundary subtree that extends past end is rejected
+	sh := NewReaderSubtreeHasher(bytes.NewReader(leafData), 64, blake)
+	if _, err := BoundaryHash(0, 8, 12, sh, blake); err == nil {
+		t.Fatal("expected error for boundary subtree extending past end")
+	}
+}
+
+// TestVerifyRangeProofFetch tests verifying proofs with leaves fetched on
+// demand from a callback.
+func TestVerifyRangeProofFetch(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(16 * 64)
+	root := bytesRoot(leafData, blake, 64)
+	leaves := make(map[int][]byte)
+	for i := 0; i < 16; i++ {
+		leaves[i] = leafData[i*64:][:64]
+	}
+	proof, err := BuildRangeProofFromBytes(leafData, 64, 3, 11, blake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetched []int
+	fetch := func(index int) ([]byte, error) {
+		fetched = append(fetched, index)
+		leaf, ok := leaves[index]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return leaf, nil
+	}
+	if ok, err := VerifyRangeProofFetch(fetch, blake, 3, 11, proof, root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("VerifyRangeProofFetch failed to verify a valid proof")
+	} else if !reflect.DeepEqual(fetched, RequiredLeaves(3, 11)) {
+		t.Fatal("leaves were fetched in the wrong order:", fetched)
+	}
+
+	// an error mid-range should be propagated
+	errFetch := errors.New("fetch failed")
+	failing := func(index int) ([]byte, error) {
+		if index == 7 {
+			return nil, errFetch
+		}
+		return leaves[index], nil
+	}
+	if _, err := VerifyRangeProofFetch(failing, blake, 3, 11, proof, root); !errors.Is(err, errFetch) {
+		t.Fatal("expected fetch error to be propagated, got", err)
+	}
+}
+
+// TestVerifyRangeProofStackDepth tests that the subtree stack used to verify
+// a proof for a large range stays logarithmic in the size of the range, i.e.
+// that completed subtrees are folded as soon as they are pushed.
+func TestVerifyRangeProofStackDepth(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	blake, _ := blake2b.New256(nil)
+	const start, end = 1, 1 << 18
+	leafHash := leafSum(blake, []byte("leaf"))
+
+	// push the proof hashes and leaf hashes in the same order as
+	// VerifyRangeProof, tracking the depth of the stack
+	tree := New(blake)
+	maxDepth := 0
+	push := func(height int, sum []byte) {
+		if err := tree.PushSubTree(height, sum); err != nil {
+			t.Fatal(err)
+		}
+		depth := 0
+		for s := tree.head; s != nil; s = s.next {
+			depth++
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	push(0, leafHash) // left-side proof hash for leaf 0
+	for i := start; i < end; i++ {
+		push(0, leafHash)
+	}
+	if limit := bits.Len(end); maxDepth > limit {
+		t.Fatalf("stack reached depth %v; expected at most %v", maxDepth, limit)
+	}
+
+	// the verifier should produce the same root
+	leafHashes := make([][]byte, end-start)
+	for i := range leafHashes {
+		leafHashes[i] = leafHash
+	}
+	proof := [][]byte{leafHash}
+	if ok, err := VerifyRangeProof(NewCachedLeafHasher(leafHashes), blake, start, end, proof, tree.Root()); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("VerifyRangeProof did not reproduce the root")
+	}
+}
+
+// TestProofsShareRoot tests that ProofsShareRoot reports whether two proofs
+// imply the same root.
+func TestProofsShareRoot(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	dataA := fastrand.Bytes(16 * 64)
+	dataB := append([]byte(nil), dataA...)
+	dataB[15*64] ^= 1 // differs only in the last leaf
+	inputs := func(data []byte, start, end int) ProofInputs {
+		proof, err := BuildRangeProofFromBytes(data, 64, start, end, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ProofInputs{
+			Start:  start,
+			End:    end,
+			Proof:  proof,
+			Leaves: NewReaderLeafHasher(bytes.NewReader(data[start*64:end*64]), blake, 64),
+			Hash:   blake,
+		}
+	}
+
+	if ok, err := ProofsShareRoot(inputs(dataA, 2, 5), inputs(dataA, 9, 16)); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("proofs for the same tree do not share a root")
+	}
+	if ok, err := ProofsShareRoot(inputs(dataA, 2, 5), inputs(dataB, 9, 16)); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("proofs for different trees share a root")
+	}
+}
+
+// TestRangeProofBuilder tests that a RangeProofBuilder produces the same
+// proofs as BuildRangeProof, and reuses the subtree roots it computes.
+func TestRangeProofBuilder(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(100*64 + 10)
+	b := NewRangeProofBuilder(leafData, 64, blake)
+	for i := 0; i < 50; i++ {
+		start := fastrand.Intn(101)
+		end := start + fastrand.Intn(101-start) + 1
+		expected, err := BuildRangeProofFromBytes(leafData, 64, start, end, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := b.BuildRangeProof(start, end)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof, expected) {
+			t.Fatalf("[%v, %v): RangeProofBuilder produced a different proof", start, end)
+		}
+	}
+
+	// building a proof for a range whose subtrees have all been hashed
+	// should reuse the cached roots rather than rehashing them
+	b = NewRangeProofBuilder(leafData, 64, blake)
+	if _, err := b.BuildRangeProof(3, 5); err != nil {
+		t.Fatal(err)
+	}
+	numRoots := len(b.roots)
+	for span := range b.roots {
+		b.roots[span] = []byte("cached")
+	}
+	proof, err := b.BuildRangeProof(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(b.roots) != numRoots {
+		t.Fatalf("expected %v cached roots, got %v", numRoots, len(b.roots))
+	}
+	for i := range proof {
+		if string(proof[i]) != "cached" {
+			t.Fatalf("proof hash %v was not taken from the cache", i)
+		}
+	}
+}
+
+// BenchmarkRangeProofBuilder benchmarks building 100 proofs for random,
+// overlapping ranges of a 4 MiB sector, with and without a RangeProofBuilder.
+func BenchmarkRangeProofBuilder(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 1 << 16
+	leafData := testData(1, numLeaves*64)
+	ranges := make([][2]int, 100)
+	for i := range ranges {
+		start := fastrand.Intn(numLeaves)
+		ranges[i] = [2]int{start, start + fastrand.Intn(numLeaves-start) + 1}
+	}
+
+	b.Run("independent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, r := range ranges {
+				if _, err := BuildRangeProofFromBytes(leafData, 64, r[0], r[1], blake); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("builder", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pb := NewRangeProofBuilder(leafData, 64, blake)
+			for _, r := range ranges {
+				if _, err := pb.BuildRangeProof(r[0], r[1]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// TestVerifyRangeProofFlat tests verifying proofs with leaf hashes supplied
+// in a single flat buffer.
+func TestVerifyRangeProofFlat(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafData := fastrand.Bytes(13 * 64)
+	root := bytesRoot(leafData, blake, 64)
+	for _, r := range [][2]int{{0, 1}, {3, 7}, {12, 13}, {0, 13}} {
+		proof, err := BuildRangeProofFromBytes(leafData, 64, r[0], r[1], blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var flat []byte
+		for i := r[0]; i < r[1]; i++ {
+			flat = append(flat, leafSum(blake, leafData[i*64:][:64])...)
+		}
+		if ok, err := VerifyRangeProofFlat(flat, blake, r[0], r[1], proof, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("[%v, %v): proof does not verify", r[0], r[1])
+		}
+		flat[0] ^= 1
+		if ok, _ := VerifyRangeProofFlat(flat, blake, r[0], r[1], proof, root); ok {
+			t.Fatalf("[%v, %v): corrupted leaf hashes verified", r[0], r[1])
+		}
+		if _, err := VerifyRangeProofFlat(flat[1:], blake, r[0], r[1], proof, root); err == nil {
+			t.Fatalf("[%v, %v): expected error for wrong buffer length", r[0], r[1])
+		}
+	}
+}
+
+// BenchmarkVerifyRangeProofFlat compares verifying a proof with leaf hashes
+// supplied as a flat buffer and as a [][]byte.
+func BenchmarkVerifyRangeProofFlat(b *testing.B) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 1 << 12
+	const start, end = 100, numLeaves - 100
+	leafData := fastrand.Bytes(numLeaves * 64)
+	root := bytesRoot(leafData, blake, 64)
+	proof, err := BuildRangeProofFromBytes(leafData, 64, start, end, blake)
+	if err != nil {
+		b.Fatal(err)
+	}
+	leafHashes := make([][]byte, end-start)
+	var flat []byte
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, leafData[(start+i)*64:][:64])
+		flat = append(flat, leafHashes[i]...)
+	}
+
+	b.Run("flat", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if ok, err := VerifyRangeProofFlat(flat, blake, start, end, proof, root); !ok || err != nil {
+				b.Fatal(ok, err)
+			}
+		}
+	})
+	b.Run("slices", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if ok, err := VerifyRangeProof(NewCachedLeafHasher(leafHashes), blake, start, end, proof, root); !ok || err != nil {
+				b.Fatal(ok, err)
+			}
+		}
+	})
+}
+
+// TestSeparateLeafHash tests building and verifying proofs for a tree whose
+// leaves and interior nodes are hashed with different algorithms.
+func TestSeparateLeafHash(t *testing.T) {
+	leafHash, _ := blake2b.New256(nil)
+	nodeHash, _ := blake2b.New512(nil)
+	const numLeaves = 13
+	leafData := fastrand.Bytes(numLeaves*64 - 7)
+
+	tree := NewWithLeafHash(leafHash, nodeHash)
+	if err := tree.ReadAll(bytes.NewReader(leafData), 64); err != nil {
+		t.Fatal(err)
+	}
+	root := tree.Root()
+	if len(root) != nodeHash.Size() {
+		t.Fatal("root has wrong size:", len(root))
+	}
+	rsh := NewReaderSubtreeHasherWithLeafHash(bytes.NewReader(leafData), 64, leafHash, nodeHash)
+	if shRoot, err := rsh.NextSubtreeRoot(numLeaves); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(shRoot, root) {
+		t.Fatal("ReaderSubtreeHasher root does not match Tree root")
+	}
+
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		end := (i + 1) * 64
+		if end > len(leafData) {
+			end = len(leafData)
+		}
+		leafHashes[i] = leafSum(leafHash, leafData[i*64:end])
+	}
+	builder := NewRangeProofBuilderWithLeafHash(leafData, 64, leafHash, nodeHash)
+	for _, r := range [][2]int{{0, 1}, {3, 7}, {0, 12}, {12, 13}, {0, 13}} {
+		rsh := NewReaderSubtreeHasherWithLeafHash(bytes.NewReader(leafData), 64, leafHash, nodeHash)
+		proof, err := BuildRangeProof(r[0], r[1], rsh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every SubtreeHasher that supports separate leaf hashes should
+		// produce the same proof
+		remaining := leafData
+		next := func() ([]byte, bool, error) {
+			if len(remaining) == 0 {
+				return nil, false, nil
+			}
+			leaf := remaining
+			if len(leaf) > 64 {
+				leaf = leaf[:64]
+			}
+			remaining = remaining[len(leaf):]
+			return leaf, true, nil
+		}
+		newLeafHash := func() hash.Hash { h, _ := blake2b.New256(nil); return h }
+		newNodeHash := func() hash.Hash { h, _ := blake2b.New512(nil); return h }
+		for name, sh := range map[string]SubtreeHasher{
+			"ReaderAt": NewReaderAtSubtreeHasherWithLeafHash(bytes.NewReader(leafData), 64, leafHash, nodeHash),
+			"Iterator": NewIteratorSubtreeHasherWithLeafHash(next, 64, leafHash, nodeHash),
+			"Parallel": NewReaderSubtreeHasherParallelWithLeafHash(bytes.NewReader(leafData), 64, newLeafHash, newNodeHash, 2),
+			"Cached":   NewCachedSubtreeHasher(leafHashes, nodeHash),
+		} {
+			if proof2, err := BuildRangeProof(r[0], r[1], sh); err != nil {
+				t.Fatal(name, err)
+			} else if !reflect.DeepEqual(proof2, proof) {
+				t.Fatalf("[%v, %v): %v proof does not match", r[0], r[1], name)
+			}
+		}
+		if proof2, err := builder.BuildRangeProof(r[0], r[1]); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(proof2, proof) {
+			t.Fatalf("[%v, %v): RangeProofBuilder proof does not match", r[0], r[1])
+		}
+
+		end := r[1] * 64
+		if end > len(leafData) {
+			end = len(leafData)
+		}
+		verify := func(root []byte) (bool, error) {
+			lh := NewReaderLeafHasher(bytes.NewReader(leafData[r[0]*64:end]), leafHash, 64)
+			return VerifyRangeProofWithLeafHash(lh, leafHash, nodeHash, r[0], r[1], proof, root)
+		}
+		if ok, err := verify(root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("[%v, %v): proof does not verify", r[0], r[1])
+		}
+		tampered := append([]byte(nil), root...)
+		tampered[0] ^= 1
+		if ok, _ := verify(tampered); ok {
+			t.Fatalf("[%v, %v): proof verified against the wrong root", r[0], r[1])
+		}
+	}
+
+	// a hash covering a single leaf must be the size of the leaf hash, and
+	// every other hash the size of the node hash. In a proof for [3, 7), the
+	// left-side hashes cover [0, 2) and [2, 3), and the right-side hashes
+	// cover [7, 8) and [8, 13). Since the final subtree could have been
+	// truncated to a single leaf, its hash may have either size.
+	proof, err := BuildRangeProof(3, 7, NewCachedSubtreeHasher(leafHashes, nodeHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range proof {
+		bad := append([][]byte(nil), proof...)
+		if len(proof[i]) == leafHash.Size() {
+			bad[i] = make([]byte, nodeHash.Size())
+		} else {
+			bad[i] = make([]byte, leafHash.Size())
+		}
+		lh := NewCachedLeafHasher(leafHashes[3:7])
+		ok, err := VerifyRangeProofWithLeafHash(lh, leafHash, nodeHash, 3, 7, bad, root)
+		if i == len(proof)-1 {
+			if ok || err != nil {
+				t.Errorf("proof hash %v: expected verification to fail without error, got %v, %v", i, ok, err)
+			}
+		} else if err != ErrBadHashLength {
+			t.Errorf("proof hash %v: expected ErrBadHashLength, got %v", i, err)
+		}
+	}
+
+	// using the same hash for both should match New
+	h := sha256.New()
+	tree1, tree2 := New(h), NewWithLeafHash(h, h)
+	tree1.ReadAll(bytes.NewReader(leafData), 64)
+	tree2.ReadAll(bytes.NewReader(leafData), 64)
+	if !bytes.Equal(tree1.Root(), tree2.Root()) {
+		t.Fatal("NewWithLeafHash(h, h) does not match New(h)")
+	}
+}
+
+// TestVerifyExclusion tests that VerifyExclusion accepts leaves just outside
+// of a proven range, and rejects leaves within it.
+func TestVerifyExclusion(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves, start, end = 16, 5, 11
+	leafData := fastrand.Bytes(numLeaves * 64)
+	root := bytesRoot(leafData, blake, 64)
+	rangeProof, err := BuildRangeProofFromBytes(leafData, 64, start, end, blake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(index int, root []byte) (bool, error) {
+		leafProof, err := BuildRangeProofFromBytes(leafData, 64, index, index+1, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf := NewReaderLeafHasher(bytes.NewReader(leafData[index*64:][:64]), blake, 64)
+		rangeLeaves := NewReaderLeafHasher(bytes.NewReader(leafData[start*64:end*64]), blake, 64)
+		return VerifyExclusion(blake, index, leaf, leafProof, start, end, rangeLeaves, rangeProof, root)
+	}
+
+	for _, index := range []int{0, start - 1, end, numLeaves - 1} {
+		if ok, err := verify(index, root); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("leaf %v: exclusion proof does not verify", index)
+		}
+	}
+	for _, index := range []int{start, end - 1} {
+		if ok, _ := verify(index, root); ok {
+			t.Fatalf("leaf %v: exclusion proof verified for a leaf within the range", index)
+		}
+	}
+
+	// both proofs must be bound to the same root
+	otherRoot := bytesRoot(fastrand.Bytes(numLeaves*64), blake, 64)
+	if ok, _ := verify(start-1, otherRoot); ok {
+		t.Fatal("exclusion proof verified against the wrong root")
+	}
+}
+
+// TestMMR tests MMRRoot and VerifyMMRProof on Merkle mountain ranges whose
+// peaks are not a single perfect tree.
+func TestMMR(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	for _, numLeaves := range []int{3, 7} {
+		leafData := fastrand.Bytes(numLeaves * 64)
+		spans := CoveringSubtrees(0, numLeaves)
+		peaks := make([][]byte, len(spans))
+		for i, span := range spans {
+			peaks[i] = bytesRoot(leafData[span.Offset*64:(span.Offset+span.Size)*64], blake, 64)
+		}
+		root := MMRRoot(peaks, blake)
+		if !bytes.Equal(root, bytesRoot(leafData, blake, 64)) {
+			t.Fatalf("%v leaves: MMR root does not match Tree root", numLeaves)
+		}
+
+		for index := 0; index < numLeaves; index++ {
+			// build the proof within the leaf's peak
+			var proof [][]byte
+			for _, span := range spans {
+				if ProofCoversIndex(span.Offset, span.Offset+span.Size, index) {
+					peakData := leafData[span.Offset*64 : (span.Offset+span.Size)*64]
+					var err error
+					proof, err = BuildRangeProofFromBytes(peakData, 64, index-span.Offset, index-span.Offset+1, blake)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			verify := func(peaks [][]byte, root []byte) (bool, error) {
+				lh := NewReaderLeafHasher(bytes.NewReader(leafData[index*64:][:64]), blake, 64)
+				return VerifyMMRProof(lh, blake, index, numLeaves, proof, peaks, root)
+			}
+			if ok, err := verify(peaks, root); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("%v leaves: proof for leaf %v does not verify", numLeaves, index)
+			}
+
+			// tampering with any peak should cause verification to fail
+			for i := range peaks {
+				tampered := append([][]byte(nil), peaks...)
+				tampered[i] = append([]byte(nil), peaks[i]...)
+				tampered[i][0] ^= 1
+				if ok, _ := verify(tampered, root); ok {
+					t.Fatalf("%v leaves: proof for leaf %v verified with tampered peak %v", numLeaves, index, i)
+				}
+			}
+		}
+	}
 }
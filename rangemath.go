@@ -0,0 +1,309 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// maxSubtreeHeight is the height of the largest subtree whose number of
+// leaves can be represented by a (positive) int. Loops over subtree heights
+// must not exceed it, since 1<<i would otherwise overflow, producing a
+// negative or zero subtree size.
+const maxSubtreeHeight = bits.UintSize - 2
+
+// TreeHeight returns the height of a tree of numLeaves leaves, i.e. the
+// number of levels above the leaves, which is ceil(log2(numLeaves)). This is
+// also the maximum number of hashes in a proof for a single leaf. A tree
+// with a single leaf has a height of 0, as does the empty tree.
+func TreeHeight(numLeaves int) int {
+	if numLeaves < 0 {
+		panic("TreeHeight: negative leaf count")
+	} else if numLeaves <= 1 {
+		return 0
+	}
+	return bits.Len64(uint64(numLeaves - 1))
+}
+
+// RangeProofSize returns the number of hashes in a proof for the leaf range
+// [proofStart, proofEnd) within a tree of numLeaves leaves, as constructed by
+// BuildRangeProof.
+func RangeProofSize(numLeaves, proofStart, proofEnd int) int {
+	return rangeProofSizeLeft(proofStart) + rangeProofSizeRight(numLeaves, proofEnd)
+}
+
+// BatchProofSize returns the total size, in bytes, of the proof hashes for
+// each of ranges within a tree of numLeaves leaves, where each range is
+// proven independently by BuildRangeProof and each hash is hashSize bytes.
+// This can be used to estimate the bandwidth required by a batch of proof
+// requests before building them.
+func BatchProofSize(ranges []LeafRange, numLeaves, hashSize int) int {
+	total := 0
+	for _, r := range ranges {
+		if r.Start < 0 || r.Start >= r.End || r.End > numLeaves {
+			panic("BatchProofSize: illegal proof range")
+		}
+		total += RangeProofSize(numLeaves, r.Start, r.End) * hashSize
+	}
+	return total
+}
+
+// IsMinimalProof reports whether proof contains exactly the number of hashes
+// that BuildRangeProof produces for the leaf range [proofStart, proofEnd)
+// within a tree of numLeaves leaves. It does not verify the proof, but can be
+// used to reject proofs padded with redundant hashes before verifying them.
+func IsMinimalProof(proofStart, proofEnd, numLeaves int, proof [][]byte) bool {
+	if proofStart < 0 || proofStart >= proofEnd || proofEnd > numLeaves {
+		return false
+	}
+	return len(proof) == RangeProofSize(numLeaves, proofStart, proofEnd)
+}
+
+// checkProofLength returns ErrBadProofLength if proof cannot be a proof for
+// the leaf range [proofStart, proofEnd) in any tree: either it has fewer
+// hashes than are needed to cover the leaves [0, proofStart), or it has more
+// right-side hashes than there are 0 bits in proofEnd-1.
+func checkProofLength(proofStart, proofEnd int, proof [][]byte) error {
+	numLeft := rangeProofSizeLeft(proofStart)
+	maxRight := maxSubtreeHeight + 1 - bits.OnesCount64(uint64(proofEnd-1))
+	if len(proof) < numLeft || len(proof)-numLeft > maxRight {
+		return ErrBadProofLength
+	}
+	return nil
+}
+
+// rangeProofSizeLeft returns the number of proof hashes covering the leaves
+// [0, proofStart). There is one hash for each 1 bit in proofStart.
+func rangeProofSizeLeft(proofStart int) int {
+	return bits.OnesCount64(uint64(proofStart))
+}
+
+// rangeProofSizeRight returns the number of proof hashes covering the leaves
+// [proofEnd, numLeaves). There is one hash for each 0 bit in proofEnd-1,
+// stopping once the subtrees pass the end of the tree.
+func rangeProofSizeRight(numLeaves, proofEnd int) int {
+	n := 0
+	endMask := proofEnd - 1
+	pos := proofEnd
+	for i := 0; i <= maxSubtreeHeight && pos < numLeaves; i++ {
+		subtreeSize := 1 << uint64(i)
+		if endMask&subtreeSize == 0 {
+			n++
+			pos += subtreeSize
+		}
+	}
+	return n
+}
+
+// ProofCoversIndex reports whether the leaf at index is within the range of a
+// proof for the leaves [start, end). Proof ranges are always half-open: start
+// is the first leaf in the range, and end is one past the last.
+func ProofCoversIndex(start, end, index int) bool {
+	return start <= index && index < end
+}
+
+// A SubtreeSpan identifies a perfect subtree of a Merkle tree by the index of
+// its first leaf and its number of leaves, which is always a power of two.
+type SubtreeSpan struct {
+	Offset int
+	Size   int
+}
+
+// CoveringSubtrees returns the maximal aligned subtrees that exactly tile the
+// leaf range [start, end), ordered from left to right. This is the canonical
+// binary decomposition of the range: each span is the largest power-of-two
+// subtree that begins at the end of the previous span and does not extend
+// past end. The sizes therefore increase and then decrease.
+//
+// The left-side hashes of a proof for [start, end) are exactly the roots of
+// CoveringSubtrees(0, start). If the tree is perfect, the right-side hashes
+// are likewise the roots of CoveringSubtrees(end, numLeaves); otherwise, the
+// last right-side hash may cover an imperfect subtree.
+func CoveringSubtrees(start, end int) []SubtreeSpan {
+	if start < 0 || start > end {
+		panic("CoveringSubtrees: illegal range")
+	}
+	var spans []SubtreeSpan
+	for start < end {
+		// the largest subtree aligned at start is given by the lowest set
+		// bit of start; shrink it until it fits within the range
+		size := 1 << uint(bits.Len64(uint64(end-start))-1)
+		if start != 0 {
+			if align := start & -start; align < size {
+				size = align
+			}
+		}
+		spans = append(spans, SubtreeSpan{Offset: start, Size: size})
+		start += size
+	}
+	return spans
+}
+
+// OptimalRange returns the contiguous leaf range [start, end) that covers
+// every index in required and minimizes the total size of a range proof,
+// i.e. the size of the proof hashes plus the size of the leaf data within
+// the range. Expanding a range to an aligned boundary removes hashes from the
+// proof at the cost of additional leaves, which is worthwhile when leafSize
+// is small relative to hashSize. If several ranges are equally small, the
+// narrowest is returned.
+func OptimalRange(required []int, numLeaves, leafSize, hashSize int) (start, end int) {
+	if len(required) == 0 {
+		panic("OptimalRange: no required leaves")
+	} else if leafSize <= 0 || hashSize <= 0 {
+		panic("OptimalRange: leafSize and hashSize must be positive")
+	}
+	lo, hi := required[0], required[0]
+	for _, i := range required {
+		if i < 0 || i >= numLeaves {
+			panic("OptimalRange: required leaf outside of tree")
+		}
+		if i < lo {
+			lo = i
+		}
+		if i > hi {
+			hi = i
+		}
+	}
+
+	// The number of proof hashes on each side of the range depends only on
+	// the boundary on that side, so each boundary can be chosen
+	// independently. Expanding a boundary can remove at most 64 hashes from
+	// the proof, so there is no point in expanding it further than the
+	// number of leaves that fit in 64 hashes.
+	window := 64*hashSize/leafSize + 1
+
+	start = lo
+	bestLeft := rangeProofSizeLeft(lo) * hashSize
+	for s := lo - 1; s >= 0 && s >= lo-window; s-- {
+		cost := rangeProofSizeLeft(s)*hashSize + (lo-s)*leafSize
+		if cost < bestLeft {
+			start, bestLeft = s, cost
+		}
+	}
+
+	end = hi + 1
+	bestRight := rangeProofSizeRight(numLeaves, hi+1) * hashSize
+	for e := hi + 2; e <= numLeaves && e <= hi+1+window; e++ {
+		cost := rangeProofSizeRight(numLeaves, e)*hashSize + (e-hi-1)*leafSize
+		if cost < bestRight {
+			end, bestRight = e, cost
+		}
+	}
+	return start, end
+}
+
+// A LeafRange denotes the leaf range [Start, End).
+type LeafRange struct {
+	Start int
+	End   int
+}
+
+// ErrBadRanges is returned by MergeRanges when the supplied ranges are empty,
+// overlapping, or not in increasing order.
+var ErrBadRanges = errors.New("ranges must be non-empty, non-overlapping, and strictly increasing")
+
+// MergeRanges returns the canonical form of a list of leaf ranges, for use
+// when proving several ranges at once. The ranges must be non-empty and
+// strictly increasing; overlapping or out-of-order ranges are rejected with
+// ErrBadRanges. Adjacent ranges, such as [3, 5) and [5, 7), are merged into a
+// single range ([3, 7)), since a proof for two adjacent ranges would contain
+// a redundant interior boundary. The input slice is not modified.
+func MergeRanges(ranges []LeafRange) ([]LeafRange, error) {
+	var merged []LeafRange
+	for _, r := range ranges {
+		if r.Start < 0 || r.Start >= r.End {
+			return nil, ErrBadRanges
+		}
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if r.Start < last.End {
+				return nil, ErrBadRanges
+			} else if r.Start == last.End {
+				last.End = r.End
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// RequiredLeaves returns the indices of the leaves whose hashes a verifier
+// consumes from its LeafHasher when verifying a proof for the leaf range
+// [start, end), in the order they are consumed. These are the leaves that a
+// client must fetch before it can verify the proof.
+func RequiredLeaves(start, end int) []int {
+	if start < 0 || start > end {
+		panic("RequiredLeaves: illegal range")
+	}
+	indices := make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// RequiredLeavesMulti is like RequiredLeaves, but returns the leaves required
+// to verify proofs for each of ranges. The returned indices are sorted and
+// contain no duplicates, so ranges may overlap or be out of order.
+func RequiredLeavesMulti(ranges []LeafRange) []int {
+	var indices []int
+	for _, r := range ranges {
+		if r.Start < 0 || r.Start > r.End {
+			panic("RequiredLeavesMulti: illegal range")
+		}
+		indices = append(indices, RequiredLeaves(r.Start, r.End)...)
+	}
+	sort.Ints(indices)
+	// remove duplicates
+	n := 0
+	for i, index := range indices {
+		if i == 0 || index != indices[n-1] {
+			indices[n] = index
+			n++
+		}
+	}
+	return indices[:n]
+}
+
+// Reconcile compares two trees of numLeaves leaves, whose subtree roots are
+// supplied by left and right, and returns the leaves at which they differ,
+// as spans of size 1 in increasing order. The trees are compared top-down:
+// the subtrees of CoveringSubtrees(0, numLeaves) are compared first, and the
+// halves of a subtree are only compared if its roots differ. This requires
+// O(d log n) roots from each tree, where d is the number of differing leaves.
+func Reconcile(left, right func(span SubtreeSpan) ([]byte, error), numLeaves int) ([]SubtreeSpan, error) {
+	if numLeaves < 0 {
+		panic("Reconcile: negative leaf count")
+	}
+	var diffs []SubtreeSpan
+	var compare func(span SubtreeSpan) error
+	compare = func(span SubtreeSpan) error {
+		l, err := left(span)
+		if err != nil {
+			return err
+		}
+		r, err := right(span)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(l, r) {
+			return nil
+		} else if span.Size == 1 {
+			diffs = append(diffs, span)
+			return nil
+		}
+		half := span.Size / 2
+		if err := compare(SubtreeSpan{Offset: span.Offset, Size: half}); err != nil {
+			return err
+		}
+		return compare(SubtreeSpan{Offset: span.Offset + half, Size: half})
+	}
+	for _, span := range CoveringSubtrees(0, numLeaves) {
+		if err := compare(span); err != nil {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
@@ -0,0 +1,378 @@
+package merkletree
+
+import (
+	"errors"
+	"math/bits"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestRangeProofSize tests that RangeProofSize matches the size of the proofs
+// constructed by BuildRangeProof.
+func TestRangeProofSize(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	leafHashes := make([][]byte, 33)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, []byte{byte(i)})
+	}
+	for nLeaves := 1; nLeaves <= len(leafHashes); nLeaves++ {
+		for start := 0; start < nLeaves; start++ {
+			for end := start + 1; end <= nLeaves; end++ {
+				proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes[:nLeaves], blake))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if RangeProofSize(nLeaves, start, end) != len(proof) {
+					t.Fatalf("RangeProofSize(%v, %v, %v) = %v, expected %v", nLeaves, start, end, RangeProofSize(nLeaves, start, end), len(proof))
+				}
+			}
+		}
+	}
+}
+
+// TestBatchProofSize tests that BatchProofSize matches the total size of the
+// proofs constructed by BuildRangeProof.
+func TestBatchProofSize(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 37
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, []byte{byte(i)})
+	}
+	batches := [][]LeafRange{
+		{{Start: 0, End: 1}},
+		{{Start: 0, End: numLeaves}},
+		{{Start: 3, End: 5}, {Start: 10, End: 20}, {Start: 36, End: 37}},
+		{{Start: 7, End: 8}, {Start: 7, End: 8}, {Start: 0, End: 32}},
+	}
+	for _, batch := range batches {
+		actual := 0
+		for _, r := range batch {
+			proof, err := BuildRangeProof(r.Start, r.End, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, h := range proof {
+				actual += len(h)
+			}
+		}
+		if size := BatchProofSize(batch, numLeaves, blake.Size()); size != actual {
+			t.Fatalf("BatchProofSize(%v) = %v, expected %v", batch, size, actual)
+		}
+	}
+}
+
+// TestTreeHeight tests the TreeHeight function.
+func TestTreeHeight(t *testing.T) {
+	tests := []struct {
+		numLeaves, height int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{5, 3},
+		{1024, 10},
+		{1025, 11},
+	}
+	for _, test := range tests {
+		if h := TreeHeight(test.numLeaves); h != test.height {
+			t.Errorf("TreeHeight(%v) = %v, expected %v", test.numLeaves, h, test.height)
+		}
+	}
+
+	// the height should match the largest single-leaf proof
+	for numLeaves := 1; numLeaves <= 65; numLeaves++ {
+		max := 0
+		for i := 0; i < numLeaves; i++ {
+			if n := RangeProofSize(numLeaves, i, i+1); n > max {
+				max = n
+			}
+		}
+		if max != TreeHeight(numLeaves) {
+			t.Errorf("TreeHeight(%v) = %v, but largest proof has %v hashes", numLeaves, TreeHeight(numLeaves), max)
+		}
+	}
+}
+
+// TestProofCoversIndex tests ProofCoversIndex at the boundaries of a range.
+func TestProofCoversIndex(t *testing.T) {
+	tests := []struct {
+		start, end, index int
+		exp               bool
+	}{
+		{3, 7, 2, false},
+		{3, 7, 3, true},
+		{3, 7, 6, true},
+		{3, 7, 7, false},
+		{0, 1, 0, true},
+		{0, 1, 1, false},
+		{5, 5, 5, false},
+	}
+	for _, test := range tests {
+		if got := ProofCoversIndex(test.start, test.end, test.index); got != test.exp {
+			t.Errorf("ProofCoversIndex(%v, %v, %v): expected %v, got %v", test.start, test.end, test.index, test.exp, got)
+		}
+	}
+}
+
+// TestIsMinimalProof tests that IsMinimalProof accepts proofs built by
+// BuildRangeProof and rejects proofs with extra or missing hashes.
+func TestIsMinimalProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 13
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, []byte{byte(i)})
+	}
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsMinimalProof(start, end, numLeaves, proof) {
+				t.Fatalf("proof for range %v-%v should be minimal", start, end)
+			}
+			if IsMinimalProof(start, end, numLeaves, append(proof, leafHashes[0])) {
+				t.Fatalf("proof for range %v-%v with an appended hash should not be minimal", start, end)
+			}
+			if len(proof) > 0 && IsMinimalProof(start, end, numLeaves, proof[1:]) {
+				t.Fatalf("proof for range %v-%v with a missing hash should not be minimal", start, end)
+			}
+		}
+	}
+	if IsMinimalProof(3, 14, numLeaves, nil) || IsMinimalProof(5, 5, numLeaves, nil) {
+		t.Fatal("invalid ranges should not be minimal")
+	}
+}
+
+// TestOptimalRange tests the OptimalRange function.
+func TestOptimalRange(t *testing.T) {
+	proofBytes := func(numLeaves, start, end, leafSize, hashSize int) int {
+		return RangeProofSize(numLeaves, start, end)*hashSize + (end-start)*leafSize
+	}
+
+	// with small leaves, expanding to an aligned range is cheaper than
+	// proving the tight range
+	start, end := OptimalRange([]int{3}, 16, 4, 32)
+	if start != 0 || end != 8 {
+		t.Fatalf("expected aligned range 0-8, got %v-%v", start, end)
+	}
+	if proofBytes(16, start, end, 4, 32) >= proofBytes(16, 3, 4, 4, 32) {
+		t.Fatal("optimal range is not smaller than tight range")
+	}
+
+	// with large leaves, the tight range is cheapest
+	start, end = OptimalRange([]int{5, 3, 4}, 16, 64, 32)
+	if start != 3 || end != 6 {
+		t.Fatalf("expected tight range 3-6, got %v-%v", start, end)
+	}
+
+	// the optimal range should never be larger than any other covering range
+	const numLeaves, leafSize, hashSize = 37, 8, 32
+	for lo := 0; lo < numLeaves; lo++ {
+		for hi := lo; hi < numLeaves; hi++ {
+			start, end := OptimalRange([]int{lo, hi}, numLeaves, leafSize, hashSize)
+			if start > lo || end <= hi {
+				t.Fatalf("optimal range %v-%v does not cover %v-%v", start, end, lo, hi)
+			}
+			best := proofBytes(numLeaves, start, end, leafSize, hashSize)
+			for s := 0; s <= lo; s++ {
+				for e := hi + 1; e <= numLeaves; e++ {
+					if proofBytes(numLeaves, s, e, leafSize, hashSize) < best {
+						t.Fatalf("range %v-%v is smaller than optimal range %v-%v", s, e, start, end)
+					}
+				}
+			}
+		}
+	}
+
+	// non-positive sizes trigger a panic
+	for _, sizes := range [][2]int{{0, 32}, {8, 0}, {-1, 32}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic for leafSize %v, hashSize %v", sizes[0], sizes[1])
+				}
+			}()
+			OptimalRange([]int{3}, 16, sizes[0], sizes[1])
+		}()
+	}
+}
+
+// TestCoveringSubtrees tests CoveringSubtrees against hand-computed
+// decompositions.
+func TestCoveringSubtrees(t *testing.T) {
+	tests := []struct {
+		start, end int
+		spans      []SubtreeSpan
+	}{
+		{0, 0, nil},
+		{0, 1, []SubtreeSpan{{0, 1}}},
+		{0, 8, []SubtreeSpan{{0, 8}}},
+		{0, 12, []SubtreeSpan{{0, 8}, {8, 4}}},
+		{3, 5, []SubtreeSpan{{3, 1}, {4, 1}}},
+		{3, 13, []SubtreeSpan{{3, 1}, {4, 4}, {8, 4}, {12, 1}}},
+		{5, 6, []SubtreeSpan{{5, 1}}},
+		{6, 16, []SubtreeSpan{{6, 2}, {8, 8}}},
+		{8, 16, []SubtreeSpan{{8, 8}}},
+		{12, 23, []SubtreeSpan{{12, 4}, {16, 4}, {20, 2}, {22, 1}}},
+		{1, 31, []SubtreeSpan{{1, 1}, {2, 2}, {4, 4}, {8, 8}, {16, 8}, {24, 4}, {28, 2}, {30, 1}}},
+	}
+	for _, test := range tests {
+		spans := CoveringSubtrees(test.start, test.end)
+		if len(spans) != len(test.spans) {
+			t.Errorf("CoveringSubtrees(%v, %v) = %v, expected %v", test.start, test.end, spans, test.spans)
+			continue
+		}
+		for i := range spans {
+			if spans[i] != test.spans[i] {
+				t.Errorf("CoveringSubtrees(%v, %v) = %v, expected %v", test.start, test.end, spans, test.spans)
+				break
+			}
+		}
+	}
+
+	// in a perfect tree, the covering subtrees of [0, start) and [end,
+	// numLeaves) should correspond to the proof hashes
+	const numLeaves = 32
+	for start := 0; start < numLeaves; start++ {
+		for end := start + 1; end <= numLeaves; end++ {
+			n := len(CoveringSubtrees(0, start)) + len(CoveringSubtrees(end, numLeaves))
+			if n != RangeProofSize(numLeaves, start, end) {
+				t.Fatalf("covering subtrees of range %v-%v do not match proof size", start, end)
+			}
+		}
+	}
+}
+
+// TestMergeRanges tests that MergeRanges merges adjacent ranges and rejects
+// overlapping and out-of-order ranges.
+func TestMergeRanges(t *testing.T) {
+	tests := []struct {
+		ranges []LeafRange
+		merged []LeafRange
+		err    error
+	}{
+		{nil, nil, nil},
+		{[]LeafRange{{3, 5}}, []LeafRange{{3, 5}}, nil},
+		// properly gapped
+		{[]LeafRange{{0, 2}, {3, 5}, {8, 9}}, []LeafRange{{0, 2}, {3, 5}, {8, 9}}, nil},
+		// adjacent
+		{[]LeafRange{{3, 5}, {5, 7}}, []LeafRange{{3, 7}}, nil},
+		{[]LeafRange{{0, 1}, {1, 2}, {2, 3}, {5, 6}, {6, 8}}, []LeafRange{{0, 3}, {5, 8}}, nil},
+		// overlapping
+		{[]LeafRange{{3, 5}, {4, 7}}, nil, ErrBadRanges},
+		{[]LeafRange{{3, 7}, {4, 5}}, nil, ErrBadRanges},
+		// out of order
+		{[]LeafRange{{5, 7}, {3, 5}}, nil, ErrBadRanges},
+		// empty or invalid
+		{[]LeafRange{{3, 3}}, nil, ErrBadRanges},
+		{[]LeafRange{{-1, 3}}, nil, ErrBadRanges},
+	}
+	for _, test := range tests {
+		merged, err := MergeRanges(test.ranges)
+		if err != test.err {
+			t.Errorf("MergeRanges(%v): expected error %v, got %v", test.ranges, test.err, err)
+			continue
+		}
+		if len(merged) != len(test.merged) {
+			t.Errorf("MergeRanges(%v) = %v, expected %v", test.ranges, merged, test.merged)
+			continue
+		}
+		for i := range merged {
+			if merged[i] != test.merged[i] {
+				t.Errorf("MergeRanges(%v) = %v, expected %v", test.ranges, merged, test.merged)
+				break
+			}
+		}
+	}
+
+	// the input should not be modified
+	ranges := []LeafRange{{3, 5}, {5, 7}}
+	MergeRanges(ranges)
+	if ranges[0] != (LeafRange{3, 5}) || ranges[1] != (LeafRange{5, 7}) {
+		t.Error("MergeRanges modified its input")
+	}
+}
+
+// TestRequiredLeaves tests RequiredLeaves and RequiredLeavesMulti.
+func TestRequiredLeaves(t *testing.T) {
+	if got := RequiredLeaves(3, 7); !reflect.DeepEqual(got, []int{3, 4, 5, 6}) {
+		t.Error("wrong leaves for [3, 7):", got)
+	}
+	if got := RequiredLeaves(0, 1); !reflect.DeepEqual(got, []int{0}) {
+		t.Error("wrong leaves for [0, 1):", got)
+	}
+
+	got := RequiredLeavesMulti([]LeafRange{{Start: 10, End: 12}, {Start: 2, End: 4}})
+	if exp := []int{2, 3, 10, 11}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	got = RequiredLeavesMulti([]LeafRange{{Start: 2, End: 5}, {Start: 4, End: 6}})
+	if exp := []int{2, 3, 4, 5}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v for overlapping ranges, got %v", exp, got)
+	}
+}
+
+// TestReconcile tests that Reconcile finds exactly the leaves at which two
+// trees differ.
+func TestReconcile(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	spanRoots := func(leafHashes [][]byte, requests *int) func(SubtreeSpan) ([]byte, error) {
+		return func(span SubtreeSpan) ([]byte, error) {
+			*requests++
+			return NewCachedSubtreeHasher(leafHashes[span.Offset:], blake).NextSubtreeRoot(span.Size)
+		}
+	}
+
+	for _, numLeaves := range []int{64, 13} {
+		a := make([][]byte, numLeaves)
+		b := make([][]byte, numLeaves)
+		for i := range a {
+			a[i] = leafSum(blake, []byte{byte(i)})
+			b[i] = a[i]
+		}
+
+		// identical trees
+		var requests int
+		diffs, err := Reconcile(spanRoots(a, &requests), spanRoots(b, &requests), numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		} else if diffs != nil {
+			t.Fatalf("%v-leaf trees: expected no differences, got %v", numLeaves, diffs)
+		} else if n := len(CoveringSubtrees(0, numLeaves)); requests != 2*n {
+			t.Fatalf("%v-leaf trees: expected %v requests, got %v", numLeaves, 2*n, requests)
+		}
+
+		// two differing leaves
+		b[3] = leafSum(blake, []byte("foo"))
+		b[numLeaves-2] = leafSum(blake, []byte("bar"))
+		requests = 0
+		diffs, err = Reconcile(spanRoots(a, &requests), spanRoots(b, &requests), numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []SubtreeSpan{{Offset: 3, Size: 1}, {Offset: numLeaves - 2, Size: 1}}
+		if !reflect.DeepEqual(diffs, expected) {
+			t.Fatalf("%v-leaf trees: expected differences %v, got %v", numLeaves, expected, diffs)
+		}
+		// each differing leaf requires at most two roots per level from each
+		// tree
+		if maxRequests := 2 * 2 * 2 * (bits.Len(uint(numLeaves)) + 1); requests > maxRequests {
+			t.Fatalf("%v-leaf trees: made %v requests, expected at most %v", numLeaves, requests, maxRequests)
+		}
+	}
+
+	// errors should be propagated
+	errRoot := errors.New("unavailable")
+	failing := func(SubtreeSpan) ([]byte, error) { return nil, errRoot }
+	var requests int
+	if _, err := Reconcile(spanRoots(make([][]byte, 8), &requests), failing, 8); err != errRoot {
+		t.Fatal("expected error to be propagated, got", err)
+	}
+}
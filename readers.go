@@ -1,9 +1,13 @@
 package merkletree
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"hash"
 	"io"
+	"math/bits"
+	"sync/atomic"
 )
 
 // ReadAll will read segments of size 'segmentSize' and push them into the tree
@@ -43,6 +47,90 @@ func ReaderRoot(r io.Reader, h hash.Hash, segmentSize int) (root []byte, err err
 	return
 }
 
+// DetectLeafSize returns the first leaf size in candidates for which the
+// Merkle root of data equals root, and whether any candidate matched. Each
+// candidate requires hashing all of data, so the candidate list should be
+// kept short. Non-positive candidates are ignored.
+func DetectLeafSize(data []byte, root []byte, h hash.Hash, candidates []int) (int, bool) {
+	for _, leafSize := range candidates {
+		if leafSize <= 0 {
+			continue
+		}
+		r, err := ReaderRoot(bytes.NewReader(data), h, leafSize)
+		if err == nil && bytes.Equal(r, root) {
+			return leafSize, true
+		}
+	}
+	return 0, false
+}
+
+// progressInterval is the number of leaves between calls to the progress
+// callback of ReaderRootProgress.
+const progressInterval = 1 << 12
+
+// ReaderRootProgress is like ReaderRoot, but calls progress with the number of
+// leaves processed so far after every progressInterval leaves, and once more
+// with the total number of leaves after the reader has been exhausted.
+// progress is always called from the calling goroutine.
+func ReaderRootProgress(r io.Reader, h hash.Hash, segmentSize int, progress func(leavesProcessed int)) (root []byte, err error) {
+	tree := New(h)
+	leaves := 0
+	segment := make([]byte, segmentSize)
+	for {
+		n, readErr := io.ReadFull(r, segment)
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			return nil, readErr
+		}
+		tree.Push(segment[:n])
+		leaves++
+		if leaves%progressInterval == 0 {
+			progress(leaves)
+		}
+	}
+	if leaves%progressInterval != 0 || leaves == 0 {
+		progress(leaves)
+	}
+	return tree.Root(), nil
+}
+
+// ReaderRootAndLeaves is like ReaderRoot, but also returns the hash of every
+// leaf, which can later be passed to NewCachedSubtreeHasher to build proofs
+// without re-reading the data. The leaf hashes are held in memory, requiring
+// h.Size() bytes (plus slice overhead) per leaf; for very large readers,
+// ReaderRootFunc can be used to process each leaf hash as it is computed.
+func ReaderRootAndLeaves(r io.Reader, h hash.Hash, segmentSize int) (root []byte, leafHashes [][]byte, err error) {
+	root, err = ReaderRootFunc(r, h, segmentSize, func(leafHash []byte) {
+		leafHashes = append(leafHashes, leafHash)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, leafHashes, nil
+}
+
+// ReaderRootFunc is like ReaderRoot, but calls fn with the hash of each leaf,
+// in order, as it is computed. fn may retain the leaf hash.
+func ReaderRootFunc(r io.Reader, h hash.Hash, segmentSize int, fn func(leafHash []byte)) (root []byte, err error) {
+	tree := New(h)
+	segment := make([]byte, segmentSize)
+	for {
+		n, readErr := io.ReadFull(r, segment)
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			return nil, readErr
+		}
+		leafHash := leafSum(h, segment[:n])
+		if err := tree.PushLeafHash(leafHash); err != nil {
+			return nil, err
+		}
+		fn(leafHash)
+	}
+	return tree.Root(), nil
+}
+
 // BuildReaderProof returns a proof that certain data is in the merkle tree
 // created by the data in the reader. The merkle root, set of proofs, and the
 // number of leaves in the Merkle tree are all returned. All leaves will we
@@ -68,3 +156,237 @@ func BuildReaderProof(r io.Reader, h hash.Hash, segmentSize int, index uint64) (
 	}
 	return
 }
+
+// leafHashReader implements io.Reader by serving the concatenated leaf hashes
+// produced by a LeafHasher.
+type leafHashReader struct {
+	lh  LeafHasher
+	buf []byte
+}
+
+// Read implements io.Reader.
+func (r *leafHashReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.buf) == 0 {
+		leafHash, err := r.lh.NextLeafHash()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = leafHash
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// LeafHashReader returns an io.Reader that reads the concatenation of the
+// leaf hashes produced by lh. Each Read serves bytes from at most one leaf
+// hash, buffering any remainder for subsequent reads. The Reader returns
+// io.EOF once lh is exhausted.
+func LeafHashReader(lh LeafHasher) io.Reader {
+	return &leafHashReader{
+		lh: lh,
+	}
+}
+
+// A CountingReader wraps an io.Reader, counting the bytes read from it. It
+// can be used to measure the I/O performed while building a proof.
+type CountingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader.
+func (cr *CountingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// BytesRead returns the number of bytes read so far.
+func (cr *CountingReader) BytesRead() int64 {
+	return cr.n
+}
+
+// NewCountingReader returns a CountingReader that reads from r.
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{
+		r: r,
+	}
+}
+
+// A CountingReaderAt wraps an io.ReaderAt, counting the bytes read from it.
+// Like any io.ReaderAt, it is safe for concurrent use if the underlying
+// io.ReaderAt is.
+type CountingReaderAt struct {
+	r io.ReaderAt
+	n int64 // accessed atomically
+}
+
+// ReadAt implements io.ReaderAt.
+func (cr *CountingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cr.r.ReadAt(p, off)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read so far.
+func (cr *CountingReaderAt) BytesRead() int64 {
+	return atomic.LoadInt64(&cr.n)
+}
+
+// NewCountingReaderAt returns a CountingReaderAt that reads from r.
+func NewCountingReaderAt(r io.ReaderAt) *CountingReaderAt {
+	return &CountingReaderAt{
+		r: r,
+	}
+}
+
+// An IncrementalRootBuilder computes the Merkle root of data that is appended
+// in arbitrarily-sized chunks, such as a sector that is written to disk a
+// piece at a time. Complete leaves are hashed as soon as they arrive, so the
+// builder never needs to re-read earlier data; only the unaligned tail is
+// buffered. The state of the builder can be saved with MarshalState and
+// restored with UnmarshalState, allowing an interrupted append to resume
+// after a crash.
+type IncrementalRootBuilder struct {
+	tree     *Tree
+	h        hash.Hash
+	leafSize int
+	tail     []byte
+}
+
+// Write implements io.Writer. It appends p to the data, hashing each leaf
+// that is completed. It never returns an error.
+func (b *IncrementalRootBuilder) Write(p []byte) (int, error) {
+	n := len(p)
+	// complete the buffered leaf first
+	if len(b.tail) > 0 {
+		fill := b.leafSize - len(b.tail)
+		if fill > len(p) {
+			fill = len(p)
+		}
+		b.tail = append(b.tail, p[:fill]...)
+		p = p[fill:]
+		if len(b.tail) < b.leafSize {
+			return n, nil
+		}
+		b.pushLeaf(b.tail)
+		b.tail = b.tail[:0]
+	}
+	for len(p) >= b.leafSize {
+		b.pushLeaf(p[:b.leafSize])
+		p = p[b.leafSize:]
+	}
+	b.tail = append(b.tail, p...)
+	return n, nil
+}
+
+// pushLeaf hashes a complete leaf and pushes it onto the tree.
+func (b *IncrementalRootBuilder) pushLeaf(leaf []byte) {
+	if err := b.tree.PushSubTree(0, leafSum(b.h, leaf)); err != nil {
+		panic(err) // should never happen
+	}
+}
+
+// NumLeaves returns the number of leaves in the data appended so far,
+// including a partial trailing leaf.
+func (b *IncrementalRootBuilder) NumLeaves() int {
+	n := int(b.tree.currentIndex)
+	if len(b.tail) > 0 {
+		n++
+	}
+	return n
+}
+
+// Root returns the Merkle root of the data appended so far. If the data does
+// not end on a leaf boundary, the partial trailing leaf is hashed as-is,
+// without padding, as ReaderRoot would; it is not committed to the tree, so
+// more data may still be appended to it. Root returns nil if no data has been
+// appended.
+func (b *IncrementalRootBuilder) Root() []byte {
+	if len(b.tail) == 0 {
+		return b.tree.Root()
+	}
+	// fold the partial leaf into the tree's subtrees, from shortest to
+	// tallest, without modifying them
+	root := leafSum(b.h, b.tail)
+	for s := b.tree.head; s != nil; s = s.next {
+		root = nodeSum(b.h, s.sum, root)
+	}
+	return root
+}
+
+// MarshalState returns an encoding of the builder's state, from which it can
+// be restored with UnmarshalState. The encoding is the leaf size, the number
+// of complete leaves, the hash size, and the length of the buffered tail, all
+// as uvarints, followed by the tail and the roots of the tree's subtrees,
+// ordered from tallest to shortest. It is O(log n) in the size of the data.
+func (b *IncrementalRootBuilder) MarshalState() []byte {
+	roots := b.tree.subtreeRoots()
+	buf := make([]byte, 4*binary.MaxVarintLen64, 4*binary.MaxVarintLen64+len(b.tail)+len(roots)*b.h.Size())
+	n := binary.PutUvarint(buf, uint64(b.leafSize))
+	n += binary.PutUvarint(buf[n:], b.tree.currentIndex)
+	n += binary.PutUvarint(buf[n:], uint64(b.h.Size()))
+	n += binary.PutUvarint(buf[n:], uint64(len(b.tail)))
+	buf = append(buf[:n], b.tail...)
+	for _, root := range roots {
+		buf = append(buf, root...)
+	}
+	return buf
+}
+
+// UnmarshalState restores the builder to a state encoded by MarshalState,
+// replacing its current state. The state must have been produced by a
+// builder using the same hash function.
+func (b *IncrementalRootBuilder) UnmarshalState(state []byte) error {
+	var fields [4]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(state)
+		if n <= 0 {
+			return errors.New("invalid builder state")
+		}
+		fields[i], state = v, state[n:]
+	}
+	leafSize, numLeaves, hashSize, tailLen := fields[0], fields[1], fields[2], fields[3]
+	if leafSize == 0 || leafSize > uint64(^uint(0)>>1) || tailLen >= leafSize {
+		return errors.New("invalid builder state")
+	} else if numLeaves > 1<<maxSubtreeHeight {
+		return errors.New("builder state has too many leaves")
+	} else if hashSize != uint64(b.h.Size()) {
+		return ErrBadHashLength
+	}
+	numRoots := bits.OnesCount64(numLeaves)
+	if uint64(len(state)) != tailLen+uint64(numRoots)*hashSize {
+		return errors.New("builder state has wrong length")
+	}
+	tree := New(b.h)
+	tail := append([]byte(nil), state[:tailLen]...)
+	state = state[tailLen:]
+	for i := maxSubtreeHeight; i >= 0; i-- {
+		if numLeaves&(1<<uint(i)) != 0 {
+			if err := tree.PushSubTree(i, append([]byte(nil), state[:hashSize]...)); err != nil {
+				return err
+			}
+			state = state[hashSize:]
+		}
+	}
+	b.tree, b.leafSize, b.tail = tree, int(leafSize), tail
+	return nil
+}
+
+// NewIncrementalRootBuilder returns an IncrementalRootBuilder for data split
+// into leaves of leafSize bytes, hashed with h.
+func NewIncrementalRootBuilder(h hash.Hash, leafSize int) *IncrementalRootBuilder {
+	if leafSize <= 0 {
+		panic("NewIncrementalRootBuilder: leafSize must be positive")
+	}
+	return &IncrementalRootBuilder{
+		tree:     New(h),
+		h:        h,
+		leafSize: leafSize,
+		tail:     make([]byte, 0, leafSize),
+	}
+}
@@ -3,7 +3,14 @@ package merkletree
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"reflect"
 	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
 )
 
 // TestReaderRoot calls ReaderRoot on a manually crafted dataset
@@ -51,6 +58,34 @@ func TestReaderRootPadding(t *testing.T) {
 	}
 }
 
+// TestReaderRootMatchesTree tests that, for random leaf counts and sizes,
+// ReaderRoot produces the same root as pushing each leaf onto a Tree,
+// including when the final leaf is short.
+func TestReaderRootMatchesTree(t *testing.T) {
+	h := sha256.New()
+	for i := 0; i < 200; i++ {
+		numLeaves := fastrand.Intn(100) + 1
+		leafSize := fastrand.Intn(100) + 1
+		// the final leaf may have any size from 1 to leafSize
+		data := fastrand.Bytes((numLeaves-1)*leafSize + fastrand.Intn(leafSize) + 1)
+
+		tree := New(h)
+		for j := 0; j < len(data); j += leafSize {
+			end := j + leafSize
+			if end > len(data) {
+				end = len(data)
+			}
+			tree.Push(data[j:end])
+		}
+		root, err := ReaderRoot(bytes.NewReader(data), h, leafSize)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(root, tree.Root()) {
+			t.Fatalf("%v leaves of %v bytes (%v bytes total): ReaderRoot does not match Tree.Root", numLeaves, leafSize, len(data))
+		}
+	}
+}
+
 // TestBuildReaderProof calls BuildReaderProof on a manually crafted dataset
 // and checks the output.
 func TestBuilReaderProof(t *testing.T) {
@@ -109,3 +144,230 @@ func TestEmptyReader(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestLeafHashReader reads the output of LeafHashReader one byte at a time
+// and compares it to the concatenated leaf hashes.
+func TestLeafHashReader(t *testing.T) {
+	data := fastrand.Bytes(64*7 + 3)
+	var expected []byte
+	for i := 0; i < len(data); i += 64 {
+		end := i + 64
+		if end > len(data) {
+			end = len(data)
+		}
+		expected = append(expected, leafSum(sha256.New(), data[i:end])...)
+	}
+
+	r := LeafHashReader(NewReaderLeafHasher(bytes.NewReader(data), sha256.New(), 64))
+	var got []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("LeafHashReader produced wrong bytes")
+	}
+
+	// reading with a large buffer should produce the same result
+	got, err := ioutil.ReadAll(LeafHashReader(NewReaderLeafHasher(bytes.NewReader(data), sha256.New(), 64)))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, expected) {
+		t.Fatal("LeafHashReader produced wrong bytes")
+	}
+}
+
+// TestReaderRootProgress checks that ReaderRootProgress reports progress
+// periodically, finishes with the total number of leaves, and returns the
+// same root as ReaderRoot.
+func TestReaderRootProgress(t *testing.T) {
+	for _, numLeaves := range []int{0, 1, progressInterval, 2*progressInterval + 3} {
+		data := fastrand.Bytes(numLeaves * 4)
+		var calls []int
+		root, err := ReaderRootProgress(bytes.NewReader(data), sha256.New(), 4, func(n int) {
+			calls = append(calls, n)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := ReaderRoot(bytes.NewReader(data), sha256.New(), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(root, expected) {
+			t.Error("ReaderRootProgress returned the wrong root")
+		}
+		expectedCalls := (numLeaves + progressInterval - 1) / progressInterval
+		if expectedCalls == 0 {
+			expectedCalls = 1
+		}
+		if len(calls) != expectedCalls {
+			t.Errorf("expected progress to be called %v times, got %v", expectedCalls, len(calls))
+		}
+		if len(calls) == 0 || calls[len(calls)-1] != numLeaves {
+			t.Errorf("expected final progress of %v, got %v", numLeaves, calls)
+		}
+	}
+}
+
+// TestReaderRootAndLeaves checks that the leaf hashes returned by
+// ReaderRootAndLeaves can be used to rebuild the same root.
+func TestReaderRootAndLeaves(t *testing.T) {
+	data := fastrand.Bytes(64*13 + 5)
+	root, leafHashes, err := ReaderRootAndLeaves(bytes.NewReader(data), sha256.New(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leafHashes) != 14 {
+		t.Fatalf("expected 14 leaf hashes, got %v", len(leafHashes))
+	}
+	expected, err := ReaderRoot(bytes.NewReader(data), sha256.New(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, expected) {
+		t.Error("ReaderRootAndLeaves returned the wrong root")
+	}
+	cachedRoot, err := NewCachedSubtreeHasher(leafHashes, sha256.New()).NextSubtreeRoot(len(leafHashes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cachedRoot, expected) {
+		t.Error("leaf hashes do not rebuild the same root")
+	}
+
+	// an empty reader has no root and no leaves
+	root, leafHashes, err = ReaderRootAndLeaves(new(bytes.Reader), sha256.New(), 64)
+	if err != nil {
+		t.Fatal(err)
+	} else if root != nil || leafHashes != nil {
+		t.Error("expected nil root and leaf hashes for empty reader")
+	}
+}
+
+// TestDetectLeafSize tests recovering the leaf size of a tree from its data
+// and root.
+func TestDetectLeafSize(t *testing.T) {
+	data := fastrand.Bytes(1000)
+	root, err := ReaderRoot(bytes.NewReader(data), sha256.New(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leafSize, ok := DetectLeafSize(data, root, sha256.New(), []int{0, 32, 64, 128}); !ok || leafSize != 64 {
+		t.Fatalf("expected leaf size 64, got %v (%v)", leafSize, ok)
+	}
+	if leafSize, ok := DetectLeafSize(data, root, sha256.New(), []int{16, 32, 128, 4096}); ok {
+		t.Fatalf("detected leaf size %v, which is not the correct leaf size", leafSize)
+	}
+}
+
+// TestCountingReader tests that CountingReader and CountingReaderAt measure
+// the data read while building a proof. A ReaderSubtreeHasher must read past
+// every leaf it skips, whereas a ReaderAtSubtreeHasher never reads skipped
+// leaves, so it should read far less when proving a large range.
+func TestCountingReader(t *testing.T) {
+	const leafSize = 64
+	const numLeaves = 1 << 12
+	data := fastrand.Bytes(leafSize * numLeaves)
+	const start, end = 1, numLeaves - 1
+
+	cr := NewCountingReader(bytes.NewReader(data))
+	expected, err := BuildRangeProof(start, end, NewReaderSubtreeHasher(cr, leafSize, sha256.New()))
+	if err != nil {
+		t.Fatal(err)
+	} else if cr.BytesRead() != int64(len(data)) {
+		t.Fatalf("expected ReaderSubtreeHasher to read %v bytes, read %v", len(data), cr.BytesRead())
+	}
+
+	cra := NewCountingReaderAt(bytes.NewReader(data))
+	proof, err := BuildRangeProof(start, end, NewReaderAtSubtreeHasherBlockSize(cra, leafSize, leafSize, sha256.New()))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(proof, expected) {
+		t.Fatal("proofs do not match")
+	}
+	// only the first and last leaves, and the byte probed by Skip, should be
+	// read, rather than the whole tree
+	if cra.BytesRead() != 2*leafSize+1 {
+		t.Fatalf("expected ReaderAtSubtreeHasher to read %v bytes, read %v", 2*leafSize+1, cra.BytesRead())
+	}
+}
+
+// TestIncrementalRootBuilder tests that an IncrementalRootBuilder computes
+// the same root as ReaderRoot when data is appended in odd-sized chunks, and
+// that its state survives a MarshalState/UnmarshalState round trip.
+func TestIncrementalRootBuilder(t *testing.T) {
+	h := sha256.New()
+	const leafSize = 64
+	data := fastrand.Bytes(leafSize*37 + 11)
+	if root := NewIncrementalRootBuilder(h, leafSize).Root(); root != nil {
+		t.Fatal("expected nil root for empty builder, got", root)
+	}
+
+	chunkSizes := []int{1, 7, 63, 64, 65, 130, 200}
+	b := NewIncrementalRootBuilder(h, leafSize)
+	for i, n := 0, 0; n < len(data); i++ {
+		chunk := chunkSizes[i%len(chunkSizes)]
+		if n+chunk > len(data) {
+			chunk = len(data) - n
+		}
+		b.Write(data[n : n+chunk])
+		n += chunk
+
+		// check the intermediate root
+		root, _ := ReaderRoot(bytes.NewReader(data[:n]), h, leafSize)
+		if !bytes.Equal(b.Root(), root) {
+			t.Fatalf("root mismatch after %v bytes", n)
+		} else if b.NumLeaves() != (n+leafSize-1)/leafSize {
+			t.Fatalf("expected %v leaves after %v bytes, got %v", (n+leafSize-1)/leafSize, n, b.NumLeaves())
+		}
+
+		// restore a fresh builder from the saved state and check that it
+		// produces the same root
+		b2 := NewIncrementalRootBuilder(h, 1)
+		if err := b2.UnmarshalState(b.MarshalState()); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(b2.Root(), root) {
+			t.Fatalf("restored root mismatch after %v bytes", n)
+		}
+		b = b2
+	}
+
+	// invalid states should be rejected
+	state := b.MarshalState()
+	if err := b.UnmarshalState(state[:len(state)-1]); err == nil {
+		t.Error("expected error for truncated state")
+	}
+	if err := NewIncrementalRootBuilder(sha256.New224(), leafSize).UnmarshalState(state); err != ErrBadHashLength {
+		t.Error("expected ErrBadHashLength, got", err)
+	}
+
+	// states with more leaves than an int can count, or a leaf size that
+	// does not fit in an int, should be rejected rather than panicking
+	encodeState := func(leafSize, numLeaves uint64) []byte {
+		buf := make([]byte, 4*binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, leafSize)
+		n += binary.PutUvarint(buf[n:], numLeaves)
+		n += binary.PutUvarint(buf[n:], uint64(h.Size()))
+		n += binary.PutUvarint(buf[n:], 0)
+		return append(buf[:n], make([]byte, bits.OnesCount64(numLeaves)*h.Size())...)
+	}
+	for _, state := range [][]byte{
+		encodeState(leafSize, 1<<maxSubtreeHeight+1),
+		encodeState(leafSize, 1<<63),
+		encodeState(1<<63, 1),
+	} {
+		if err := b.UnmarshalState(state); err == nil {
+			t.Error("expected error for out-of-range state")
+		}
+	}
+	if err := b.UnmarshalState(encodeState(leafSize, 1<<maxSubtreeHeight)); err != nil {
+		t.Error("expected largest leaf count to be accepted, got", err)
+	}
+}
@@ -0,0 +1,119 @@
+package merkletree
+
+import (
+	"hash"
+	"io"
+)
+
+// SectorRoots reads r once, splitting it into sectors of sectorSize bytes and
+// returning the Merkle root of each sector, where each leaf is leafSize
+// bytes. The final sector may be shorter than sectorSize, in which case its
+// root is computed over the remaining data as usual. sectorSize must be a
+// multiple of leafSize.
+func SectorRoots(r io.Reader, sectorSize, leafSize int, h hash.Hash) ([][]byte, error) {
+	if sectorSize <= 0 || leafSize <= 0 || sectorSize%leafSize != 0 {
+		panic("SectorRoots: sectorSize must be a positive multiple of leafSize")
+	}
+	leavesPerSector := sectorSize / leafSize
+	rsh := NewReaderSubtreeHasher(r, leafSize, h)
+	var roots [][]byte
+	for {
+		root, err := rsh.NextSubtreeRoot(leavesPerSector)
+		if err == io.EOF {
+			return roots, nil
+		} else if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+}
+
+// FileRoot reads r once, returning both the Merkle root of each sector (as
+// computed by SectorRoots) and the Merkle root of the whole file.
+//
+// The file root is the root of a two-level tree: the leaves of the upper
+// level are the sector roots, which are pushed into the tree as subtree roots
+// of height 0. Unlike ordinary leaves, the sector roots are not hashed again
+// with the leaf prefix, since they are already node hashes. When sectorSize
+// / leafSize is a power of two, this makes the file root identical to the
+// Merkle root of the entire file computed over leafSize-byte leaves.
+func FileRoot(r io.Reader, sectorSize, leafSize int, h hash.Hash) (fileRoot []byte, sectorRoots [][]byte, err error) {
+	sectorRoots, err = SectorRoots(r, sectorSize, leafSize, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree := New(h)
+	for _, root := range sectorRoots {
+		if err := tree.PushSubTree(0, root); err != nil {
+			// should never happen, since every subtree has height 0
+			panic(err)
+		}
+	}
+	return tree.Root(), sectorRoots, nil
+}
+
+// RootLeafHasher implements the LeafHasher interface by reading precomputed
+// subtree roots, such as sector roots, from a stream. Unlike a
+// ReaderLeafHasher, it does not hash its input: each root is returned as-is,
+// which is the correct treatment for the leaves of the upper level of a
+// two-level tree (see FileRoot).
+type RootLeafHasher struct {
+	r        io.Reader
+	rootSize int
+}
+
+// NextLeafHash implements LeafHasher. It returns io.ErrUnexpectedEOF if the
+// stream ends partway through a root.
+func (rlh *RootLeafHasher) NextLeafHash() ([]byte, error) {
+	root := make([]byte, rlh.rootSize)
+	if _, err := io.ReadFull(rlh.r, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// NewRootLeafHasher creates a RootLeafHasher that reads the concatenated
+// roots from r. Each root is h.Size() bytes.
+func NewRootLeafHasher(r io.Reader, h hash.Hash) *RootLeafHasher {
+	return &RootLeafHasher{
+		r:        r,
+		rootSize: h.Size(),
+	}
+}
+
+// BuildFileRangeProof constructs a two-level proof for the leaf range
+// [leafStart, leafEnd) within the sector at sectorIndex. sector must produce
+// the leaves of that sector, and sectorRoots must contain the roots of every
+// sector in the file, as returned by FileRoot. The returned sectorProof
+// proves the leaf range against the sector root, and fileProof proves the
+// sector root against the file root.
+func BuildFileRangeProof(sectorIndex, leafStart, leafEnd int, sector SubtreeHasher, sectorRoots [][]byte, h hash.Hash) (sectorProof, fileProof [][]byte, err error) {
+	if sectorIndex < 0 || sectorIndex >= len(sectorRoots) {
+		panic("BuildFileRangeProof: illegal sector index")
+	}
+	sectorProof, err = BuildRangeProof(leafStart, leafEnd, sector)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileProof, err = BuildRangeProof(sectorIndex, sectorIndex+1, NewCachedSubtreeHasher(sectorRoots, h))
+	if err != nil {
+		return nil, nil, err
+	}
+	return sectorProof, fileProof, nil
+}
+
+// VerifyFileRangeProof verifies a two-level proof produced by
+// BuildFileRangeProof. lh must produce the leaf hashes of the range
+// [leafStart, leafEnd) within the sector at sectorIndex. The sector root is
+// reconstructed from the leaves and sectorProof, and is then verified
+// against fileRoot using fileProof.
+func VerifyFileRangeProof(lh LeafHasher, h hash.Hash, sectorIndex, leafStart, leafEnd int, sectorProof, fileProof [][]byte, fileRoot []byte) (bool, error) {
+	if leafStart < 0 || leafStart >= leafEnd || sectorIndex < 0 {
+		panic("VerifyFileRangeProof: illegal proof range")
+	}
+	sectorRoot, err := rangeProofRoot(lh, h, leafStart, leafEnd, sectorProof)
+	if err != nil {
+		return false, err
+	}
+	return VerifyRangeProof(NewCachedLeafHasher([][]byte{sectorRoot}), h, sectorIndex, sectorIndex+1, fileProof, fileRoot)
+}
@@ -0,0 +1,178 @@
+package merkletree
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestSectorRoots tests that SectorRoots returns the same roots as computing
+// the root of each sector individually.
+func TestSectorRoots(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const sectorSize = 16 * leafSize
+
+	// test full sectors, a short final sector, and a short final leaf
+	for _, dataSize := range []int{0, 1, sectorSize, 3 * sectorSize, 3*sectorSize + 5*leafSize, 3*sectorSize + 5*leafSize + 7} {
+		data := fastrand.Bytes(dataSize)
+		roots, err := SectorRoots(bytes.NewReader(data), sectorSize, leafSize, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numSectors := (dataSize + sectorSize - 1) / sectorSize
+		if len(roots) != numSectors {
+			t.Fatalf("expected %v sector roots, got %v", numSectors, len(roots))
+		}
+		for i := range roots {
+			end := (i + 1) * sectorSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if !bytes.Equal(roots[i], bytesRoot(data[i*sectorSize:end], blake, leafSize)) {
+				t.Errorf("sector root %v of %v-byte data does not match", i, dataSize)
+			}
+		}
+	}
+}
+
+// TestFileRoot tests that FileRoot matches a manual two-level computation.
+func TestFileRoot(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const sectorSize = 16 * leafSize
+
+	for _, dataSize := range []int{1, sectorSize, 3 * sectorSize, 5*sectorSize + 5*leafSize + 7} {
+		data := fastrand.Bytes(dataSize)
+		fileRoot, sectorRoots, err := FileRoot(bytes.NewReader(data), sectorSize, leafSize, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// manually compute the root of each sector, then combine them
+		var manualRoots [][]byte
+		for i := 0; i < len(data); i += sectorSize {
+			end := i + sectorSize
+			if end > len(data) {
+				end = len(data)
+			}
+			manualRoots = append(manualRoots, bytesRoot(data[i:end], blake, leafSize))
+		}
+		for len(manualRoots) > 1 {
+			var next [][]byte
+			for i := 0; i+1 < len(manualRoots); i += 2 {
+				next = append(next, nodeSum(blake, manualRoots[i], manualRoots[i+1]))
+			}
+			if len(manualRoots)%2 == 1 {
+				next = append(next, manualRoots[len(manualRoots)-1])
+			}
+			manualRoots = next
+		}
+		if len(sectorRoots) == 0 || !bytes.Equal(fileRoot, manualRoots[0]) {
+			t.Errorf("file root of %v-byte data does not match manual computation", dataSize)
+		}
+
+		// since there are 16 leaves per sector, the file root should match
+		// the root of the entire file
+		if !bytes.Equal(fileRoot, bytesRoot(data, blake, leafSize)) {
+			t.Errorf("file root of %v-byte data does not match flat root", dataSize)
+		}
+	}
+}
+
+// TestBuildVerifyFileRangeProof tests the BuildFileRangeProof and
+// VerifyFileRangeProof functions.
+func TestBuildVerifyFileRangeProof(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const leavesPerSector = 16
+	const sectorSize = leavesPerSector * leafSize
+
+	// the file has 3 full sectors and a short final sector of 5 leaves
+	for _, dataSize := range []int{sectorSize, 3*sectorSize + 5*leafSize} {
+		data := fastrand.Bytes(dataSize)
+		fileRoot, sectorRoots, err := FileRoot(bytes.NewReader(data), sectorSize, leafSize, blake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for sectorIndex := range sectorRoots {
+			sectorData := data[sectorIndex*sectorSize:]
+			if len(sectorData) > sectorSize {
+				sectorData = sectorData[:sectorSize]
+			}
+			numLeaves := len(sectorData) / leafSize
+			for start := 0; start < numLeaves; start++ {
+				for end := start + 1; end <= numLeaves; end++ {
+					sh := NewReaderSubtreeHasher(bytes.NewReader(sectorData), leafSize, blake)
+					sectorProof, fileProof, err := BuildFileRangeProof(sectorIndex, start, end, sh, sectorRoots, blake)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(sectorRoots) == 1 && len(fileProof) != 0 {
+						t.Fatal("file proof for a single-sector file should be empty")
+					}
+					lh := NewReaderLeafHasher(bytes.NewReader(sectorData[start*leafSize:end*leafSize]), blake, leafSize)
+					ok, err := VerifyFileRangeProof(lh, blake, sectorIndex, start, end, sectorProof, fileProof, fileRoot)
+					if err != nil {
+						t.Fatal(err)
+					} else if !ok {
+						t.Fatalf("failed to verify file range proof for sector %v, range %v-%v", sectorIndex, start, end)
+					}
+
+					// the proof should not verify for the wrong sector
+					if len(sectorRoots) > 1 {
+						wrongSector := (sectorIndex + 1) % len(sectorRoots)
+						lh = NewReaderLeafHasher(bytes.NewReader(sectorData[start*leafSize:end*leafSize]), blake, leafSize)
+						ok, err = VerifyFileRangeProof(lh, blake, wrongSector, start, end, sectorProof, fileProof, fileRoot)
+						if err != nil {
+							t.Fatal(err)
+						} else if ok {
+							t.Fatalf("verified file range proof against the wrong sector")
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestRootLeafHasher tests verifying a file-level range proof whose leaves
+// are sector roots.
+func TestRootLeafHasher(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = 64
+	const sectorSize = 16 * leafSize
+	data := fastrand.Bytes(7*sectorSize + 100)
+	fileRoot, sectorRoots, err := FileRoot(bytes.NewReader(data), sectorSize, leafSize, blake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const start, end = 2, 5
+	proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(sectorRoots, blake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeRoots := bytes.Join(sectorRoots[start:end], nil)
+
+	lh := NewRootLeafHasher(bytes.NewReader(rangeRoots), blake)
+	if ok, err := VerifyRangeProof(lh, blake, start, end, proof, fileRoot); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("failed to verify file-level proof with RootLeafHasher")
+	}
+
+	// hashing the sector roots as leaf data should fail
+	rlh := NewReaderLeafHasher(bytes.NewReader(rangeRoots), blake, blake.Size())
+	if ok, _ := VerifyRangeProof(rlh, blake, start, end, proof, fileRoot); ok {
+		t.Fatal("verified file-level proof using hashed sector roots")
+	}
+
+	// a truncated root should be reported
+	lh = NewRootLeafHasher(bytes.NewReader(rangeRoots[:len(rangeRoots)-1]), blake)
+	if _, err := VerifyRangeProof(lh, blake, start, end, proof, fileRoot); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
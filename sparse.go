@@ -0,0 +1,180 @@
+package merkletree
+
+import (
+	"bytes"
+	"hash"
+)
+
+// A SparseTree is an in-memory sparse Merkle tree, mapping fixed-width keys
+// to leaf hashes. Each key of keySize bytes is interpreted as a big-endian
+// integer, giving the index of its leaf in a perfect tree of 2^(8*keySize)
+// leaves; the bits of the key, from most to least significant, give the path
+// from the root to the leaf. Nearly all of the leaves are empty, so the root
+// of each empty subtree is a precomputed default for its height. Only the
+// nodes on the paths to non-empty leaves are stored.
+//
+// The empty leaf hash is a string of zero bytes, which (unlike the output of
+// leafSum) has no known preimage. Interior nodes are hashed with nodeSum, as
+// in Tree.
+type SparseTree struct {
+	h        hash.Hash
+	keySize  int
+	defaults [][]byte // defaults[i] is the root of an empty subtree of height i
+	nodes    map[sparseNodeKey][]byte
+}
+
+// A sparseNodeKey identifies the node at height whose subtree contains the
+// leaves whose keys begin with prefix. The low height bits of prefix are zero.
+type sparseNodeKey struct {
+	height int
+	prefix string
+}
+
+// sparseKeyBit returns bit i of key, counting from the least significant bit
+// of the big-endian integer.
+func sparseKeyBit(key []byte, i int) bool {
+	return key[len(key)-1-i/8]&(1<<uint(i%8)) != 0
+}
+
+// sparsePrefix returns the prefix of the node at height on the path to key,
+// i.e. key with its low height bits cleared.
+func sparsePrefix(key []byte, height int) string {
+	prefix := append([]byte(nil), key...)
+	for i := 0; i < height; i++ {
+		prefix[len(prefix)-1-i/8] &^= 1 << uint(i%8)
+	}
+	return string(prefix)
+}
+
+// sparseSibling returns the prefix of the sibling of the node at height on
+// the path to key.
+func sparseSibling(key []byte, height int) string {
+	prefix := []byte(sparsePrefix(key, height))
+	prefix[len(prefix)-1-height/8] ^= 1 << uint(height%8)
+	return string(prefix)
+}
+
+// node returns the hash of the node at height whose prefix is prefix,
+// which is the default for its height if the subtree is empty.
+func (st *SparseTree) node(height int, prefix string) []byte {
+	if sum, ok := st.nodes[sparseNodeKey{height, prefix}]; ok {
+		return sum
+	}
+	return st.defaults[height]
+}
+
+// depth returns the height of the tree.
+func (st *SparseTree) depth() int {
+	return 8 * st.keySize
+}
+
+// Update sets the leaf hash of key to leafHash. If leafHash is nil, or equal
+// to the empty leaf hash, key is removed from the tree. Update panics if key
+// is not keySize bytes, or if leafHash is not nil and not the size of the
+// tree's hash.
+func (st *SparseTree) Update(key, leafHash []byte) {
+	if len(key) != st.keySize {
+		panic("SparseTree: key has wrong size")
+	} else if leafHash != nil && len(leafHash) != st.h.Size() {
+		panic("SparseTree: leaf hash has wrong size")
+	}
+	if leafHash == nil {
+		leafHash = st.defaults[0]
+	}
+	// set the leaf, then recompute each node on the path to the root
+	sum := append([]byte(nil), leafHash...)
+	for height := 0; ; height++ {
+		k := sparseNodeKey{height, sparsePrefix(key, height)}
+		if bytes.Equal(sum, st.defaults[height]) {
+			delete(st.nodes, k)
+		} else {
+			st.nodes[k] = sum
+		}
+		if height == st.depth() {
+			return
+		}
+		sibling := st.node(height, sparseSibling(key, height))
+		if sparseKeyBit(key, height) {
+			sum = nodeSum(st.h, sibling, sum)
+		} else {
+			sum = nodeSum(st.h, sum, sibling)
+		}
+	}
+}
+
+// Root returns the Merkle root of the tree.
+func (st *SparseTree) Root() []byte {
+	return append([]byte(nil), st.node(st.depth(), string(make([]byte, st.keySize)))...)
+}
+
+// Get returns the leaf hash of key, or nil if key is not in the tree.
+func (st *SparseTree) Get(key []byte) []byte {
+	if len(key) != st.keySize {
+		panic("SparseTree: key has wrong size")
+	}
+	if sum, ok := st.nodes[sparseNodeKey{0, string(key)}]; ok {
+		return append([]byte(nil), sum...)
+	}
+	return nil
+}
+
+// Prove returns a proof for the leaf at key, consisting of the root of the
+// sibling subtree at each height, from the leaf up to the root. The same
+// proof demonstrates membership (if key is in the tree) or non-membership (if
+// it is not); see VerifySparseProof.
+func (st *SparseTree) Prove(key []byte) [][]byte {
+	if len(key) != st.keySize {
+		panic("SparseTree: key has wrong size")
+	}
+	proof := make([][]byte, st.depth())
+	for height := range proof {
+		proof[height] = append([]byte(nil), st.node(height, sparseSibling(key, height))...)
+	}
+	return proof
+}
+
+// VerifySparseProof verifies a proof, constructed by SparseTree.Prove, that
+// the leaf hash of key in the sparse tree with the given root is leafHash. If
+// leafHash is nil, it instead verifies that key is not in the tree. The tree
+// must use keys of len(key) bytes.
+func VerifySparseProof(h hash.Hash, key, leafHash []byte, proof [][]byte, root []byte) bool {
+	if len(proof) != 8*len(key) {
+		return false
+	}
+	sum := leafHash
+	if sum == nil {
+		sum = make([]byte, h.Size())
+	} else if len(sum) != h.Size() {
+		return false
+	}
+	for height, sibling := range proof {
+		if len(sibling) != h.Size() {
+			return false
+		}
+		if sparseKeyBit(key, height) {
+			sum = nodeSum(h, sibling, sum)
+		} else {
+			sum = nodeSum(h, sum, sibling)
+		}
+	}
+	return bytes.Equal(sum, root)
+}
+
+// NewSparseTree returns an empty SparseTree with keys of keySize bytes,
+// hashed with h. The tree has a height of 8*keySize.
+func NewSparseTree(h hash.Hash, keySize int) *SparseTree {
+	if keySize <= 0 {
+		panic("NewSparseTree: keySize must be positive")
+	}
+	defaults := make([][]byte, 8*keySize+1)
+	defaults[0] = make([]byte, h.Size())
+	for i := 1; i < len(defaults); i++ {
+		defaults[i] = nodeSum(h, defaults[i-1], defaults[i-1])
+	}
+	return &SparseTree{
+		h:        h,
+		keySize:  keySize,
+		defaults: defaults,
+		nodes:    make(map[sparseNodeKey][]byte),
+	}
+}
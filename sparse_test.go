@@ -0,0 +1,78 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestSparseTree tests membership and non-membership proofs in a depth-8
+// SparseTree.
+func TestSparseTree(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	st := NewSparseTree(blake, 1)
+	emptyRoot := st.Root()
+
+	leaves := make(map[byte][]byte)
+	for _, k := range []byte{0, 1, 7, 128, 200, 255} {
+		leaves[k] = leafSum(blake, fastrand.Bytes(16))
+		st.Update([]byte{k}, leaves[k])
+	}
+	root := st.Root()
+
+	// the root should match that of a dense Tree with the same leaves
+	tree := New(blake)
+	for i := 0; i < 256; i++ {
+		leafHash, ok := leaves[byte(i)]
+		if !ok {
+			leafHash = make([]byte, blake.Size())
+		}
+		if err := tree.PushLeafHash(leafHash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(root, tree.Root()) {
+		t.Fatal("SparseTree root does not match dense Tree root")
+	}
+
+	for i := 0; i < 256; i++ {
+		key := []byte{byte(i)}
+		proof := st.Prove(key)
+		leafHash, ok := leaves[byte(i)]
+		if !bytes.Equal(st.Get(key), leafHash) {
+			t.Fatalf("key %v: wrong leaf hash", i)
+		}
+		if ok {
+			// membership
+			if !VerifySparseProof(blake, key, leafHash, proof, root) {
+				t.Fatalf("key %v: membership proof does not verify", i)
+			} else if VerifySparseProof(blake, key, nil, proof, root) {
+				t.Fatalf("key %v: non-membership proof verified for present key", i)
+			}
+		} else {
+			// non-membership
+			if !VerifySparseProof(blake, key, nil, proof, root) {
+				t.Fatalf("key %v: non-membership proof does not verify", i)
+			} else if VerifySparseProof(blake, key, leafSum(blake, nil), proof, root) {
+				t.Fatalf("key %v: membership proof verified for absent key", i)
+			}
+		}
+	}
+
+	// a proof for one key should not verify for another
+	if VerifySparseProof(blake, []byte{1}, leaves[7], st.Prove([]byte{7}), root) {
+		t.Fatal("proof verified for the wrong key")
+	}
+
+	// removing every key should restore the empty root
+	for k := range leaves {
+		st.Update([]byte{k}, nil)
+	}
+	if !bytes.Equal(st.Root(), emptyRoot) {
+		t.Fatal("removing all keys did not restore the empty root")
+	} else if len(st.nodes) != 0 {
+		t.Fatalf("expected no stored nodes, got %v", len(st.nodes))
+	}
+}
@@ -1,8 +1,10 @@
 package merkletree
 
 import (
+	"encoding/binary"
 	"errors"
 	"hash"
+	"math/bits"
 )
 
 // A Tree takes data as leaves and returns the Merkle root. Each call to 'Push'
@@ -36,6 +38,14 @@ type Tree struct {
 	// this flag is somewhat gross, but eliminates needing to duplicate the
 	// entire 'Push' function when writing the cached tree.
 	cachedTree bool
+
+	// The lengthPrefix flag indicates that leaves are hashed with their
+	// length prepended, as in lengthPrefixedLeafSum.
+	lengthPrefix bool
+
+	// leafHash, if non-nil, is used to hash leaves in place of hash, which
+	// is then used only for interior nodes.
+	leafHash hash.Hash
 }
 
 // A subTree contains the Merkle root of a complete (2^height leaves) subTree
@@ -64,6 +74,23 @@ func leafSum(h hash.Hash, data []byte) []byte {
 	return sum(h, leafHashPrefix, data)
 }
 
+// lengthPrefixedLeafSum returns the hash created from data inserted to form a
+// leaf, with the length of the data prepended as a uvarint (as encoded by
+// encoding/binary). Length-prefixed leaf sums are calculated using:
+//		Hash(0x00 || uvarint(len(data)) || data)
+func lengthPrefixedLeafSum(h hash.Hash, data []byte) []byte {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(data)))
+	return sum(h, leafHashPrefix, prefix[:n], data)
+}
+
+// LengthPrefixedLeafHash returns the leaf hash of data as computed by a Tree
+// created with NewLengthPrefixed. It can be used to compute the leaf hashes
+// supplied to a CachedSubtreeHasher or CachedLeafHasher.
+func LengthPrefixedLeafHash(h hash.Hash, data []byte) []byte {
+	return lengthPrefixedLeafSum(h, data)
+}
+
 // nodeSum returns the hash created from two sibling nodes being combined into
 // a parent node. Node sums are calculated using:
 //		Hash(0x01 || left sibling sum || right sibling sum)
@@ -97,6 +124,45 @@ func New(h hash.Hash) *Tree {
 	}
 }
 
+// NewWithLeafHash creates a new Tree that hashes leaves with leafHash and
+// interior nodes with nodeHash, for interoperability with schemes that
+// separate the two by algorithm as well as by prefix. The hashes may differ
+// in size. New(h) is equivalent to NewWithLeafHash(h, h).
+//
+// Proofs for such trees can be built with the SubtreeHashers returned by the
+// WithLeafHash constructors (ReaderSubtreeHasher, its parallel variant,
+// ReaderAtSubtreeHasher, IteratorSubtreeHasher, and RangeProofBuilder), or
+// with any SubtreeHasher that only hashes interior nodes, such as a
+// CachedSubtreeHasher given nodeHash and leaf hashes computed with leafHash.
+// They must be verified with VerifyRangeProofWithLeafHash. All other
+// functions in this package, including PaddedSubtreeHasher, VerifyProof, and
+// the other VerifyRangeProof variants, use a single hash for both leaves and
+// nodes, and do not support separate leaf hashes.
+func NewWithLeafHash(leafHash, nodeHash hash.Hash) *Tree {
+	return &Tree{
+		hash:     nodeHash,
+		leafHash: leafHash,
+	}
+}
+
+// NewLengthPrefixed creates a new Tree that prepends the length of each leaf
+// to its data before hashing, as described in lengthPrefixedLeafSum. This
+// matches Merkle formats that defend against second-preimage attacks on
+// variable-length leaves. Trees created with New do not use length prefixes,
+// so the two will produce different roots for the same data.
+func NewLengthPrefixed(h hash.Hash) *Tree {
+	return &Tree{
+		hash:         h,
+		lengthPrefix: true,
+	}
+}
+
+// NewChecked creates a new Tree that wraps h in a CheckedHash, causing the
+// Tree to panic if the output size of h ever changes.
+func NewChecked(h hash.Hash) *Tree {
+	return New(NewCheckedHash(h))
+}
+
 // Prove creates a proof that the leaf at the established index (established by
 // SetIndex) is an element of the Merkle tree. Prove will return a nil proof
 // set if used incorrectly. Prove does not modify the Tree. Prove can only be
@@ -185,10 +251,16 @@ func (t *Tree) Push(data []byte) {
 		next:   t.head,
 		height: 0,
 	}
+	leafHash := t.hash
+	if t.leafHash != nil {
+		leafHash = t.leafHash
+	}
 	if t.cachedTree {
 		t.head.sum = data
+	} else if t.lengthPrefix {
+		t.head.sum = lengthPrefixedLeafSum(leafHash, data)
 	} else {
-		t.head.sum = leafSum(t.hash, data)
+		t.head.sum = leafSum(leafHash, data)
 	}
 
 	// Join subTrees if possible.
@@ -212,13 +284,58 @@ func (t *Tree) Push(data []byte) {
 	}
 }
 
+// PushLeafHash pushes an already-hashed leaf into the merkle tree. It is
+// equivalent to PushSubTree(0, leafHash). Unlike Push, which hashes its input
+// with leafSum, PushLeafHash uses leafHash as-is; pushing raw leaf data with
+// PushLeafHash, or a leaf hash with Push, will produce an incorrect root.
+func (t *Tree) PushLeafHash(leafHash []byte) error {
+	return t.PushSubTree(0, leafHash)
+}
+
+// PushSpanRoot pushes the root of a cached subtree of leafCount leaves into
+// the merkle tree. It is equivalent to PushSubTree(log2(leafCount), root),
+// and is subject to the same restrictions; additionally, leafCount must be a
+// power of two.
+func (t *Tree) PushSpanRoot(leafCount int, root []byte) error {
+	if leafCount <= 0 || leafCount&(leafCount-1) != 0 {
+		return errors.New("subtree leaf count must be a power of two")
+	}
+	return t.PushSubTree(bits.TrailingZeros64(uint64(leafCount)), root)
+}
+
+// CanPushSubTree reports whether a subtree of the given height can be pushed
+// via PushSubTree. A subtree can be pushed onto an empty Tree at any height;
+// otherwise, its height must not exceed the height of the smallest subtree
+// currently in the Tree, which is the number of trailing zeros in the number
+// of leaves pushed so far. (For example, after pushing 12 leaves, the
+// smallest subtree has height 2, so heights 0, 1, and 2 can be pushed.) If
+// the Tree is building a proof, the subtree additionally must not contain the
+// leaf at the proof index.
+func (t *Tree) CanPushSubTree(height int) bool {
+	if height < 0 {
+		return false
+	}
+	newIndex := t.currentIndex + 1<<uint64(height)
+	if t.proofTree && (t.currentIndex == t.proofIndex ||
+		(t.currentIndex < t.proofIndex && t.proofIndex < newIndex)) {
+		return false
+	}
+	return t.head == nil || height <= t.head.height
+}
+
 // PushSubTree pushes a cached subtree into the merkle tree. The subtree has to
 // be smaller than the smallest subtree in the merkle tree, it has to be
 // balanced and it can't contain the element that needs to be proven.  Since we
 // can't tell if a subTree is balanced, we can't sanity check for unbalanced
 // trees. Therefore an unbalanced tree will cause silent errors, pain and
 // misery for the person who wants to debug the resulting error.
+// PushSubTree returns an error if and only if CanPushSubTree(height) returns
+// false.
 func (t *Tree) PushSubTree(height int, sum []byte) error {
+	if height < 0 {
+		return errors.New("subtree height must not be negative")
+	}
+
 	// Check if the cached tree that is pushed contains the element at
 	// proofIndex. This is not allowed.
 	newIndex := t.currentIndex + 1<<uint64(height)
@@ -262,7 +379,13 @@ func (t *Tree) PushSubTree(height int, sum []byte) error {
 	return nil
 }
 
-// Root returns the Merkle root of the data that has been pushed.
+// Root returns the Merkle root of the data that has been pushed. The root of
+// a Tree containing a single leaf is the leaf hash itself, i.e. leafSum(h,
+// leaf), rather than a nodeSum. Likewise, a range proof for the only leaf of
+// such a tree contains no hashes.
+//
+// Root does not modify the Tree, so it may be called at any time, any number
+// of times, and more data may be pushed afterwards.
 func (t *Tree) Root() []byte {
 	// If the Tree is empty, return nil.
 	if t.head == nil {
@@ -280,6 +403,32 @@ func (t *Tree) Root() []byte {
 	return append(current.sum[:0:0], current.sum...)
 }
 
+// PeekRoot returns the Merkle root of the data that has been pushed so far.
+// It is identical to Root, which never modifies the Tree; the separate name
+// is provided for clarity at call sites that inspect the root of a Tree that
+// is still being built.
+func (t *Tree) PeekRoot() []byte {
+	return t.Root()
+}
+
+// RootAndNumLeaves returns the Merkle root of the data that has been pushed,
+// along with the number of leaves in the Tree. Each call to Push adds one
+// leaf, and each call to PushSubTree adds 2^height leaves.
+func (t *Tree) RootAndNumLeaves() (merkleRoot []byte, numLeaves uint64) {
+	return t.Root(), t.currentIndex
+}
+
+// subtreeRoots returns the roots of the subtrees that currently make up the
+// Tree, ordered from tallest to shortest. This is the same order in which
+// they would be pushed onto an empty Tree via PushSubTree.
+func (t *Tree) subtreeRoots() [][]byte {
+	var roots [][]byte
+	for current := t.head; current != nil; current = current.next {
+		roots = append([][]byte{append([]byte(nil), current.sum...)}, roots...)
+	}
+	return roots
+}
+
 // SetIndex will tell the Tree to create a storage proof for the leaf at the
 // input index. SetIndex must be called on an empty tree.
 func (t *Tree) SetIndex(i uint64) error {
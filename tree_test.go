@@ -489,6 +489,124 @@ func TestLeafCounts(t *testing.T) {
 	}
 }
 
+// TestPeekRoot checks that calling PeekRoot while building a Tree does not
+// affect the final root.
+func TestPeekRoot(t *testing.T) {
+	data := fastrand.Bytes(37)
+	tree := New(sha256.New())
+	peeked := New(sha256.New())
+	for i := range data {
+		tree.Push(data[i : i+1])
+		peeked.Push(data[i : i+1])
+		root := peeked.PeekRoot()
+		if !bytes.Equal(root, peeked.PeekRoot()) || !bytes.Equal(root, bytesRoot(data[:i+1], sha256.New(), 1)) {
+			t.Fatalf("PeekRoot returned the wrong root after %v leaves", i+1)
+		}
+	}
+	if !bytes.Equal(tree.Root(), peeked.Root()) {
+		t.Fatal("calling PeekRoot changed the final root")
+	}
+	if New(sha256.New()).PeekRoot() != nil {
+		t.Fatal("PeekRoot of an empty tree should be nil")
+	}
+}
+
+// TestRootAndNumLeaves checks that RootAndNumLeaves reports the correct leaf
+// count after pushing a mix of leaves and subtrees.
+func TestRootAndNumLeaves(t *testing.T) {
+	tree := New(sha256.New())
+	if root, leaves := tree.RootAndNumLeaves(); root != nil || leaves != 0 {
+		t.Fatal("empty tree should have no root and no leaves")
+	}
+
+	// push 4 leaves, then a subtree of height 2, a subtree of height 1, and
+	// a final leaf
+	for i := 0; i < 4; i++ {
+		tree.Push([]byte{byte(i)})
+	}
+	if err := tree.PushSubTree(2, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.PushSubTree(1, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	tree.Push([]byte{4})
+	root, leaves := tree.RootAndNumLeaves()
+	if leaves != 4+4+2+1 {
+		t.Error("bad reporting of leaf count:", leaves)
+	}
+	if !bytes.Equal(root, tree.Root()) {
+		t.Error("RootAndNumLeaves returned wrong root")
+	}
+}
+
+// TestPushLeafHash checks that pushing leaf hashes with PushLeafHash produces
+// the same root as pushing the raw leaf data with Push.
+func TestPushLeafHash(t *testing.T) {
+	h := sha256.New()
+	dataTree := New(h)
+	hashTree := New(h)
+	for i := 0; i < 13; i++ {
+		data := fastrand.Bytes(64)
+		dataTree.Push(data)
+		if err := hashTree.PushLeafHash(leafSum(h, data)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dataTree.Root(), hashTree.Root()) {
+			t.Fatal("PushLeafHash and Push produced different roots after", i+1, "leaves")
+		}
+	}
+
+	// PushLeafHash is subject to the same restrictions as PushSubTree
+	tree := New(h)
+	if err := tree.SetIndex(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.PushLeafHash(leafSum(h, []byte{0})); err == nil {
+		t.Fatal("expected error when pushing leaf hash at the proof index")
+	}
+}
+
+// TestPushSpanRoot tests that PushSpanRoot infers the height of each subtree
+// from its number of leaves.
+func TestPushSpanRoot(t *testing.T) {
+	h := sha256.New()
+	data := fastrand.Bytes(7 * 64)
+	expected, err := ReaderRoot(bytes.NewReader(data), h, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := New(h)
+	offset := 0
+	for _, leafCount := range []int{4, 2, 1} {
+		root, err := ReaderRoot(bytes.NewReader(data[offset*64:(offset+leafCount)*64]), h, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.PushSpanRoot(leafCount, root); err != nil {
+			t.Fatal(err)
+		}
+		offset += leafCount
+	}
+	if !bytes.Equal(tree.Root(), expected) {
+		t.Fatal("PushSpanRoot produced the wrong root")
+	}
+
+	// non-power-of-two counts and out-of-order pushes should be rejected
+	tree = New(h)
+	for _, leafCount := range []int{0, -1, 3, 6} {
+		if err := tree.PushSpanRoot(leafCount, expected); err == nil {
+			t.Errorf("expected error for leaf count %v", leafCount)
+		}
+	}
+	if err := tree.PushSpanRoot(2, expected); err != nil {
+		t.Fatal(err)
+	} else if err := tree.PushSpanRoot(4, expected); err == nil {
+		t.Fatal("expected error when pushing a larger subtree")
+	}
+}
+
 // TestPushSubTreeCorrectRoot creates data for 4 leaves, combines them in
 // different ways and makes sure that the root is always the same.
 func TestPushSubTreeCorrectRoot(t *testing.T) {
@@ -762,6 +880,59 @@ func TestPushSubTreeSimple(t *testing.T) {
 	}
 }
 
+// TestCanPushSubTree tests that CanPushSubTree correctly predicts which
+// heights can be pushed for various stack states.
+func TestCanPushSubTree(t *testing.T) {
+	tests := []struct {
+		numLeaves int
+		pushable  []int
+	}{
+		{0, []int{0, 1, 2, 3, 4, 5}},
+		{1, []int{0}},
+		{2, []int{0, 1}},
+		{3, []int{0}},
+		{4, []int{0, 1, 2}},
+		{12, []int{0, 1, 2}},
+		{16, []int{0, 1, 2, 3, 4}},
+		{24, []int{0, 1, 2, 3}},
+	}
+	for _, test := range tests {
+		for height := -1; height <= 5; height++ {
+			tree := New(sha256.New())
+			for i := 0; i < test.numLeaves; i++ {
+				tree.Push([]byte{byte(i)})
+			}
+			expected := false
+			for _, h := range test.pushable {
+				expected = expected || h == height
+			}
+			if tree.CanPushSubTree(height) != expected {
+				t.Errorf("with %v leaves, expected CanPushSubTree(%v) to be %v", test.numLeaves, height, expected)
+			}
+			if err := tree.PushSubTree(height, []byte{}); (err == nil) != expected {
+				t.Errorf("with %v leaves, CanPushSubTree(%v) disagrees with PushSubTree: %v", test.numLeaves, height, err)
+			}
+		}
+	}
+
+	// a subtree containing the proof index cannot be pushed
+	tree := New(sha256.New())
+	if err := tree.SetIndex(5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		tree.Push([]byte{byte(i)})
+	}
+	if !tree.CanPushSubTree(0) || tree.CanPushSubTree(1) || tree.CanPushSubTree(2) {
+		t.Error("should not be able to push a subtree containing the proof index")
+	}
+	tree.Push([]byte{4})
+	tree.Push([]byte{5})
+	if !tree.CanPushSubTree(0) || !tree.CanPushSubTree(1) || tree.CanPushSubTree(2) {
+		t.Error("CanPushSubTree returned the wrong result after the proof index")
+	}
+}
+
 // BenchmarkSha256_4MB uses sha256 to hash 4mb of data.
 func BenchmarkSha256_4MB(b *testing.B) {
 	data := make([]byte, 4*1024*1024)
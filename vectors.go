@@ -0,0 +1,48 @@
+package merkletree
+
+import (
+	_ "embed" // for vectorsJSON
+	"encoding/json"
+)
+
+// A TestVector is a known Merkle root and set of range proofs for a
+// deterministic data buffer, for use in testing other implementations of this
+// package's tree. All vectors use BLAKE2b-256, and all hashes are
+// hex-encoded.
+type TestVector struct {
+	// Name identifies the vector.
+	Name string `json:"name"`
+	// Data describes the contents of the data buffer: either "zero", for a
+	// buffer of zero bytes, or "blake2b-counter", for the concatenation of
+	// BLAKE2b-256(uint64le(i)) for i = 0, 1, 2, ..., truncated to DataLen
+	// bytes.
+	Data    string `json:"data"`
+	DataLen int    `json:"dataLen"`
+	// The buffer is split into leaves of LeafSize bytes; the final leaf may
+	// be shorter.
+	LeafSize  int               `json:"leafSize"`
+	NumLeaves int               `json:"numLeaves"`
+	Root      string            `json:"root"`
+	Proofs    []TestVectorProof `json:"proofs"`
+}
+
+// A TestVectorProof is a range proof for the leaves [Start, End), as
+// constructed by BuildRangeProof.
+type TestVectorProof struct {
+	Start int      `json:"start"`
+	End   int      `json:"end"`
+	Proof []string `json:"proof"`
+}
+
+//go:embed testdata/vectors.json
+var vectorsJSON []byte
+
+// TestVectors returns the canonical test vectors for this package, as
+// published in testdata/vectors.json.
+func TestVectors() []TestVector {
+	var vectors []TestVector
+	if err := json.Unmarshal(vectorsJSON, &vectors); err != nil {
+		panic(err) // should never happen
+	}
+	return vectors
+}
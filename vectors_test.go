@@ -0,0 +1,155 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var updateVectors = flag.Bool("update-vectors", false, "regenerate testdata/vectors.json")
+
+// testVectorData returns the data buffer described by a TestVector.
+func testVectorData(data string, dataLen int) []byte {
+	switch data {
+	case "zero":
+		return make([]byte, dataLen)
+	case "blake2b-counter":
+		buf := make([]byte, 0, dataLen+blake2b.Size256)
+		var ctr [8]byte
+		for i := uint64(0); len(buf) < dataLen; i++ {
+			binary.LittleEndian.PutUint64(ctr[:], i)
+			sum := blake2b.Sum256(ctr[:])
+			buf = append(buf, sum[:]...)
+		}
+		return buf[:dataLen]
+	default:
+		panic("unknown test vector data: " + data)
+	}
+}
+
+// generateTestVectors generates the test vectors returned by TestVectors.
+func generateTestVectors() []TestVector {
+	const bigLen = 1 << 22
+	const bigLeaves = bigLen / 64
+	specs := []struct {
+		name     string
+		data     string
+		dataLen  int
+		leafSize int
+		ranges   [][2]int
+	}{
+		{"zero-4MiB", "zero", bigLen, 64, [][2]int{
+			{0, 1},
+			{bigLeaves - 1, bigLeaves},
+			{10, 11},
+			{bigLeaves/2 - 1, bigLeaves/2 + 1},
+			{0, bigLeaves},
+		}},
+		{"blake2b-counter-partial", "blake2b-counter", 13*64 + 10, 64, [][2]int{
+			{0, 1},
+			{3, 7},
+			{8, 12},
+			{13, 14},
+			{5, 14},
+			{0, 14},
+		}},
+		{"blake2b-counter-single", "blake2b-counter", 5, 64, [][2]int{
+			{0, 1},
+		}},
+	}
+
+	h, _ := blake2b.New256(nil)
+	vectors := make([]TestVector, 0, len(specs))
+	for _, spec := range specs {
+		data := testVectorData(spec.data, spec.dataLen)
+		root, err := ReaderRoot(bytes.NewReader(data), h, spec.leafSize)
+		if err != nil {
+			panic(err) // should never happen
+		}
+		tv := TestVector{
+			Name:      spec.name,
+			Data:      spec.data,
+			DataLen:   spec.dataLen,
+			LeafSize:  spec.leafSize,
+			NumLeaves: (spec.dataLen + spec.leafSize - 1) / spec.leafSize,
+			Root:      hex.EncodeToString(root),
+		}
+		for _, r := range spec.ranges {
+			proof, err := BuildRangeProofFromBytes(data, spec.leafSize, r[0], r[1], h)
+			if err != nil {
+				panic(err) // should never happen
+			}
+			tvp := TestVectorProof{
+				Start: r[0],
+				End:   r[1],
+				Proof: make([]string, len(proof)),
+			}
+			for i := range proof {
+				tvp.Proof[i] = hex.EncodeToString(proof[i])
+			}
+			tv.Proofs = append(tv.Proofs, tvp)
+		}
+		vectors = append(vectors, tv)
+	}
+	return vectors
+}
+
+// TestTestVectors tests that the generated test vectors match the published
+// vectors, and that each of them verifies.
+func TestTestVectors(t *testing.T) {
+	vectors := generateTestVectors()
+	js, err := json.MarshalIndent(vectors, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js = append(js, '\n')
+	path := filepath.Join("testdata", "vectors.json")
+	if *updateVectors {
+		if err := ioutil.WriteFile(path, js, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	published, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(js, published) {
+		t.Fatal("generated test vectors do not match", path)
+	} else if !*updateVectors && !reflect.DeepEqual(TestVectors(), vectors) {
+		t.Fatal("TestVectors does not match the generated test vectors")
+	}
+
+	// the first vector is the tree used by TestBuildVerifyRangeProof
+	if vectors[0].Root != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
+		t.Fatal("wrong root for first test vector:", vectors[0].Root)
+	}
+
+	blake, _ := blake2b.New256(nil)
+	for _, tv := range vectors {
+		data := testVectorData(tv.Data, tv.DataLen)
+		root, _ := hex.DecodeString(tv.Root)
+		for _, tvp := range tv.Proofs {
+			proof := make([][]byte, len(tvp.Proof))
+			for i := range proof {
+				proof[i], _ = hex.DecodeString(tvp.Proof[i])
+			}
+			end := tvp.End * tv.LeafSize
+			if end > len(data) {
+				end = len(data)
+			}
+			lh := NewReaderLeafHasher(bytes.NewReader(data[tvp.Start*tv.LeafSize:end]), blake, tv.LeafSize)
+			if ok, err := VerifyRangeProof(lh, blake, tvp.Start, tvp.End, proof, root); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("%v: proof for [%v, %v) does not verify", tv.Name, tvp.Start, tvp.End)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// A RangeVerifier verifies a range proof whose pieces arrive separately and
+// possibly out of order, e.g. over a multiplexed or resumable connection.
+// Proof hashes are tagged with their position among the left-side hashes
+// (covering leaves before the proof range) or the right-side hashes
+// (covering leaves after the proof range), and leaf hashes are tagged with
+// their leaf index. Once every piece has arrived, Verify checks the proof.
+type RangeVerifier struct {
+	h          hash.Hash
+	proofStart int
+	proofEnd   int
+	root       []byte
+
+	left   [][]byte
+	right  [][]byte
+	leaves [][]byte
+}
+
+// add stores b at index i of pieces, returning an error if i is out of
+// bounds or a different piece was previously stored at i.
+func (rv *RangeVerifier) add(pieces [][]byte, i int, b []byte) error {
+	if i < 0 || i >= len(pieces) {
+		return errors.New("piece index out of range")
+	} else if len(b) != rv.h.Size() {
+		return ErrBadHashLength
+	} else if pieces[i] != nil && !bytes.Equal(pieces[i], b) {
+		return errors.New("conflicting piece received")
+	}
+	pieces[i] = append([]byte(nil), b...)
+	return nil
+}
+
+// AddLeftHash adds the i'th left-side proof hash, i.e. the i'th hash covering
+// leaves before the proof range.
+func (rv *RangeVerifier) AddLeftHash(i int, proofHash []byte) error {
+	return rv.add(rv.left, i, proofHash)
+}
+
+// AddRightHash adds the i'th right-side proof hash, i.e. the i'th hash
+// covering leaves after the proof range.
+func (rv *RangeVerifier) AddRightHash(i int, proofHash []byte) error {
+	return rv.add(rv.right, i, proofHash)
+}
+
+// AddLeafHash adds the hash of the leaf at index, which must be within the
+// proof range.
+func (rv *RangeVerifier) AddLeafHash(index int, leafHash []byte) error {
+	return rv.add(rv.leaves, index-rv.proofStart, leafHash)
+}
+
+// Missing returns the positions of the left-side proof hashes, right-side
+// proof hashes, and leaf indices that have not yet been received.
+func (rv *RangeVerifier) Missing() (left, right, leaves []int) {
+	for i := range rv.left {
+		if rv.left[i] == nil {
+			left = append(left, i)
+		}
+	}
+	for i := range rv.right {
+		if rv.right[i] == nil {
+			right = append(right, i)
+		}
+	}
+	for i := range rv.leaves {
+		if rv.leaves[i] == nil {
+			leaves = append(leaves, rv.proofStart+i)
+		}
+	}
+	return left, right, leaves
+}
+
+// Complete returns true if every piece of the proof has been received.
+func (rv *RangeVerifier) Complete() bool {
+	left, right, leaves := rv.Missing()
+	return len(left) == 0 && len(right) == 0 && len(leaves) == 0
+}
+
+// Verify verifies the proof. It returns an error if any pieces are missing.
+func (rv *RangeVerifier) Verify() (bool, error) {
+	if !rv.Complete() {
+		return false, errors.New("proof is incomplete")
+	}
+	proof := append(append([][]byte(nil), rv.left...), rv.right...)
+	return VerifyRangeProof(NewCachedLeafHasher(rv.leaves), rv.h, rv.proofStart, rv.proofEnd, proof, rv.root)
+}
+
+// NewRangeVerifier creates a RangeVerifier for the leaf range [proofStart,
+// proofEnd) within a tree of numLeaves leaves with the specified root.
+func NewRangeVerifier(h hash.Hash, numLeaves, proofStart, proofEnd int, root []byte) *RangeVerifier {
+	if proofStart < 0 || proofStart >= proofEnd || proofEnd > numLeaves {
+		panic("NewRangeVerifier: illegal proof range")
+	}
+	return &RangeVerifier{
+		h:          h,
+		proofStart: proofStart,
+		proofEnd:   proofEnd,
+		root:       root,
+
+		left:   make([][]byte, rangeProofSizeLeft(proofStart)),
+		right:  make([][]byte, rangeProofSizeRight(numLeaves, proofEnd)),
+		leaves: make([][]byte, proofEnd-proofStart),
+	}
+}
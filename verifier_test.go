@@ -0,0 +1,88 @@
+package merkletree
+
+import (
+	"testing"
+
+	"github.com/HyperspaceApp/fastrand"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestRangeVerifier tests that a RangeVerifier can verify a proof whose
+// pieces arrive in a random order.
+func TestRangeVerifier(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const numLeaves = 37
+	leafHashes := make([][]byte, numLeaves)
+	for i := range leafHashes {
+		leafHashes[i] = leafSum(blake, fastrand.Bytes(64))
+	}
+	tree := New(blake)
+	for _, lh := range leafHashes {
+		tree.PushSubTree(0, lh)
+	}
+	root := tree.Root()
+
+	for n := 0; n < 20; n++ {
+		start := fastrand.Intn(numLeaves)
+		end := start + fastrand.Intn(numLeaves-start) + 1
+		proof, err := BuildRangeProof(start, end, NewCachedSubtreeHasher(leafHashes, blake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		numLeft := rangeProofSizeLeft(start)
+
+		// create a shuffled list of pieces
+		rv := NewRangeVerifier(blake, numLeaves, start, end, root)
+		var pieces []func() error
+		for i := range proof {
+			i := i
+			if i < numLeft {
+				pieces = append(pieces, func() error { return rv.AddLeftHash(i, proof[i]) })
+			} else {
+				pieces = append(pieces, func() error { return rv.AddRightHash(i-numLeft, proof[i]) })
+			}
+		}
+		for i := start; i < end; i++ {
+			i := i
+			pieces = append(pieces, func() error { return rv.AddLeafHash(i, leafHashes[i]) })
+		}
+		for j, i := range fastrand.Perm(len(pieces)) {
+			if rv.Complete() {
+				t.Fatal("verifier is complete before all pieces have arrived")
+			} else if _, err := rv.Verify(); err == nil {
+				t.Fatal("expected error when verifying incomplete proof")
+			}
+			left, right, leaves := rv.Missing()
+			if len(left)+len(right)+len(leaves) != len(pieces)-j {
+				t.Fatal("verifier reported wrong number of missing pieces")
+			}
+			if err := pieces[i](); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ok, err := rv.Verify()
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("failed to verify range %v-%v", start, end)
+		}
+	}
+
+	// pieces out of range or conflicting with earlier pieces are rejected
+	rv := NewRangeVerifier(blake, numLeaves, 3, 5, root)
+	if err := rv.AddLeafHash(5, leafHashes[5]); err == nil {
+		t.Fatal("expected error for leaf outside of proof range")
+	}
+	if err := rv.AddLeftHash(2, leafHashes[0]); err == nil {
+		t.Fatal("expected error for nonexistent left hash")
+	}
+	if err := rv.AddLeafHash(3, leafHashes[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := rv.AddLeafHash(3, leafHashes[4]); err == nil {
+		t.Fatal("expected error for conflicting leaf hash")
+	}
+	if err := rv.AddRightHash(0, leafHashes[0][:5]); err != ErrBadHashLength {
+		t.Fatal("expected ErrBadHashLength, got", err)
+	}
+}